@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runs a ring of peers under churn, i.e. peers joining, leaving and crashing at random,
+// while storing & verifying files through it. Reports the fraction of the files that
+// could still be retrieved intact at the end. The sequence of events is the same for
+// the same seed.
+//
+// Every file is stored only on the owner of its key, so the files of a crashed peer
+// are lost. Leaving peers hand their files over to their successors.
+
+var peerPath = flag.String("peer", "./peer", "path of the peer executable")
+var basePort = flag.Int("baseport", 47000, "port of the first peer, the others get the following ports")
+var initialNodes = flag.Int("nodes", 4, "number of peers in the ring at the start")
+var minNodes = flag.Int("minnodes", 2, "number of peers below which no peer leaves or crashes")
+var maxNodes = flag.Int("maxnodes", 8, "number of peers above which no peer joins")
+var fileCount = flag.Int("files", 20, "number of files to store & verify")
+var duration = flag.Duration("duration", 30*time.Second, "how long to run the churn")
+var interval = flag.Duration("interval", 2*time.Second, "interval between the churn events")
+var joinWeight = flag.Int("join", 2, "relative weight of the joins among the churn events")
+var leaveWeight = flag.Int("leave", 2, "relative weight of the graceful leaves among the churn events")
+var crashWeight = flag.Int("crash", 0, "relative weight of the crashes among the churn events")
+var seed = flag.Int64("seed", 1, "seed of the random churn events & file contents")
+var settleTime = flag.Duration("settle", 500*time.Millisecond, "time given to a peer to start, join or leave")
+
+// The size of the ring, which must match the peers'.
+var ringCapacity uint32 = 127
+
+// Returns the key of the given file name, or the id of the given peer address.
+func hsh(in string) int {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(in))
+	return int(hasher.Sum32() % ringCapacity)
+}
+
+// A peer process of the ring.
+type node struct {
+	Address string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+}
+
+// Starts a peer on the given port, with its directory under the given one.
+func startNode(port int, workDir string) (*node, error) {
+	dir := filepath.Join(workDir, strconv.Itoa(port))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	address := "127.0.0.1:" + strconv.Itoa(port)
+	cmd := exec.Command(*peerPath, "-advertise", address, strconv.Itoa(port))
+	cmd.Dir = dir
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(*settleTime)
+	return &node{Address: address, cmd: cmd, stdin: stdin}, nil
+}
+
+// Joins the peer to the ring through the given initiator.
+func (n *node) join(initiatorAddr string) {
+	fmt.Fprintf(n.stdin, "1\n%s\n", initiatorAddr)
+	time.Sleep(*settleTime)
+}
+
+// Makes the peer leave the ring gracefully, handing its files over.
+func (n *node) leave() {
+	fmt.Fprintf(n.stdin, "7\n")
+	done := make(chan error, 1)
+	go func() { done <- n.cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(10 * *settleTime):
+		log.Println("The peer", n.Address, "did not leave in time, killing it.")
+		n.cmd.Process.Kill()
+		<-done
+	}
+}
+
+// Kills the peer without letting it leave.
+func (n *node) crash() {
+	n.cmd.Process.Kill()
+	n.cmd.Wait()
+}
+
+// Asks the given peer for the owner of the given key.
+// SUCC <id> => <succ addr> | ERR <msg>
+func findOwner(key int, peerAddr string) (string, error) {
+	conn, err := net.DialTimeout("tcp", peerAddr, time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "SUCC %d\n", key)
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	answer = strings.TrimSpace(answer)
+	if strings.HasPrefix(answer, "ERR") || strings.HasPrefix(answer, "NEXT") {
+		return "", fmt.Errorf("unexpected answer %q", answer)
+	}
+	return answer, nil
+}
+
+// Reads an `OK ...` response and returns its message.
+func readOK(reader *bufio.Reader) (string, error) {
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	response = strings.TrimSpace(response)
+	if !strings.HasPrefix(response, "OK") {
+		return "", fmt.Errorf("unexpected response %q", response)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(response, "OK")), nil
+}
+
+// Stores the given contents as the given file through the given peer.
+// STORE <file name> <file size> => OK, the file, OK
+func storeFile(fileName string, contents []byte, peerAddr string) error {
+	ownerAddr, err := findOwner(hsh(fileName), peerAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", ownerAddr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "STORE %s %d\n", fileName, len(contents))
+	_, err = readOK(reader)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(contents)
+	if err != nil {
+		return err
+	}
+	_, err = readOK(reader)
+	return err
+}
+
+// Retrieves the given file through the given peer.
+// RETRIEVE <file name> => OK <file size>, the file, OK
+func retrieveFile(fileName string, peerAddr string) ([]byte, error) {
+	ownerAddr, err := findOwner(hsh(fileName), peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", ownerAddr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "RETRIEVE %s\n", fileName)
+	sizeString, err := readOK(reader)
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.Atoi(sizeString)
+	if err != nil {
+		return nil, fmt.Errorf("malformed size %q", sizeString)
+	}
+	contents := make([]byte, size)
+	_, err = io.ReadFull(reader, contents)
+	if err != nil {
+		return nil, err
+	}
+	_, err = readOK(reader)
+	return contents, err
+}
+
+// Tries the given operation a few times, as a peer that is joining or leaving may
+// not be ready to answer.
+func retry(op func() error) error {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		err = op()
+		if err == nil {
+			return nil
+		}
+		time.Sleep(*settleTime / 2)
+	}
+	return err
+}
+
+// Checks whether the given contents are one of the given versions.
+func oneOf(contents []byte, versions [][]byte) bool {
+	for _, version := range versions {
+		if bytes.Equal(contents, version) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns random contents for a version of a file.
+func randomContents(rng *rand.Rand) []byte {
+	contents := make([]byte, 1+rng.Intn(4096))
+	rng.Read(contents)
+	return contents
+}
+
+func main() {
+	flag.Parse()
+	if *initialNodes < 1 || *minNodes < 1 || *maxNodes < *initialNodes {
+		log.Fatalln("Invalid node counts.")
+	}
+	if *joinWeight+*leaveWeight+*crashWeight <= 0 {
+		log.Fatalln("At least one kind of churn event needs a positive weight.")
+	}
+	os.Exit(run())
+}
+
+// Runs the churn and returns the exit code, which is non-zero if a file was lost.
+func run() int {
+	rng := rand.New(rand.NewSource(*seed))
+	workDir, err := os.MkdirTemp("", "churn-")
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer os.RemoveAll(workDir)
+	// Start the ring.
+	nextPort := *basePort
+	nodes := []*node{}
+	defer func() {
+		for _, n := range nodes {
+			n.crash()
+		}
+	}()
+	for i := 0; i < *initialNodes; i++ {
+		n, err := startNode(nextPort, workDir)
+		if err != nil {
+			log.Println("Could not start a peer:", err)
+			return 1
+		}
+		nextPort++
+		if len(nodes) > 0 {
+			n.join(nodes[0].Address)
+		}
+		nodes = append(nodes, n)
+	}
+	// Store the first version of each file. A file can be expected to have one of
+	// several versions, as a failed update may have still been stored.
+	fileNames := []string{}
+	expected := make(map[string][][]byte)
+	for i := 0; i < *fileCount; i++ {
+		fileName := fmt.Sprintf("churn-%d.bin", i)
+		contents := randomContents(rng)
+		err := retry(func() error { return storeFile(fileName, contents, nodes[0].Address) })
+		if err != nil {
+			log.Println("Could not store", fileName+":", err)
+			return 1
+		}
+		fileNames = append(fileNames, fileName)
+		expected[fileName] = [][]byte{contents}
+	}
+	fmt.Println("Stored", len(fileNames), "files on", len(nodes), "peers.")
+	// Churn, while updating & verifying the files in between the events.
+	joins, leaves, crashes, failedChecks := 0, 0, 0, 0
+	deadline := time.Now().Add(*duration)
+	for time.Now().Before(deadline) {
+		entry := nodes[rng.Intn(len(nodes))]
+		// Update a file. If the update fails, e.g. its final OK is lost, it is not known
+		// whether it was stored, so either version is expected.
+		fileName := fileNames[rng.Intn(len(fileNames))]
+		contents := randomContents(rng)
+		err := retry(func() error { return storeFile(fileName, contents, entry.Address) })
+		if err == nil {
+			expected[fileName] = [][]byte{contents}
+		} else {
+			expected[fileName] = append(expected[fileName], contents)
+		}
+		// Verify a file.
+		fileName = fileNames[rng.Intn(len(fileNames))]
+		retrieved, err := retrieveFile(fileName, entry.Address)
+		if err != nil || !oneOf(retrieved, expected[fileName]) {
+			failedChecks++
+		}
+		// Pick a churn event.
+		event := rng.Intn(*joinWeight + *leaveWeight + *crashWeight)
+		switch {
+		case event < *joinWeight:
+			if len(nodes) >= *maxNodes {
+				break
+			}
+			n, err := startNode(nextPort, workDir)
+			nextPort++
+			if err != nil {
+				log.Println("Could not start a peer:", err)
+				break
+			}
+			n.join(nodes[rng.Intn(len(nodes))].Address)
+			nodes = append(nodes, n)
+			joins++
+		case len(nodes) <= *minNodes:
+		case event < *joinWeight+*leaveWeight:
+			i := rng.Intn(len(nodes))
+			nodes[i].leave()
+			nodes = append(nodes[:i], nodes[i+1:]...)
+			leaves++
+		default:
+			i := rng.Intn(len(nodes))
+			nodes[i].crash()
+			nodes = append(nodes[:i], nodes[i+1:]...)
+			crashes++
+		}
+		time.Sleep(*interval)
+	}
+	// Verify every file through a random remaining peer.
+	intact := 0
+	for _, fileName := range fileNames {
+		retrieved, err := retrieveFile(fileName, nodes[rng.Intn(len(nodes))].Address)
+		if err == nil && oneOf(retrieved, expected[fileName]) {
+			intact++
+		} else if err != nil {
+			fmt.Println("Lost", fileName+":", err)
+		} else {
+			fmt.Println("Lost", fileName+": the contents do not match")
+		}
+	}
+	fmt.Printf("Churn: %d joins, %d leaves, %d crashes, %d peers left\n", joins, leaves, crashes, len(nodes))
+	fmt.Println("Failed checks during the churn:", failedChecks)
+	fmt.Printf("Durability: %d/%d files intact (%.1f%%)\n", intact, len(fileNames), 100*float64(intact)/float64(len(fileNames)))
+	if intact < len(fileNames) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Runs a short churn of joins & graceful leaves against real peers, which must not lose
+// a file. The peer does not replicate the files, so the crashes are left out: this only
+// checks that the files are handed over on the joins & leaves, not that they survive
+// the loss of their owner. Set CHURN_PEER to the path of a peer executable to run it.
+func TestChurnLosesNoFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the churn takes a while")
+	}
+	peer := os.Getenv("CHURN_PEER")
+	if peer == "" {
+		t.Skip("CHURN_PEER is not set")
+	}
+	// The peers run in directories of their own.
+	peer, err := filepath.Abs(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*peerPath = peer
+	*fileCount = 10
+	*duration = 10 * time.Second
+	*interval = 500 * time.Millisecond
+	// A crash loses the files of the peer for good.
+	*crashWeight = 0
+	if code := run(); code != 0 {
+		t.Errorf("the churn lost files")
+	}
+}
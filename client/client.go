@@ -1,15 +1,26 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"hash/fnv"
 	"io"
-	"log"
 	"net"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,30 +28,116 @@ var mainMenu = `
 1) Enter the filename to store
 2) Enter the filename to retrieve
 3) Exit
+4) Export a peer's files into a tar archive
+5) Import a tar archive into the ring
+6) Enter the filename to delete
+7) Enter the filename to store with a TTL
+8) List the files on a peer's neighbors
+9) Describe the ring
+10) Rename a file
+11) Enter the filename to retrieve and its expected SHA-256 checksum
+12) Put a file under its content hash
+13) Get a file by its content hash
+14) Check the ring invariants
+15) Push a file from its owner to another peer
+16) Refresh the TTL of a file
+17) Retrieve several files
+18) Trace the route to a key
+19) Compare the keys of two peers
+20) Store all files in a directory
+21) Pin a file
+22) Measure the latency of each peer
+23) List the files matching a pattern
+24) Forget a file on every peer
+25) Check that files are stored & retrievable
+26) Show the most accessed files in the ring
+27) Watch a file for changes
+28) Repair the predecessor pointers
+29) Store several files all or nothing
 `
 
-var hasher = fnv.New32a()
+// Debug only: when set, files are stored on & retrieved from this peer directly,
+// regardless of which peer actually owns them.
+var directAddr = flag.String("direct", "", "(debug only) store & retrieve on the given peer address, bypassing routing, even if the peer does not own the files")
+
+// When set, the entry peer is reached through this Unix domain socket instead.
+var unixPath = flag.String("unix", "", "connect to the peer listening on the Unix domain socket at the given path")
+
+// When unset, storing a directory stops at the first file that could not be stored.
+var continueOnError = flag.Bool("continue-on-error", true, "keep storing the rest of a directory after a file could not be stored")
+
+var connectTimeout = flag.Duration("timeout", 5*time.Second, "timeout for connecting to a peer")
+
+// The peers discard a transaction that is idle for longer than their control timeout,
+// 30 seconds by default.
+var txnKeepAlive = flag.Duration("txnkeepalive", 10*time.Second, "how often a staged transaction is kept alive while the other owners are staged")
+
+// When set, the owners are computed locally from a cached copy of the ring, which is
+// fetched again once it is older than this.
+var ringCacheTTL = flag.Duration("ringcache", 0, "compute the owners locally from the ring, fetching it again after this long (0 disables)")
+
+// When set, the hops of each lookup are printed.
+var traceLookups = flag.Bool("trace", false, "print the peers visited by each lookup")
+
 var ringCapacity uint32 = 127
 
+// The hash function & the protocol version that this client expects the peers to use.
+const hashAlgorithm = "fnv32a"
+const protocolVersion = 1
+
+// The seed mixed into the hash of the keys, which must be the one of the ring.
+var hashSeed = flag.String("hashseed", "", "seed mixed into the hash of the keys (default: the one of the peer)")
+
 // Returns the id of a node (given its full address) or key of a file (given its name).
 func hsh(in string) int {
+	// A hasher per call, as the ids & keys are hashed from many goroutines at once.
+	hasher := fnv.New32a()
+	hasher.Write([]byte(*hashSeed))
 	hasher.Write([]byte(in))
-	digest := hasher.Sum32()
-	hasher.Reset()
-	return int(digest % ringCapacity)
+	return int(hasher.Sum32() % ringCapacity)
+}
+
+// Checks if n is between low and high (exclusive) on the ring.
+func between(low int, n int, high int) bool {
+	if low == high {
+		return true
+	}
+	perimeter := int(ringCapacity)
+	if high < low {
+		high += perimeter
+		if n < low {
+			n += perimeter
+		}
+	}
+	return (n > low && n < high)
+}
+
+// Checks whether the node with the given id & address owns the given key, given the id
+// & address of its predecessor. Of the nodes with the same id, the one with the lowest
+// address owns the keys up to the id, and the others own none.
+func ownsKey(predID int, predAddr string, nodeID int, nodeAddr string, key int) bool {
+	if predID == nodeID {
+		return predAddr >= nodeAddr
+	}
+	return between(predID, key, nodeID) || key == nodeID
 }
 
-// Connects to the peer at the given address.
-func connectToPeer(address string) (net.Conn, *bufio.Reader) {
+// Connects to the peer at the given address, giving up after the connect timeout.
+func connectToPeer(address string) (net.Conn, *bufio.Reader, error) {
 	address = strings.TrimSpace(address)
-	conn, err := net.Dial("tcp", address)
+	network, dialAddr := "tcp", address
+	if strings.HasPrefix(address, "unix:") {
+		network, dialAddr = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	conn, err := net.DialTimeout(network, dialAddr, *connectTimeout)
 	if err != nil {
-		log.Println("Could not connect to the peer.")
-		log.Fatalln(err)
+		// The cached ring may be out of date if a peer has left.
+		invalidateRing()
+		return nil, nil, fmt.Errorf("%w: could not connect to %s: %v", ErrNetwork, address, err)
 	}
 	// Create a buffered reader.
 	reader := bufio.NewReader(conn)
-	return conn, reader
+	return conn, reader, nil
 }
 
 // The server sends responses in the following form:
@@ -64,149 +161,2696 @@ func extractServerResponse(resp string) (string, string) {
 	return prefix, msg
 }
 
+// Errors returned from the operations on the ring.
+var (
+	// The requested file is not stored in the ring.
+	ErrNotFound = errors.New("file does not exist")
+	// The peer could not be reached or the connection failed midway.
+	ErrNetwork = errors.New("network failure")
+	// The peer rejected the request for any other reason.
+	ErrServer = errors.New("server error")
+	// The retrieved file does not have the expected checksum.
+	ErrChecksum = errors.New("checksum mismatch")
+	// The user canceled the operation.
+	ErrCanceled = errors.New("canceled")
+	// The peer does not support the requested feature.
+	ErrUnsupported = errors.New("unsupported feature")
+	// The peer can not take the request until it settles into the ring.
+	ErrNotReady = errors.New("peer not ready")
+	// The ring has no node that can take the file.
+	ErrNoOwner = errors.New("no node can store the file")
+	// The request reached a peer that does not own the file.
+	ErrNotOwner = errors.New("peer is not the owner")
+)
+
+// Converts an `ERR <error msg>` response from the server into an error.
+func responseError(respMsg string) error {
+	if respMsg == "File does not exist." {
+		return ErrNotFound
+	}
+	if respMsg == "Not ready, retry" {
+		return ErrNotReady
+	}
+	if respMsg == "Not the owner." {
+		return ErrNotOwner
+	}
+	if respMsg == "Node stores no data" {
+		return fmt.Errorf("%w: %s", ErrNoOwner, respMsg)
+	}
+	return fmt.Errorf("%w: %s", ErrServer, respMsg)
+}
+
 // Constructs a store request with the file name to store, then sends the file.
 // (1) finds the successor (owner) of the file through the given peer.
 // (2) uploads the file to the owner of the file.
-func storeFile(fileName string, peerAddr string) {
-	// Find the successor (owner) of the file.
-	fileKey := hsh(fileName)
-	succAddr := askForSuccesor(fileKey, peerAddr)
-	// Begin trying to store the file on the successor.
-	conn, reader := connectToPeer(succAddr)
-	defer conn.Close()
+// The file expires after the given TTL in seconds, or never if it is zero.
+func storeFile(fileName string, ttl int, peerAddr string) error {
 	srcFile, err := os.Open(fileName)
-	defer srcFile.Close()
 	if err != nil {
-		log.Println("Could not send store request")
-		log.Fatalln(err)
+		return err
 	}
+	defer srcFile.Close()
 	fileInfo, _ := srcFile.Stat()
-	fileSize := fileInfo.Size()
+	// A retry uses the same token, so that the peer does not store the file twice
+	// if the first attempt has actually succeeded.
+	token := newStoreToken()
+	err = storeContents(fileName, fileInfo.Size(), srcFile, ttl, token, peerAddr)
+	if errors.Is(err, ErrNetwork) {
+		fmt.Println("> Retrying after", err)
+		srcFile.Seek(0, io.SeekStart)
+		err = storeContents(fileName, fileInfo.Size(), srcFile, ttl, token, peerAddr)
+	}
+	return err
+}
+
+// Returns a random token that identifies a single store operation.
+func newStoreToken() string {
+	token := make([]byte, 8)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// Stores the given number of bytes from the source under the given file name.
+// (1) finds the successor (owner) of the file through the given peer.
+// (2) uploads the contents to the owner of the file.
+// If the token is not empty, it is sent along so that the owner can recognize retries.
+// If the owner is not ready yet, the store is tried again with an increasing delay.
+func storeContents(fileName string, fileSize int64, src io.Reader, ttl int, token string, peerAddr string) error {
+	delay := 100 * time.Millisecond
+	err := storeContentsOnce(fileName, fileSize, src, ttl, token, peerAddr)
+	// The owner refuses the store before any of the contents are sent, so the source
+	// can be read again from the start.
+	for attempt := 1; errors.Is(err, ErrNotReady) && attempt < 6; attempt++ {
+		fmt.Println("> The owner is not ready, retrying in", delay)
+		time.Sleep(delay)
+		delay *= 2
+		err = storeContentsOnce(fileName, fileSize, src, ttl, token, peerAddr)
+	}
+	return err
+}
+
+// Makes a single attempt of storeContents.
+func storeContentsOnce(fileName string, fileSize int64, src io.Reader, ttl int, token string, peerAddr string) error {
+	// Find the successor (owner) of the file.
+	fileKey := hsh(fileName)
+	succAddr, conn, reader, err := connectToOwner(fileKey, peerAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if ttl > 0 {
+		err := requireCapability(succAddr, "ttl")
+		if err != nil {
+			return err
+		}
+	}
 	// Send the store request.
-	storeRequest := fmt.Sprintf("STORE %s %d\n", fileName, fileSize)
-	conn.Write([]byte(storeRequest))
+	storeRequest := fmt.Sprintf("STORE %s %d", fileName, fileSize)
+	if ttl > 0 {
+		storeRequest += fmt.Sprintf(" ttl=%d", ttl)
+	}
+	if token != "" {
+		storeRequest += " token=" + token
+	}
+	_, err = conn.Write([]byte(storeRequest + "\n"))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
 	// Read the response.
-	serverResponse, _ := reader.ReadString('\n')
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
 	respType, respMsg := extractServerResponse(serverResponse)
 	// Response: ERR <error msg>
 	if respType != "OK" {
-		fmt.Println("> Server response:", respMsg)
-		return
+		return responseError(respMsg)
+	}
+	// Response: OK STORED, the file was already stored with the same token.
+	if respMsg == "STORED" {
+		return nil
 	}
 	// Response: OK
-	io.Copy(conn, srcFile)
+	// Ctrl-C during the upload cancels the store by closing the connection, upon
+	// which the peer discards what it has received so far.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	uploaded := make(chan struct{})
+	canceled := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupts:
+			close(canceled)
+			conn.Close()
+		case <-uploaded:
+		}
+	}()
+	_, err = io.CopyN(conn, src, fileSize)
+	close(uploaded)
+	signal.Stop(interrupts)
+	select {
+	case <-canceled:
+		return ErrCanceled
+	default:
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
 	// Read the next response.
-	serverResponse, _ = reader.ReadString('\n')
+	serverResponse, err = reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
 	respType, respMsg = extractServerResponse(serverResponse)
 	// Response: ERR <error msg>
 	if respType != "OK" {
-		fmt.Println("> Server response:", respMsg)
-		return
+		return responseError(respMsg)
 	}
 	// Response: OK
-	fmt.Println("File successfully stored.")
+	return nil
 }
 
 // Retrieves the given file from the peer.
 // (1) finding the successor of the file through the peer.
 // (2) downloading the file through that successor.
-func retrieveFile(fileName string, peerAddr string) {
+// The file is downloaded next to its final path, so that a download that is cut short
+// can be resumed by retrieving the file again.
+func retrieveFile(fileName string, peerAddr string) error {
+	return retrieveVerifiedContents(fileName, "", peerAddr, fileName)
+}
+
+// Retrieves the given file from the peer into the local file at the given path.
+// If the owner is not ready yet, or the request reached a peer that does not own the
+// file, e.g. while a peer joins or leaves, the owner is looked up again and the
+// retrieve is tried again with an increasing delay.
+func retrieveContents(fileName string, peerAddr string, dstPath string) error {
+	return retryRetrieve(fileName, func() error {
+		return retrieveContentsOnce(fileName, peerAddr, dstPath)
+	})
+}
+
+// Calls the given retrieve of the file until it succeeds, or fails for another reason
+// than the owner not being ready or not being the owner.
+func retryRetrieve(fileName string, retrieve func() error) error {
+	delay := 100 * time.Millisecond
+	err := retrieve()
+	for attempt := 1; attempt < 6; attempt++ {
+		if errors.Is(err, ErrNotOwner) && *directAddr == "" {
+			fmt.Println("> Reached a peer that does not own", fileName+", looking up the owner again in", delay)
+			invalidateRing()
+		} else if errors.Is(err, ErrNotReady) {
+			fmt.Println("> The owner is not ready, retrying in", delay)
+		} else {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+		err = retrieve()
+	}
+	return err
+}
+
+// Makes a single attempt of retrieveContents.
+func retrieveContentsOnce(fileName string, peerAddr string, dstPath string) error {
 	// Find the successor (owner) of the file.
 	fileKey := hsh(fileName)
-	succAddr := askForSuccesor(fileKey, peerAddr)
-	// Begin trying to retrieve the file.
-	conn, reader := connectToPeer(succAddr)
+	_, conn, reader, err := connectToOwner(fileKey, peerAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return retrieveOver(conn, reader, fileName, dstPath)
+}
+
+// Retrieves the given file into the part file at the given path. If an earlier
+// download left the part file behind, only the rest of the file is fetched, as long as
+// the owner still has the same version of the file. The version is the expected
+// checksum if given, or the one recorded next to the part file when it was first
+// resumed otherwise.
+func retrievePartOnce(fileName string, expectedSum string, peerAddr string, partPath string) error {
+	fileKey := hsh(fileName)
+	ownerAddr, conn, reader, err := connectToOwner(fileKey, peerAddr)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
+	ownerAddr = strings.TrimSpace(ownerAddr)
+	partInfo, err := os.Stat(partPath)
+	if err == nil && partInfo.Mode().IsRegular() && partInfo.Size() > 0 {
+		err = resumeOver(conn, reader, fileName, expectedSum, ownerAddr, partPath, partInfo.Size())
+		if err == nil || errors.Is(err, ErrNetwork) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrNotReady) || errors.Is(err, ErrNotOwner) {
+			return err
+		}
+		// The remote file has changed since, or the part is not a part of it.
+		fmt.Println("> Could not resume the download of", fileName+", starting over:", err)
+		os.Remove(partPath + ".sum")
+	}
+	return retrieveOver(conn, reader, fileName, partPath)
+}
+
+// Retrieves the rest of the given file through an open connection to its owner,
+// appending it to the local part file at the given path that holds the first offset
+// bytes of it. The part is only kept if the checksum of the file on the owner is the
+// one of the version that the part belongs to, and the whole file is then verified
+// against it.
+// RETRIEVE <file name> <offset> => OK <size of the rest>, the rest of the file, OK
+func resumeOver(conn net.Conn, reader *bufio.Reader, fileName string, expectedSum string, ownerAddr string, partPath string, offset int64) error {
+	err := requireCapability(ownerAddr, "range")
+	if err != nil {
+		return err
+	}
+	stat, err := askForFileStat(fileName, ownerAddr)
+	if err != nil {
+		return err
+	}
+	partSum := expectedSum
+	if partSum == "" {
+		recordedSum, err := os.ReadFile(partPath + ".sum")
+		if err == nil {
+			partSum = strings.TrimSpace(string(recordedSum))
+		} else {
+			// The part belongs to the version that the owner has now, unless the
+			// checksum of the whole file says otherwise.
+			os.WriteFile(partPath+".sum", []byte(stat.Sum+"\n"), 0644)
+			partSum = stat.Sum
+		}
+	}
+	if !strings.EqualFold(partSum, stat.Sum) {
+		return fmt.Errorf("%w: the file has changed since the part was downloaded", ErrChecksum)
+	}
+	if offset > stat.Size {
+		return fmt.Errorf("%w: the local file is larger than the remote one", ErrChecksum)
+	}
+	_, err = conn.Write([]byte(fmt.Sprintf("RETRIEVE %s %d\n", fileName, offset)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return responseError(respMsg)
+	}
+	restSize, _ := strconv.ParseInt(strings.TrimSpace(respMsg), 10, 64)
+	dstFile, err := os.OpenFile(partPath, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("could not open the local file: %w", err)
+	}
+	defer dstFile.Close()
+	_, err = dstFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("could not open the local file: %w", err)
+	}
+	_, err = io.CopyN(dstFile, reader, restSize)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	serverResponse, err = reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg = extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return responseError(respMsg)
+	}
+	dstFile.Close()
+	actualSum, err := fileChecksum(partPath)
+	if err != nil {
+		return err
+	}
+	if actualSum != stat.Sum {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksum, stat.Sum, actualSum)
+	}
+	return nil
+}
+
+// Retrieves the given file through an open connection to its owner into the local
+// file at the given path. The connection can be used for further retrievals.
+func retrieveOver(conn net.Conn, reader *bufio.Reader, fileName string, dstPath string) error {
 	// Construct the request.
 	retrieveRequest := fmt.Sprintf("RETRIEVE %s\n", fileName)
 	// Send the retrieve request.
-	conn.Write([]byte(retrieveRequest))
+	_, err := conn.Write([]byte(retrieveRequest))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
 	// Retrieve the size of the file from the connection.
-	serverResponse, _ := reader.ReadString('\n')
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
 	respType, respMsg := extractServerResponse(serverResponse)
 	// Response: ERR <error msg>
 	if respType != "OK" {
-		fmt.Println("> Server response:", respMsg)
-		return
+		return responseError(respMsg)
 	}
 	// Response: OK <file size>
-	fileSize, _ := strconv.Atoi(strings.TrimSpace(respMsg))
-	// Create the local file.
-	dstFile, _ := os.Create(fileName)
+	fileSize, _ := strconv.ParseInt(strings.TrimSpace(respMsg), 10, 64)
+	// Create the local file. If it can not be created, give up before reading the
+	// file from the connection.
+	dstFile, err := os.Create(dstPath)
+	if err != nil {
+		return fmt.Errorf("could not create the local file: %w", err)
+	}
 	defer dstFile.Close()
 	// Retrieve the file from the connection.
-	io.CopyN(dstFile, reader, int64(fileSize))
+	_, err = io.CopyN(dstFile, reader, fileSize)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
 	// Read the next response.
-	serverResponse, _ = reader.ReadString('\n')
+	serverResponse, err = reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
 	respType, respMsg = extractServerResponse(serverResponse)
 	// Response: ERR <error msg>
 	if respType != "OK" {
-		fmt.Println("> Server response:", respMsg)
-		return
+		return responseError(respMsg)
 	}
 	// Response: OK
-	fmt.Println("File retrieved successfully.")
+	return nil
 }
 
-// Constructs a successor request with the given id and sends it to the given address.
-// Returns the answer to the request (i.e. the address of the successor).
-// SUCC <id> => <succ addr>
-func askForSuccesor(id int, peerAddr string) string {
-	// Initiate a connection with the given peer address.
-	conn, reader := connectToPeer(peerAddr)
-	defer conn.Close()
-	// Send the successor request.
-	succRequest := fmt.Sprintf("SUCC %d\n", id)
-	conn.Write([]byte(succRequest))
-	// Wait for an answer.
-	answer, err := reader.ReadString('\n')
+// Retrieves the given files from the peer. The files that share an owner are
+// retrieved back-to-back through a single connection to it. Returns the errors of
+// the files that could not be retrieved.
+func retrieveFiles(fileNames []string, peerAddr string) map[string]error {
+	// Group the files by their owners.
+	filesByOwner := make(map[string][]string)
+	owners, errs := findOwners(fileNames, peerAddr)
+	for fileName, succAddr := range owners {
+		succAddr = strings.TrimSpace(succAddr)
+		filesByOwner[succAddr] = append(filesByOwner[succAddr], fileName)
+	}
+	for succAddr, ownedFiles := range filesByOwner {
+		conn, reader, err := connectToPeer(succAddr)
+		if err != nil {
+			for _, failedFile := range ownedFiles {
+				errs[failedFile] = err
+			}
+			continue
+		}
+		for i, fileName := range ownedFiles {
+			err := retrieveOver(conn, reader, fileName, fileName)
+			if err == nil || errors.Is(err, ErrNotFound) {
+				if err != nil {
+					errs[fileName] = err
+				}
+				continue
+			}
+			// The connection is in an unknown state, give up on the rest of the files.
+			for _, failedFile := range ownedFiles[i:] {
+				errs[failedFile] = err
+			}
+			break
+		}
+		conn.Close()
+	}
+	return errs
+}
+
+// Retrieves the given file and compares its SHA-256 checksum with the expected one,
+// regardless of what the peer claims. The file is downloaded next to its final path
+// and only moved there once verified; on a mismatch, the download is removed. A
+// download that is cut short is kept, and resumed by the next retrieve of the file.
+func retrieveVerifiedFile(fileName string, expectedSum string, peerAddr string) error {
+	return retrieveVerifiedContents(fileName, expectedSum, peerAddr, fileName)
+}
+
+// Retrieves the given file into the local file at the given path, verifying it
+// against the expected SHA-256 checksum, if given.
+func retrieveVerifiedContents(fileName string, expectedSum string, peerAddr string, dstPath string) error {
+	partPath := dstPath + ".part"
+	err := retryRetrieve(fileName, func() error {
+		return retrievePartOnce(fileName, expectedSum, peerAddr, partPath)
+	})
+	if err == nil && expectedSum != "" {
+		var actualSum string
+		actualSum, err = fileChecksum(partPath)
+		if err == nil && !strings.EqualFold(actualSum, expectedSum) {
+			err = fmt.Errorf("%w: expected %s, got %s", ErrChecksum, expectedSum, actualSum)
+		}
+	}
+	if err == nil {
+		err = os.Rename(partPath, dstPath)
+	}
+	// Keep the part of a download that was cut short, to resume from it.
+	if err == nil || !(errors.Is(err, ErrNetwork) || errors.Is(err, ErrNotReady) || errors.Is(err, ErrNotOwner)) {
+		os.Remove(partPath)
+		os.Remove(partPath + ".sum")
+	}
+	return err
+}
+
+// Stores the given file under its content hash instead of its name and returns
+// the hash, which is the only handle to the file afterwards.
+func putBlob(fileName string, peerAddr string) (string, error) {
+	key, err := fileChecksum(fileName)
 	if err != nil {
-		log.Println("Could not get the successor.")
-		log.Fatalln(err)
+		return "", err
 	}
-	// The answer will only contain the address of the successor.
-	return answer
+	srcFile, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer srcFile.Close()
+	fileInfo, _ := srcFile.Stat()
+	// The same contents always map to the same key, so the key doubles as the token.
+	err = storeContents(key, fileInfo.Size(), srcFile, 0, key, peerAddr)
+	if errors.Is(err, ErrNetwork) {
+		fmt.Println("> Retrying after", err)
+		srcFile.Seek(0, io.SeekStart)
+		err = storeContents(key, fileInfo.Size(), srcFile, 0, key, peerAddr)
+	}
+	if err != nil {
+		return "", err
+	}
+	return key, nil
 }
 
-func main() {
-	storeIP := os.Args[1]
-	storePort := os.Args[2]
-	storeAddr := storeIP + ":" + storePort
-	// Show the main menu.
-	fmt.Println(mainMenu)
-	for {
-		// Ask the user for a selection.
-		fmt.Print("> Please select an option: ")
-		var input string
-		fmt.Scanln(&input)
-		selectedOption, err := strconv.Atoi(input)
+// Retrieves the file stored under the given content hash into the local file at
+// the given path. Since the key is the checksum, the contents are always verified.
+func getBlob(key string, dstPath string, peerAddr string) error {
+	return retrieveVerifiedContents(strings.ToLower(key), key, peerAddr, dstPath)
+}
+
+// Checks whether the given file name is the content hash of a blob.
+func isBlobKey(fileName string) bool {
+	_, err := hex.DecodeString(fileName)
+	return err == nil && len(fileName) == 2*sha256.Size
+}
+
+// Checks that each of the given files is stored on its owner. With a full check, each
+// file is also retrieved, and the blobs are verified against their keys. Returns the
+// problems found by the file names, each naming the peer at fault.
+func checkFiles(fileNames []string, full bool, peerAddr string) map[string]error {
+	problems := make(map[string]error)
+	// The files of each owner, listed once.
+	filesByOwner := make(map[string]map[string]int)
+	for _, fileName := range fileNames {
+		ownerAddr, err := findOwner(hsh(fileName), peerAddr)
 		if err != nil {
-			fmt.Println("Invalid choice.")
+			problems[fileName] = err
 			continue
 		}
-		// Act accordingly.
-		switch selectedOption {
-		case 1:
-			// Ask the filename to hash.
-			fmt.Print("> Enter the file name to store: ")
-			var fileName string
-			fmt.Scanln(&fileName)
-			start := time.Now()
-			storeFile(fileName, storeAddr)
-			elapsed := time.Since(start)
-			fmt.Println("Transfer took", elapsed.Microseconds(), "us")
-		case 2:
-			// Ask the filename to hash.
-			fmt.Print("> Enter the file name to retrieve: ")
-			var fileName string
-			fmt.Scanln(&fileName)
-			start := time.Now()
-			retrieveFile(fileName, storeAddr)
-			elapsed := time.Since(start)
-			fmt.Println("Transfer took", elapsed.Microseconds(), "us")
-		case 3:
-			fmt.Println("Goodbye!")
-			return
+		ownerAddr = strings.TrimSpace(ownerAddr)
+		files, ok := filesByOwner[ownerAddr]
+		if !ok {
+			files, err = askForFileList(ownerAddr)
+			if err != nil {
+				problems[fileName] = fmt.Errorf("could not list the files of %s: %w", ownerAddr, err)
+				continue
+			}
+			filesByOwner[ownerAddr] = files
+		}
+		if _, ok := files[fileName]; !ok {
+			problems[fileName] = fmt.Errorf("%w on its owner %s", ErrNotFound, ownerAddr)
+			continue
+		}
+		if !full {
+			continue
+		}
+		// Retrieve the file into a temporary file, directly from its owner.
+		tmpFile, err := os.CreateTemp("", "check-*")
+		if err != nil {
+			problems[fileName] = err
+			continue
+		}
+		tmpFile.Close()
+		if isBlobKey(fileName) {
+			err = retrieveVerifiedContents(fileName, fileName, ownerAddr, tmpFile.Name())
+		} else {
+			err = retrieveContents(fileName, ownerAddr, tmpFile.Name())
+		}
+		os.Remove(tmpFile.Name())
+		if err != nil {
+			problems[fileName] = fmt.Errorf("could not retrieve it from %s: %w", ownerAddr, err)
+		}
+	}
+	return problems
+}
+
+// Returns the hex encoded SHA-256 checksum of the local file.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Deletes the given file from the ring.
+// (1) finds the successor (owner) of the file through the given peer.
+// (2) asks the owner to delete the file.
+func deleteFile(fileName string, peerAddr string) error {
+	// Find the successor (owner) of the file.
+	fileKey := hsh(fileName)
+	succAddr, err := findOwner(fileKey, peerAddr)
+	if err != nil {
+		return err
+	}
+	return deleteOn(fileName, succAddr)
+}
+
+// Deletes the given file from the given peer, regardless of whether it owns the file.
+// DELETE <file name> => OK | ERR <msg>
+func deleteOn(fileName string, peerAddr string) error {
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Send the delete request.
+	conn.Write([]byte(fmt.Sprintf("DELETE %s\n", fileName)))
+	// Read the response.
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	// Response: ERR <error msg>
+	if respType != "OK" {
+		return responseError(respMsg)
+	}
+	// Response: OK
+	return nil
+}
+
+// Makes the given file expire after the given TTL in seconds from now, without
+// uploading it again.
+// TOUCH <file name> <ttl> => OK | ERR <msg>
+func touchFile(fileName string, ttl int, peerAddr string) error {
+	// Find the successor (owner) of the file.
+	succAddr, err := findOwner(hsh(fileName), peerAddr)
+	if err != nil {
+		return err
+	}
+	err = requireCapability(succAddr, "touch")
+	if err != nil {
+		return err
+	}
+	conn, reader, err := connectToPeer(succAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Send the touch request.
+	conn.Write([]byte(fmt.Sprintf("TOUCH %s %d\n", fileName, ttl)))
+	// Read the response.
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	// Response: ERR <error msg>
+	if respType != "OK" {
+		return responseError(respMsg)
+	}
+	// Response: OK
+	return nil
+}
+
+// Pins the given file, so that its owner never removes it automatically.
+// PIN <file name> => OK | ERR <msg>
+func pinFile(fileName string, peerAddr string) error {
+	// Find the successor (owner) of the file.
+	succAddr, err := findOwner(hsh(fileName), peerAddr)
+	if err != nil {
+		return err
+	}
+	err = requireCapability(succAddr, "pin")
+	if err != nil {
+		return err
+	}
+	conn, reader, err := connectToPeer(succAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Send the pin request.
+	conn.Write([]byte(fmt.Sprintf("PIN %s\n", fileName)))
+	// Read the response.
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	// Response: ERR <error msg>
+	if respType != "OK" {
+		return responseError(respMsg)
+	}
+	// Response: OK
+	return nil
+}
+
+// Renames a file in the ring. As the key of the file changes, it may move to another
+// owner, so the file is
+// (1) retrieved from the owner of the old name,
+// (2) stored on the owner of the new name,
+// (3) retrieved back from the owner of the new name and compared with the original,
+// (4) deleted from the owner of the old name.
+// The old file is only deleted once the new one is verified, so a failure at any step
+// leaves at least one intact copy in the ring.
+func renameFile(oldName string, newName string, peerAddr string) error {
+	if oldName == newName {
+		return errors.New("the old and the new names are the same")
+	}
+	// Use temporary local files for the old and the new copies.
+	tmpDir, err := os.MkdirTemp("", "rename")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	oldPath := filepath.Join(tmpDir, "old")
+	newPath := filepath.Join(tmpDir, "new")
+	// Retrieve the old file.
+	err = retrieveContents(oldName, peerAddr, oldPath)
+	if err != nil {
+		return fmt.Errorf("could not retrieve %s: %w", oldName, err)
+	}
+	// Store it under the new name. Both names may be owned by the same peer, in which
+	// case the peer holds both copies until the old one is deleted.
+	srcFile, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	fileInfo, _ := srcFile.Stat()
+	err = storeContents(newName, fileInfo.Size(), srcFile, 0, newStoreToken(), peerAddr)
+	srcFile.Close()
+	if err != nil {
+		return fmt.Errorf("could not store %s: %w", newName, err)
+	}
+	// Verify the new copy.
+	err = retrieveContents(newName, peerAddr, newPath)
+	if err != nil {
+		return fmt.Errorf("could not verify %s: %w", newName, err)
+	}
+	oldContents, _ := os.ReadFile(oldPath)
+	newContents, _ := os.ReadFile(newPath)
+	if !bytes.Equal(oldContents, newContents) {
+		return fmt.Errorf("the stored copy of %s does not match %s", newName, oldName)
+	}
+	// Delete the old file.
+	err = deleteFile(oldName, peerAddr)
+	if err != nil {
+		return fmt.Errorf("could not delete %s: %w", oldName, err)
+	}
+	return nil
+}
+
+// Asks the owner of the given file to store it on the peer at the destination
+// address. The file goes directly from the owner to the destination.
+// PUSH <file name> <dest addr> => OK | ERR <msg>
+func pushFile(fileName string, destAddr string, peerAddr string) error {
+	// Find the successor (owner) of the file.
+	succAddr, err := findOwner(hsh(fileName), peerAddr)
+	if err != nil {
+		return err
+	}
+	return pushFrom(fileName, destAddr, succAddr)
+}
+
+// Has the given peer push its copy of the given file to the peer at the destination
+// address, regardless of whether it owns the file.
+// PUSH <file name> <dest addr> => OK | ERR <msg>
+func pushFrom(fileName string, destAddr string, holderAddr string) error {
+	err := requireCapability(holderAddr, "push")
+	if err != nil {
+		return err
+	}
+	conn, reader, err := connectToPeer(holderAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(fmt.Sprintf("PUSH %s %s\n", fileName, destAddr)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return responseError(respMsg)
+	}
+	return nil
+}
+
+// Asks the given peer for its neighbors. Returns NONE for a missing neighbor.
+// NODEINFO => OK <pred addr> <succ addr>
+func askForNodeInfo(peerAddr string) (string, string, error) {
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		return "", "", err
+	}
+	defer conn.Close()
+	conn.Write([]byte("NODEINFO\n"))
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return "", "", responseError(respMsg)
+	}
+	tokens := strings.Split(respMsg, " ")
+	if len(tokens) < 2 {
+		return "", "", fmt.Errorf("%w: malformed node info %q", ErrServer, respMsg)
+	}
+	return tokens[0], tokens[1], nil
+}
+
+// Asks the given peer for the files stored on it. Returns a map of the file names
+// to their keys.
+// LIST => OK <file count>, followed by a `<file name> <key>` line for each file.
+func askForFileList(peerAddr string) (map[string]int, error) {
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.Write([]byte("LIST\n"))
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return nil, responseError(respMsg)
+	}
+	fileCount, _ := strconv.Atoi(respMsg)
+	files := make(map[string]int)
+	for i := 0; i < fileCount; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNetwork, err)
+		}
+		var fileName string
+		var fileKey int
+		fmt.Sscanf(line, "%s %d", &fileName, &fileKey)
+		files[fileName] = fileKey
+	}
+	return files, nil
+}
+
+// A file found in the ring, along with the peer that stores it.
+type KeyInfo struct {
+	Name  string
+	Key   int
+	Owner string
+	Size  int64
+	// The SHA-256 checksum of the contents, empty if the owner does not know it.
+	Sum string
+}
+
+// The peer through which the exported functions reach the ring.
+var entryAddr string
+
+// Walks the ring from the entry peer and returns the files whose names match the
+// given shell pattern (see path.Match), sorted by their keys.
+func ListKeys(pattern string) ([]KeyInfo, error) {
+	// Reject a malformed pattern before walking the ring.
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return nil, err
+	}
+	nodes, _, err := walkRing(entryAddr)
+	if err != nil {
+		return nil, err
+	}
+	matches := []KeyInfo{}
+	for _, nodeAddr := range nodes {
+		nodeMatches, err := askForMatchingKeys(pattern, nodeAddr)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, nodeMatches...)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Key != matches[j].Key {
+			return matches[i].Key < matches[j].Key
+		}
+		return matches[i].Name < matches[j].Name
+	})
+	return matches, nil
+}
+
+// Asks the given peer for the files stored on it, and returns the ones whose names
+// match the given pattern. The files are matched as they are streamed.
+// LISTALL => OK, followed by a `<file name> <key> <size> <sha256>` line for each file
+// (- if the checksum is not known), and an empty line.
+func askForMatchingKeys(pattern string, peerAddr string) ([]KeyInfo, error) {
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.Write([]byte("LISTALL\n"))
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return nil, responseError(respMsg)
+	}
+	matches := []KeyInfo{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNetwork, err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return matches, nil
+		}
+		info := KeyInfo{Owner: peerAddr}
+		_, err = fmt.Sscanf(line, "%s %d %d %s", &info.Name, &info.Key, &info.Size, &info.Sum)
+		if err != nil {
+			return nil, fmt.Errorf("%w: malformed file entry %q", ErrServer, line)
+		}
+		if info.Sum == "-" {
+			info.Sum = ""
+		}
+		if ok, _ := path.Match(pattern, info.Name); ok {
+			matches = append(matches, info)
+		}
+	}
+}
+
+// Deletes every copy of the given file in the ring, not only the one on its owner,
+// e.g. the copies pushed to other peers. Returns the peers that confirmed a removal.
+// Fails if any peer could not be checked, as a copy may have survived on it.
+func forgetFile(fileName string, peerAddr string) ([]string, error) {
+	removedFrom := []string{}
+	nodes, _, err := walkRing(peerAddr)
+	if err != nil {
+		return removedFrom, fmt.Errorf("could not reach every peer: %w", err)
+	}
+	failures := []string{}
+	for _, nodeAddr := range nodes {
+		files, err := askForFileList(nodeAddr)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", nodeAddr, err))
+			continue
+		}
+		if _, ok := files[fileName]; !ok {
+			continue
+		}
+		err = deleteOn(fileName, nodeAddr)
+		// The copy may have expired in the meantime, which is just as good.
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			failures = append(failures, fmt.Sprintf("%s: %v", nodeAddr, err))
+			continue
+		}
+		removedFrom = append(removedFrom, nodeAddr)
+	}
+	if len(failures) > 0 {
+		return removedFrom, fmt.Errorf("could not check every peer: %s", strings.Join(failures, ", "))
+	}
+	return removedFrom, nil
+}
+
+// The access counts of a file, as reported by the peer that stores it.
+type hotFile struct {
+	Name       string
+	Key        int
+	Owner      string
+	Reads      int64
+	Writes     int64
+	LastAccess time.Time
+}
+
+// Asks the given peer for its most accessed files, up to the given count.
+// HOTKEYS <n> => OK <file count>, followed by a
+// `<file name> <key> <reads> <writes> <last access unix time>` line for each file.
+func askForHotKeys(count int, peerAddr string) ([]hotFile, error) {
+	err := requireCapability(peerAddr, "hotkeys")
+	if err != nil {
+		return nil, err
+	}
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.Write([]byte(fmt.Sprintf("HOTKEYS %d\n", count)))
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return nil, responseError(respMsg)
+	}
+	fileCount, _ := strconv.Atoi(respMsg)
+	files := []hotFile{}
+	for i := 0; i < fileCount; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNetwork, err)
+		}
+		file := hotFile{Owner: peerAddr}
+		var lastAccess int64
+		fmt.Sscanf(line, "%s %d %d %d %d", &file.Name, &file.Key, &file.Reads, &file.Writes, &lastAccess)
+		file.LastAccess = time.Unix(lastAccess, 0)
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// The state of a stored file, as reported by its owner.
+type fileStat struct {
+	Size    int64
+	ModTime time.Time
+	Sum     string
+	Pinned  bool
+}
+
+// Asks the given peer for the state of the given file.
+// STAT <file name> => OK <size> <modification unix nano time> <sha256> [pinned=<true|false>] | ERR <msg>
+func askForFileStat(fileName string, peerAddr string) (fileStat, error) {
+	err := requireCapability(peerAddr, "stat")
+	if err != nil {
+		return fileStat{}, err
+	}
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		return fileStat{}, err
+	}
+	defer conn.Close()
+	conn.Write([]byte(fmt.Sprintf("STAT %s\n", fileName)))
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return fileStat{}, fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return fileStat{}, responseError(respMsg)
+	}
+	var stat fileStat
+	var modTime int64
+	_, err = fmt.Sscanf(respMsg, "%d %d %s", &stat.Size, &modTime, &stat.Sum)
+	if err != nil {
+		return fileStat{}, fmt.Errorf("%w: malformed stat answer %q", ErrServer, respMsg)
+	}
+	stat.ModTime = time.Unix(0, modTime)
+	// Older peers do not report the pin.
+	stat.Pinned = strings.HasSuffix(respMsg, " pinned=true")
+	return stat, nil
+}
+
+// Watches the given file and prints an event whenever the file is created, changed or
+// deleted, until stop is closed. The owner pushes the changes if it supports it, and
+// is polled at the given interval otherwise. The owner is found again whenever it can
+// not be reached or hands the file over, so that the watch survives joins & leaves.
+func watchFile(fileName string, interval time.Duration, peerAddr string, stop <-chan struct{}) {
+	ownerAddr := ""
+	var last fileStat
+	exists := false
+	first := true
+	// Compares the current state of the file on its owner to the last one.
+	check := func() {
+		stat, err := askForFileStat(fileName, ownerAddr)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			if exists {
+				fmt.Printf("[%s] %s was deleted\n", time.Now().Format(time.StampMilli), fileName)
+			} else if first {
+				fmt.Printf("[%s] %s does not exist\n", time.Now().Format(time.StampMilli), fileName)
+			}
+			exists = false
+			first = false
+		case err != nil:
+			// The owner might have changed, find it again on the next poll.
+			invalidateRing()
+			ownerAddr = ""
+		case first:
+			pin := ""
+			if stat.Pinned {
+				pin = ", pinned"
+			}
+			fmt.Printf("[%s] %s exists (%d bytes, modified at %s%s)\n", time.Now().Format(time.StampMilli), fileName, stat.Size, stat.ModTime.Format(time.StampMilli), pin)
+			last, exists, first = stat, true, false
+		case !exists:
+			fmt.Printf("[%s] %s was created (%d bytes)\n", time.Now().Format(time.StampMilli), fileName, stat.Size)
+			last, exists = stat, true
+		case stat.Sum != last.Sum || !stat.ModTime.Equal(last.ModTime):
+			fmt.Printf("[%s] %s was changed (%d bytes)\n", time.Now().Format(time.StampMilli), fileName, stat.Size)
+			last = stat
+		}
+	}
+	for {
+		if ownerAddr == "" {
+			addr, err := findOwner(hsh(fileName), peerAddr)
+			if err != nil {
+				fmt.Println("Could not find the owner of", fileName+":", err)
+			}
+			ownerAddr = strings.TrimSpace(addr)
+		}
+		if ownerAddr != "" {
+			check()
+		}
+		// Once the state of the file is known, follow its changes through the owner.
+		if ownerAddr != "" && !first && requireCapability(ownerAddr, "subscribe") == nil {
+			err := followFile(fileName, ownerAddr, stop, check)
+			if err == nil {
+				return
+			}
+			// Subscribe again through the new owner, after catching up with the changes
+			// missed in between.
+			invalidateRing()
+			ownerAddr = ""
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Subscribes to the changes of the given file on its owner, and calls changed for
+// each change pushed by the owner, until stop is closed. Returns an error if the
+// subscription ends otherwise, e.g. if the owner hands the file over to another peer.
+// SUBSCRIBE <file name> => OK, followed by `CHANGED <file name> <sha256 | NONE>` and
+// `MOVED <file name>` lines
+// UNSUBSCRIBE => OK
+func followFile(fileName string, ownerAddr string, stop <-chan struct{}, changed func()) error {
+	conn, reader, err := connectToPeer(ownerAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.Write([]byte(fmt.Sprintf("SUBSCRIBE %s\n", fileName)))
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return responseError(respMsg)
+	}
+	// Unsubscribe once stopped.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Write([]byte("UNSUBSCRIBE\n"))
+		case <-done:
+		}
+	}()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			return fmt.Errorf("%w: %v", ErrNetwork, err)
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) == 0 {
+			continue
+		}
+		switch tokens[0] {
+		case "CHANGED":
+			changed()
+		case "MOVED":
+			return fmt.Errorf("%s moved to another peer", fileName)
+		case "OK":
+			// The acknowledgement of the unsubscription.
+			return nil
+		}
+	}
+}
+
+// Walks the ring from the given peer and returns the most accessed files in the
+// ring, up to the given count, the most accessed first.
+func hottestFiles(count int, peerAddr string) ([]hotFile, error) {
+	nodes, _, err := walkRing(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	hottest := []hotFile{}
+	for _, nodeAddr := range nodes {
+		files, err := askForHotKeys(count, nodeAddr)
+		if err != nil {
+			return nil, err
+		}
+		hottest = append(hottest, files...)
+	}
+	sort.Slice(hottest, func(i, j int) bool {
+		return hottest[i].Reads+hottest[i].Writes > hottest[j].Reads+hottest[j].Writes
+	})
+	if len(hottest) > count {
+		hottest = hottest[:count]
+	}
+	return hottest, nil
+}
+
+// Prints the files stored on the given peer's predecessor and successor.
+func listNeighborFiles(peerAddr string) {
+	predAddr, succAddr, err := askForNodeInfo(peerAddr)
+	if err != nil {
+		fmt.Println("Could not get the neighbors:", err)
+		return
+	}
+	fmt.Print("Predecessor: ")
+	printNodeFiles(predAddr)
+	fmt.Print("Successor: ")
+	printNodeFiles(succAddr)
+}
+
+// Prints the address and the id of the given peer along with the files stored on it.
+func printNodeFiles(peerAddr string) {
+	if peerAddr == "NONE" {
+		fmt.Println("none")
+		return
+	}
+	fmt.Printf("%s (%d)\n", peerAddr, hsh(peerAddr))
+	files, err := askForFileList(peerAddr)
+	if err != nil {
+		fmt.Println("  Could not list the files:", err)
+		return
+	}
+	if len(files) < 1 {
+		fmt.Println("  No files are stored!")
+	}
+	for fileName, key := range files {
+		fmt.Println(" ", fileName, "=>", key)
+	}
+}
+
+// Prints the peers visited on the way from the given peer to the owner of the given
+// key, like traceroute. The peers are asked one at a time, as in iterative mode: each
+// one either names the owner or replies with the next hop, past which the owner must
+// lie, so each hop narrows the search to the keys between the next hop and the key.
+func traceKey(key int, peerAddr string) {
+	currAddr := peerAddr
+	for hop := 1; hop <= int(ringCapacity); hop++ {
+		answer, err := askForSuccesor(key, currAddr)
+		if err != nil {
+			fmt.Println("Could not ask", currAddr, "for the successor:", err)
+			return
+		}
+		answer = strings.TrimSpace(answer)
+		currID := hsh(currAddr)
+		if strings.HasPrefix(answer, "ERR") {
+			_, respMsg := extractServerResponse(answer)
+			fmt.Printf("%d) %s (%d) could not route the key: %s\n", hop, currAddr, currID, respMsg)
+			return
+		}
+		if !strings.HasPrefix(answer, "NEXT ") {
+			if answer == currAddr {
+				fmt.Printf("%d) %s (%d) => owner\n", hop, currAddr, currID)
+				return
+			}
+			// The peer knows the owner, i.e. its successor, without asking further.
+			fmt.Printf("%d) %s (%d) names the owner\n", hop, currAddr, currID)
+			fmt.Printf("%d) %s (%d) => owner\n", hop+1, answer, hsh(answer))
+			return
+		}
+		nextAddr := strings.TrimPrefix(answer, "NEXT ")
+		nextID := hsh(nextAddr)
+		fmt.Printf("%d) %s (%d) => next hop %s (%d), the search narrows to (%d, %d]\n", hop, currAddr, currID, nextAddr, nextID, nextID, key)
+		currAddr = nextAddr
+	}
+	fmt.Println("Gave up after visiting", ringCapacity, "peers, the ring might be broken.")
+}
+
+// Prints the keys that are stored on both of the given peers. In a healthy ring,
+// each key has a single owner, so there should be none.
+func compareKeys(firstAddr string, secondAddr string) {
+	firstFiles, err := askForFileList(firstAddr)
+	if err != nil {
+		fmt.Println("Could not list the files of", firstAddr+":", err)
+		return
+	}
+	secondFiles, err := askForFileList(secondAddr)
+	if err != nil {
+		fmt.Println("Could not list the files of", secondAddr+":", err)
+		return
+	}
+	firstKeys := make(map[int][]string)
+	for fileName, key := range firstFiles {
+		firstKeys[key] = append(firstKeys[key], fileName)
+	}
+	overlaps := 0
+	for fileName, key := range secondFiles {
+		if len(firstKeys[key]) > 0 {
+			fmt.Printf("Key %d is claimed by both: %v on %s, %s on %s\n", key, firstKeys[key], firstAddr, fileName, secondAddr)
+			overlaps++
+		}
+	}
+	if overlaps < 1 {
+		fmt.Println("No keys are claimed by both peers.")
+	}
+}
+
+// Walks the ring through the successors, starting from the given peer. Returns the
+// addresses of the visited peers in order, and the address at which the walk came
+// back to an already visited peer (NONE if a peer had no successor). In a healthy
+// ring, the walk comes back to the starting peer.
+func walkRing(peerAddr string) ([]string, string, error) {
+	visited := make(map[string]bool)
+	nodes := []string{}
+	currAddr := peerAddr
+	for !visited[currAddr] && currAddr != "NONE" {
+		visited[currAddr] = true
+		nodes = append(nodes, currAddr)
+		_, succAddr, err := askForNodeInfo(currAddr)
+		if err != nil {
+			return nodes, "", err
+		}
+		// A lone peer is its own successor.
+		if succAddr == "NONE" && len(nodes) == 1 {
+			succAddr = currAddr
+		}
+		currAddr = succAddr
+	}
+	return nodes, currAddr, nil
+}
+
+// Walks the ring through the successors from the given peer, and points the
+// predecessor of each node's successor back at the node wherever it points elsewhere,
+// e.g. at a departed node after a lost update. Returns the addresses of the repaired
+// nodes. The successors must form a cycle, as they are trusted over the predecessors.
+// UPDATE KEEP <new pred addr> => OK
+func repairPredecessors(peerAddr string) ([]string, error) {
+	nodes, backAt, err := walkRing(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	if backAt != peerAddr {
+		return nil, fmt.Errorf("the successors do not form a ring, the walk from %s ended at %s", peerAddr, backAt)
+	}
+	// A lone peer has no predecessor.
+	if len(nodes) < 2 {
+		return nil, nil
+	}
+	repaired := []string{}
+	for i, nodeAddr := range nodes {
+		succAddr := nodes[(i+1)%len(nodes)]
+		predAddr, _, err := askForNodeInfo(succAddr)
+		if err != nil {
+			return repaired, err
+		}
+		if predAddr == nodeAddr {
+			continue
+		}
+		conn, reader, err := connectToPeer(succAddr)
+		if err != nil {
+			return repaired, err
+		}
+		conn.Write([]byte(fmt.Sprintf("UPDATE KEEP %s\n", nodeAddr)))
+		_, err = reader.ReadString('\n')
+		conn.Close()
+		if err != nil {
+			return repaired, fmt.Errorf("%w: %v", ErrNetwork, err)
+		}
+		repaired = append(repaired, succAddr)
+	}
+	return repaired, nil
+}
+
+// Prints the capacity, the node count, the occupied key count and the load factor
+// of the given peers.
+func printRingStats(nodes []string) {
+	fileCount := 0
+	occupiedKeys := make(map[int]bool)
+	for _, nodeAddr := range nodes {
+		files, err := askForFileList(nodeAddr)
+		if err != nil {
+			fmt.Println("  Could not list the files of", nodeAddr+":", err)
+			continue
+		}
+		fileCount += len(files)
+		for _, key := range files {
+			occupiedKeys[key] = true
+		}
+	}
+	fmt.Println("  Capacity:", ringCapacity)
+	fmt.Println("  Nodes:", len(nodes))
+	fmt.Println("  Files:", fileCount)
+	fmt.Println("  Occupied keys:", len(occupiedKeys))
+	fmt.Printf("  Load factor: %.2f files per node\n", float64(fileCount)/float64(len(nodes)))
+}
+
+// Walks the ring from the given peer and prints a summary of it. If the walk does not
+// come back to the given peer, the ring is partitioned and each part is summarized
+// separately.
+func describeRing(peerAddr string) {
+	nodes, endAddr, err := walkRing(peerAddr)
+	if err != nil {
+		fmt.Println("Could not walk the ring:", err)
+		return
+	}
+	if endAddr == peerAddr {
+		fmt.Println("Ring:")
+		printRingStats(nodes)
+		return
+	}
+	// The walk ended elsewhere: the nodes before the end address do not belong to
+	// the same ring as the rest.
+	fmt.Println("The ring is partitioned, the walk from", peerAddr, "ended at", endAddr)
+	split := len(nodes)
+	for i, nodeAddr := range nodes {
+		if nodeAddr == endAddr {
+			split = i
+		}
+	}
+	fmt.Println("Partition 1:")
+	printRingStats(nodes[:split])
+	if split < len(nodes) {
+		fmt.Println("Partition 2:")
+		printRingStats(nodes[split:])
+	}
+}
+
+// Measures the round trip time of a single request to the given peer.
+// PING => OK
+func pingPeer(peerAddr string) (time.Duration, error) {
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.Write([]byte("PING\n"))
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	elapsed := time.Since(start)
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return 0, responseError(respMsg)
+	}
+	return elapsed, nil
+}
+
+// Walks the ring from the given peer and prints the round trip time to each peer,
+// from the fastest to the slowest. The peers that could not be reached are listed
+// last as down.
+func printLatencies(peerAddr string) {
+	// A failed walk still returns the peers visited so far, including the one that
+	// could not be reached.
+	nodes, _, err := walkRing(peerAddr)
+	if err != nil {
+		fmt.Println("Could not walk the whole ring:", err)
+	}
+	latencies := make(map[string]time.Duration)
+	for _, nodeAddr := range nodes {
+		latency, err := pingPeer(nodeAddr)
+		if err != nil {
+			latency = -1
+		}
+		latencies[nodeAddr] = latency
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		first, second := latencies[nodes[i]], latencies[nodes[j]]
+		if first < 0 || second < 0 {
+			return second < 0 && first >= 0
+		}
+		return first < second
+	})
+	for _, nodeAddr := range nodes {
+		if latencies[nodeAddr] < 0 {
+			fmt.Printf("  %-24s down\n", nodeAddr)
+		} else {
+			fmt.Printf("  %-24s %d us\n", nodeAddr, latencies[nodeAddr].Microseconds())
+		}
+	}
+}
+
+// Walks the ring from the given peer and checks that:
+// (1) the walk comes back to the given peer,
+// (2) every peer's successor has that peer as its predecessor,
+// (3) every file is stored on the owner of its key,
+// (4) no file is stored on more than one peer.
+// Returns a human-readable description of each violation found.
+func checkRingInvariants(peerAddr string) []error {
+	violations := []error{}
+	nodes, endAddr, err := walkRing(peerAddr)
+	if err != nil {
+		return append(violations, fmt.Errorf("could not walk the ring: %w", err))
+	}
+	if endAddr != peerAddr {
+		violations = append(violations, fmt.Errorf("the walk from %s ended at %s", peerAddr, endAddr))
+	}
+	// Collect the neighbors of each peer.
+	predecessors := make(map[string]string)
+	successors := make(map[string]string)
+	for _, nodeAddr := range nodes {
+		predAddr, succAddr, err := askForNodeInfo(nodeAddr)
+		if err != nil {
+			violations = append(violations, fmt.Errorf("could not get the neighbors of %s: %w", nodeAddr, err))
+			continue
+		}
+		predecessors[nodeAddr] = predAddr
+		successors[nodeAddr] = succAddr
+	}
+	for _, nodeAddr := range nodes {
+		succAddr := successors[nodeAddr]
+		if succAddr == "NONE" || len(nodes) == 1 {
+			continue
+		}
+		if predecessors[succAddr] != nodeAddr {
+			violations = append(violations, fmt.Errorf("the predecessor of %s is %s, not %s", succAddr, predecessors[succAddr], nodeAddr))
+		}
+	}
+	// Check where the files are stored.
+	holders := make(map[string]string)
+	for _, nodeAddr := range nodes {
+		files, err := askForFileList(nodeAddr)
+		if err != nil {
+			violations = append(violations, fmt.Errorf("could not list the files of %s: %w", nodeAddr, err))
+			continue
+		}
+		nodeID := hsh(nodeAddr)
+		predAddr := predecessors[nodeAddr]
+		for fileName, key := range files {
+			if holder, ok := holders[fileName]; ok {
+				violations = append(violations, fmt.Errorf("%s is stored on both %s and %s", fileName, holder, nodeAddr))
+			}
+			holders[fileName] = nodeAddr
+			// A peer without a predecessor owns every key.
+			if predAddr == "" || predAddr == "NONE" {
+				continue
+			}
+			if !ownsKey(hsh(predAddr), predAddr, nodeID, nodeAddr, key) {
+				violations = append(violations, fmt.Errorf("%s (%d) is stored on %s (%d), which does not own it", fileName, key, nodeAddr, nodeID))
+			}
+		}
+	}
+	return violations
+}
+
+// Stores each regular file directly under the given directory, under its base name.
+// Returns the names of the files that could not be stored, mapped to their errors.
+// Unless continueOnError is set, stops at the first such file. Nothing is stored if
+// the parameters of the ring do not match the ones of the client.
+func storeDirectory(dirPath string, peerAddr string) (int, map[string]error, error) {
+	// With mismatching parameters, every file would be stored on the wrong peer.
+	err := checkRingParams(peerAddr)
+	if err != nil {
+		return 0, nil, err
+	}
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	stored := 0
+	failures := make(map[string]error)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		srcFile, err := os.Open(filepath.Join(dirPath, entry.Name()))
+		if err == nil {
+			fileInfo, _ := srcFile.Stat()
+			fmt.Println("Storing", entry.Name())
+			err = storeContents(entry.Name(), fileInfo.Size(), srcFile, 0, newStoreToken(), peerAddr)
+			srcFile.Close()
+		}
+		if err != nil {
+			failures[entry.Name()] = err
+			if !*continueOnError {
+				break
+			}
+			continue
+		}
+		stored++
+	}
+	return stored, failures, nil
+}
+
+// Stores the given local files so that either all of them are stored or none are. The
+// files are staged on each of their owners in a transaction. Once every file is staged,
+// each owner votes on its transaction, and the transactions are only committed once
+// every owner has voted yes. A failure before the commits leaves the ring as it was.
+// An owner that votes yes holds its files back until the commit, so a commit can only
+// fail afterwards if the owner or the connection to it fails in between.
+// TXN <transaction id> => OK, STORE <file name> <file size> sum=<sha256> => OK, the file, OK, ..., PREPARE => OK, COMMIT => OK
+func storeFilesAtomically(fileNames []string, peerAddr string) error {
+	// Group the files by their owners.
+	filesByOwner := make(map[string][]string)
+	owners, errs := findOwners(fileNames, peerAddr)
+	for _, fileName := range fileNames {
+		if errs[fileName] != nil {
+			return fmt.Errorf("%s: %w", fileName, errs[fileName])
+		}
+		succAddr := strings.TrimSpace(owners[fileName])
+		filesByOwner[succAddr] = append(filesByOwner[succAddr], fileName)
+	}
+	// A transaction is discarded by its owner once its connection is closed without
+	// a commit.
+	txnID := newStoreToken()
+	txns := make(map[string]*transaction)
+	defer func() {
+		for _, txn := range txns {
+			txn.conn.Close()
+		}
+	}()
+	for succAddr := range filesByOwner {
+		err := requireCapability(succAddr, "txn")
+		if err != nil {
+			return err
+		}
+		conn, reader, err := connectToPeer(succAddr)
+		if err != nil {
+			return err
+		}
+		txns[succAddr] = &transaction{conn: conn, reader: reader, stop: make(chan bool)}
+	}
+	// Stage the files on all of the owners at once, and keep the transactions that are
+	// staged alive until the rest are.
+	staged := make(chan error, len(txns))
+	var wg sync.WaitGroup
+	for succAddr, txn := range txns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := txn.stage(txnID, filesByOwner[succAddr])
+			staged <- err
+			if err == nil {
+				txn.keepAlive()
+			}
+		}()
+	}
+	for range txns {
+		err := <-staged
+		if err != nil {
+			// Closing the connections discards the transactions.
+			for _, txn := range txns {
+				close(txn.stop)
+				txn.conn.Close()
+			}
+			wg.Wait()
+			return err
+		}
+	}
+	for _, txn := range txns {
+		close(txn.stop)
+	}
+	wg.Wait()
+	// Every file is staged, let the owners vote. The owners are asked in order, so that
+	// two transactions over the same owners can not wait on each other.
+	succAddrs := make([]string, 0, len(txns))
+	for succAddr := range txns {
+		succAddrs = append(succAddrs, succAddr)
+	}
+	sort.Strings(succAddrs)
+	for _, succAddr := range succAddrs {
+		txn := txns[succAddr]
+		_, err := txn.conn.Write([]byte("PREPARE\n"))
+		if err == nil {
+			err = awaitOK(txn.reader)
+		}
+		if err != nil {
+			// Closing the connections discards the transactions, the prepared ones too.
+			return fmt.Errorf("%s voted against the transaction: %w", succAddr, err)
+		}
+	}
+	// Every owner voted yes, make the files visible.
+	for i, succAddr := range succAddrs {
+		txn := txns[succAddr]
+		_, err := txn.conn.Write([]byte("COMMIT\n"))
+		if err == nil {
+			err = awaitOK(txn.reader)
+		}
+		if err != nil {
+			return fmt.Errorf("could not commit on %s after committing on %v: %w", succAddr, succAddrs[:i], err)
+		}
+	}
+	return nil
+}
+
+// A transaction open on one of the owners of the files.
+type transaction struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// Closed once the transaction no longer needs to be kept alive.
+	stop chan bool
+}
+
+// Opens the transaction with the given id, and stages the given files in it.
+// TXN <transaction id> => OK
+func (txn *transaction) stage(txnID string, fileNames []string) error {
+	_, err := txn.conn.Write([]byte("TXN " + txnID + "\n"))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	err = awaitOK(txn.reader)
+	if err != nil {
+		return err
+	}
+	for _, fileName := range fileNames {
+		err := stageOver(txn.conn, txn.reader, fileName)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fileName, err)
+		}
+	}
+	return nil
+}
+
+// Keeps the staged transaction from being discarded as idle, until it is stopped. A
+// failed keep alive is left for the commit to report.
+// KEEPALIVE => OK
+func (txn *transaction) keepAlive() {
+	ticker := time.NewTicker(*txnKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-txn.stop:
+			return
+		case <-ticker.C:
+			_, err := txn.conn.Write([]byte("KEEPALIVE\n"))
+			if err == nil {
+				err = awaitOK(txn.reader)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Sends the given local file through a connection with an open transaction.
+// STORE <file name> <file size> sum=<sha256> => OK, the file, OK
+func stageOver(conn net.Conn, reader *bufio.Reader, fileName string) error {
+	sum, err := fileChecksum(fileName)
+	if err != nil {
+		return err
+	}
+	srcFile, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	fileInfo, _ := srcFile.Stat()
+	_, err = conn.Write([]byte(fmt.Sprintf("STORE %s %d sum=%s\n", fileName, fileInfo.Size(), sum)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	err = awaitOK(reader)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(conn, srcFile, fileInfo.Size())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	return awaitOK(reader)
+}
+
+// Reads a response, and returns its error unless it is an `OK`.
+func awaitOK(reader *bufio.Reader) error {
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return responseError(respMsg)
+	}
+	return nil
+}
+
+// Exports all of the files stored on the given peer into a local tar archive.
+// EXPORT => OK, followed by a tar stream of the stored files.
+func exportFiles(archiveName string, peerAddr string) {
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		fmt.Println("Could not export the files:", err)
+		return
+	}
+	defer conn.Close()
+	// Send the export request.
+	conn.Write([]byte("EXPORT\n"))
+	// Read the response.
+	serverResponse, _ := reader.ReadString('\n')
+	respType, respMsg := extractServerResponse(serverResponse)
+	// Response: ERR <error msg>
+	if respType != "OK" {
+		fmt.Println("> Server response:", respMsg)
+		return
+	}
+	// Response: OK
+	dstFile, err := os.Create(archiveName)
+	if err != nil {
+		fmt.Println("Could not create the archive:", err)
+		return
+	}
+	defer dstFile.Close()
+	// The peer closes the connection once the whole archive is sent.
+	_, err = io.Copy(dstFile, reader)
+	if err != nil {
+		fmt.Println("Could not export the files:", err)
+		return
+	}
+	fmt.Println("Files successfully exported.")
+}
+
+// Imports the files in the given tar archive into the ring. Each file is routed
+// to its own owner through the given peer.
+func importFiles(archiveName string, peerAddr string) {
+	// With mismatching parameters, every file would be stored on the wrong peer.
+	err := checkRingParams(peerAddr)
+	if err != nil {
+		fmt.Println("Not importing:", err)
+		return
+	}
+	srcFile, err := os.Open(archiveName)
+	if err != nil {
+		fmt.Println("Could not open the archive:", err)
+		return
+	}
+	defer srcFile.Close()
+	tr := tar.NewReader(srcFile)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println("Could not read the archive:", err)
+			return
+		}
+		// Skip directories and other special entries.
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		fmt.Println("Importing", header.Name)
+		err = storeContents(header.Name, header.Size, tr, 0, "", peerAddr)
+		if err != nil {
+			fmt.Println("> Could not store the file:", err)
+		}
+	}
+}
+
+// Asks the given peer for the ring parameters and returns an error if they do not
+// match the ones of this client.
+// PARAMS => OK capacity=<ring capacity> hash=<hash algorithm> version=<protocol version> seed=<hash seed>
+func checkRingParams(peerAddr string) error {
+	params, err := askForParams(peerAddr)
+	if err != nil {
+		return err
+	}
+	expected := map[string]string{
+		"capacity": strconv.Itoa(int(ringCapacity)),
+		"hash":     hashAlgorithm,
+		"version":  strconv.Itoa(protocolVersion),
+		"seed":     *hashSeed,
+	}
+	for key, value := range expected {
+		if params[key] != value {
+			return fmt.Errorf("the ring has %s %q, expected %q", key, params[key], value)
+		}
+	}
+	return nil
+}
+
+// Asks the given peer for its parameters.
+// PARAMS => OK <name>=<value> ...
+func askForParams(peerAddr string) (map[string]string, error) {
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.Write([]byte("PARAMS\n"))
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("could not get the ring parameters: %w", err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return nil, fmt.Errorf("could not get the ring parameters: %w", responseError(respMsg))
+	}
+	params := make(map[string]string)
+	for _, token := range strings.Split(respMsg, " ") {
+		key, value, _ := strings.Cut(token, "=")
+		params[key] = value
+	}
+	return params, nil
+}
+
+// Returns ErrUnsupported if the given peer does not advertise the given feature.
+func requireCapability(peerAddr string, feature string) error {
+	capabilities, err := peerCapabilities(peerAddr)
+	if err != nil {
+		return err
+	}
+	for _, capability := range capabilities {
+		if capability == feature {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s does not support %s", ErrUnsupported, strings.TrimSpace(peerAddr), feature)
+}
+
+// Returns the capabilities advertised by the given peer, which are only asked for once.
+func peerCapabilities(peerAddr string) ([]string, error) {
+	peerAddr = strings.TrimSpace(peerAddr)
+	cachedRingMutex.Lock()
+	capabilities, ok := cachedCapabilities[peerAddr]
+	cachedRingMutex.Unlock()
+	if ok {
+		return capabilities, nil
+	}
+	params, err := askForParams(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	capabilities = strings.Split(params["caps"], ",")
+	cachedRingMutex.Lock()
+	cachedCapabilities[peerAddr] = capabilities
+	cachedRingMutex.Unlock()
+	return capabilities, nil
+}
+
+// A node on the cached ring.
+type ringNode struct {
+	ID      int
+	Address string
+}
+
+// The cached ring, sorted by the node ids, and the time it was fetched at.
+var cachedRing []ringNode
+var cachedRingTime time.Time
+var cachedRingMutex sync.Mutex
+
+// The capabilities advertised by the peers, by their addresses. They are dropped along
+// with the cached ring, as a peer that has left may come back with another version.
+var cachedCapabilities = make(map[string][]string)
+
+// Drops the cached ring, so that it is fetched again on the next lookup.
+func invalidateRing() {
+	cachedRingMutex.Lock()
+	cachedRing = nil
+	cachedCapabilities = make(map[string][]string)
+	cachedRingMutex.Unlock()
+}
+
+// Fetches the ring by walking through the successors, starting from the successor
+// of the given peer. Fails if the walk does not come back to where it started, as
+// the ring is not stable then.
+func fetchRing(peerAddr string) ([]ringNode, error) {
+	// Start from an address as the peers advertise it, so that its id is right.
+	_, startAddr, err := askForNodeInfo(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	if startAddr == "NONE" {
+		return nil, errors.New("the peer is not in a ring")
+	}
+	nodes, endAddr, err := walkRing(startAddr)
+	if err != nil {
+		return nil, err
+	}
+	if endAddr != startAddr {
+		return nil, fmt.Errorf("the ring is broken at %s", endAddr)
+	}
+	ring := make([]ringNode, len(nodes))
+	for i, nodeAddr := range nodes {
+		ring[i] = ringNode{ID: hsh(nodeAddr), Address: nodeAddr}
+	}
+	// Nodes with the same id are ordered by their addresses, the lowest one owns the keys.
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].ID != ring[j].ID {
+			return ring[i].ID < ring[j].ID
+		}
+		return ring[i].Address < ring[j].Address
+	})
+	return ring, nil
+}
+
+// Returns the owner of the given key from the cached ring, fetching the ring through
+// the given peer if it is missing or stale.
+func cachedOwner(id int, peerAddr string) (string, error) {
+	cachedRingMutex.Lock()
+	ring, fetchedAt := cachedRing, cachedRingTime
+	cachedRingMutex.Unlock()
+	if ring == nil || time.Since(fetchedAt) > *ringCacheTTL {
+		// Fetch without holding the lock, as a failed connection drops the cached ring.
+		var err error
+		ring, err = fetchRing(peerAddr)
+		if err != nil {
+			return "", err
+		}
+		cachedRingMutex.Lock()
+		cachedRing, cachedRingTime = ring, time.Now()
+		cachedRingMutex.Unlock()
+	}
+	return ringOwner(ring, id), nil
+}
+
+// Returns the address of the owner of the given key on the given ring. The owner is
+// the first node whose id is not less than the key, wrapping around.
+func ringOwner(ring []ringNode, id int) string {
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].ID >= id })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].Address
+}
+
+// Returns the address of the owner of the given key, found through the given peer.
+// In direct mode, the direct address is returned without routing. With the ring
+// cache, the owner is computed locally, and found through the peer only if the ring
+// could not be fetched.
+func findOwner(id int, peerAddr string) (string, error) {
+	ownerAddr, conn, _, err := lookupOwner(id, peerAddr)
+	if conn != nil {
+		conn.Close()
+	}
+	return ownerAddr, err
+}
+
+// Returns the address of the owner of the given key along with a connection to it,
+// found through the given peer. If the given peer owns the key itself, the
+// connection of the lookup is handed over instead of connecting again.
+func connectToOwner(id int, peerAddr string) (string, net.Conn, *bufio.Reader, error) {
+	ownerAddr, conn, reader, err := lookupOwner(id, peerAddr)
+	if err != nil || conn != nil {
+		return ownerAddr, conn, reader, err
+	}
+	conn, reader, err = connectToPeer(ownerAddr)
+	return ownerAddr, conn, reader, err
+}
+
+// Checks whether the given address is the one that the connection goes to.
+func connectedTo(conn net.Conn, address string) bool {
+	address = strings.TrimSpace(address)
+	if strings.HasPrefix(address, "unix:") {
+		return conn.RemoteAddr().String() == strings.TrimPrefix(address, "unix:")
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+	return err == nil && tcpAddr.String() == conn.RemoteAddr().String()
+}
+
+// Finds the owner of the given key like findOwner. If the lookup is answered by the
+// given peer with its own address, the connection to it is left open and returned,
+// otherwise the returned connection is nil.
+func lookupOwner(id int, peerAddr string) (string, net.Conn, *bufio.Reader, error) {
+	if *directAddr != "" {
+		return *directAddr, nil, nil, nil
+	}
+	if *ringCacheTTL > 0 {
+		ownerAddr, err := cachedOwner(id, peerAddr)
+		if err == nil {
+			if *traceLookups {
+				fmt.Println("DEBUG: Lookup of", id, "computed from the cached ring =>", ownerAddr)
+			}
+			return ownerAddr, nil, nil, nil
+		}
+		if *traceLookups {
+			fmt.Println("DEBUG: Could not fetch the ring, looking up", id, "through the peer:", err)
+		}
+	}
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	answer, err := askForSuccesorOver(conn, reader, id)
+	// The peer owns the key itself, so its connection can be used for the request.
+	if err == nil && connectedTo(conn, answer) {
+		if *traceLookups {
+			fmt.Println("DEBUG: Lookup of", id, "is owned by", peerAddr, "reusing the connection")
+		}
+		return answer, conn, reader, nil
+	}
+	conn.Close()
+	hops := []string{peerAddr}
+	// Peers in iterative mode reply with the next hop instead of forwarding the
+	// request, so follow the hops until the successor is found.
+	for err == nil && strings.HasPrefix(answer, "NEXT ") && len(hops) <= int(ringCapacity) {
+		nextAddr := strings.TrimSpace(strings.TrimPrefix(answer, "NEXT "))
+		hops = append(hops, nextAddr)
+		answer, err = askForSuccesor(id, nextAddr)
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if *traceLookups {
+		fmt.Println("DEBUG: Lookup of", id, "visited", strings.Join(hops, " -> "), "=>", strings.TrimSpace(answer))
+	}
+	if strings.HasPrefix(answer, "ERR") {
+		_, respMsg := extractServerResponse(answer)
+		return "", nil, nil, fmt.Errorf("could not find the owner: %w", responseError(respMsg))
+	}
+	// The hops did not lead to a node that takes the key.
+	if strings.HasPrefix(answer, "NEXT ") || strings.TrimSpace(answer) == "" {
+		return "", nil, nil, fmt.Errorf("%w: the lookup of %d did not end at a node", ErrNoOwner, id)
+	}
+	return answer, nil, nil, nil
+}
+
+// A connection that carries several requests at once, each tagged with an id, whose
+// responses may arrive in any order.
+type muxConn struct {
+	conn        net.Conn
+	writeMutex  sync.Mutex
+	waitersLock sync.Mutex
+	waiters     map[int]chan muxResponse
+	lastID      int
+	// Set once the connection fails, after which every request fails.
+	err error
+}
+
+// The response to a multiplexed request.
+type muxResponse struct {
+	payload string
+	err     error
+}
+
+// Connects to the peer at the given address and switches the connection to
+// multiplexed requests.
+// MUX => OK
+func dialMux(peerAddr string) (*muxConn, error) {
+	err := requireCapability(peerAddr, "mux")
+	if err != nil {
+		return nil, err
+	}
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn.Write([]byte("MUX\n"))
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrNetwork, err)
+	}
+	respType, respMsg := extractServerResponse(serverResponse)
+	if respType != "OK" {
+		conn.Close()
+		return nil, responseError(respMsg)
+	}
+	m := &muxConn{conn: conn, waiters: make(map[int]chan muxResponse)}
+	go m.readResponses(reader)
+	return m, nil
+}
+
+// Reads the responses and hands each one to the request with its id, until the
+// connection fails.
+// <id> <response length>\n<response>
+func (m *muxConn) readResponses(reader *bufio.Reader) {
+	var err error
+	for err == nil {
+		var header string
+		header, err = reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		var id, length int
+		_, err = fmt.Sscanf(header, "%d %d", &id, &length)
+		if err != nil {
+			break
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			break
+		}
+		m.waitersLock.Lock()
+		waiter, ok := m.waiters[id]
+		delete(m.waiters, id)
+		m.waitersLock.Unlock()
+		if ok {
+			waiter <- muxResponse{payload: string(payload)}
+		}
+	}
+	// Fail the requests still waiting, and the ones to come.
+	m.waitersLock.Lock()
+	m.err = fmt.Errorf("%w: %v", ErrNetwork, err)
+	for id, waiter := range m.waiters {
+		waiter <- muxResponse{err: m.err}
+		delete(m.waiters, id)
+	}
+	m.waitersLock.Unlock()
+}
+
+// Sends the given request and waits for its response. Can be called concurrently.
+func (m *muxConn) request(request string) (string, error) {
+	waiter := make(chan muxResponse, 1)
+	m.waitersLock.Lock()
+	if m.err != nil {
+		m.waitersLock.Unlock()
+		return "", m.err
+	}
+	m.lastID++
+	id := m.lastID
+	m.waiters[id] = waiter
+	m.waitersLock.Unlock()
+	m.writeMutex.Lock()
+	_, err := m.conn.Write([]byte(fmt.Sprintf("%d %s\n", id, request)))
+	m.writeMutex.Unlock()
+	if err != nil {
+		m.conn.Close()
+	}
+	response := <-waiter
+	return response.payload, response.err
+}
+
+// Closes the connection.
+func (m *muxConn) close() {
+	m.conn.Close()
+}
+
+// Returns the owners of the given files by their names, along with the errors of the
+// files whose owners could not be found. The lookups are sent at once over a single
+// multiplexed connection to the given peer if it supports it, otherwise they are made
+// one by one.
+func findOwners(fileNames []string, peerAddr string) (map[string]string, map[string]error) {
+	owners := make(map[string]string)
+	errs := make(map[string]error)
+	var m *muxConn
+	if *directAddr == "" && *ringCacheTTL <= 0 {
+		m, _ = dialMux(peerAddr)
+	}
+	if m == nil {
+		for _, fileName := range fileNames {
+			succAddr, err := findOwner(hsh(fileName), peerAddr)
+			if err != nil {
+				errs[fileName] = err
+				continue
+			}
+			owners[fileName] = succAddr
+		}
+		return owners, errs
+	}
+	defer m.close()
+	var resultsMutex sync.Mutex
+	var lookups sync.WaitGroup
+	for _, fileName := range fileNames {
+		lookups.Add(1)
+		go func() {
+			defer lookups.Done()
+			answer, err := m.request(fmt.Sprintf("SUCC %d", hsh(fileName)))
+			// Peers in iterative mode reply with the next hop, which is followed as usual.
+			if err == nil && strings.HasPrefix(answer, "NEXT ") {
+				answer, err = findOwner(hsh(fileName), peerAddr)
+			} else if err == nil && strings.HasPrefix(answer, "ERR") {
+				_, respMsg := extractServerResponse(answer)
+				err = fmt.Errorf("could not find the owner: %w", responseError(respMsg))
+			}
+			resultsMutex.Lock()
+			defer resultsMutex.Unlock()
+			if err != nil {
+				errs[fileName] = err
+				return
+			}
+			owners[fileName] = strings.TrimSpace(answer)
+		}()
+	}
+	lookups.Wait()
+	return owners, errs
+}
+
+// Constructs a successor request with the given id and sends it to the given address.
+// Returns the answer to the request (i.e. the address of the successor, or the next
+// hop if the peer is in iterative mode).
+// SUCC <id> => <succ addr> | NEXT <next hop addr> | ERR <msg>
+func askForSuccesor(id int, peerAddr string) (string, error) {
+	// Initiate a connection with the given peer address.
+	conn, reader, err := connectToPeer(peerAddr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return askForSuccesorOver(conn, reader, id)
+}
+
+// Sends a successor request with the given id through an open connection and
+// returns the answer like askForSuccesor. The connection can be used for a further
+// request.
+func askForSuccesorOver(conn net.Conn, reader *bufio.Reader, id int) (string, error) {
+	// Send the successor request.
+	succRequest := fmt.Sprintf("SUCC %d\n", id)
+	conn.Write([]byte(succRequest))
+	// Wait for an answer.
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("%w: could not get the successor: %v", ErrNetwork, err)
+	}
+	// The answer will only contain the address of the successor.
+	return answer, nil
+}
+
+// Prints the key of each of the given strings on its own line. If none are given, the
+// strings are read from the standard input, one per line.
+func printKeys(inputs []string) {
+	if len(inputs) > 0 {
+		for _, input := range inputs {
+			fmt.Println(hsh(input))
+		}
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fmt.Println(hsh(scanner.Text()))
+	}
+}
+
+func main() {
+	flag.Parse()
+	// client hash [<string>...] prints the keys of the strings and exits.
+	if flag.Arg(0) == "hash" {
+		printKeys(flag.Args()[1:])
+		return
+	}
+	storeIP := flag.Arg(0)
+	storePort := flag.Arg(1)
+	storeAddr := storeIP + ":" + storePort
+	if *unixPath != "" {
+		storeAddr = "unix:" + *unixPath
+	}
+	entryAddr = storeAddr
+	// Compute the keys the way the ring does.
+	if *hashSeed == "" {
+		params, err := askForParams(storeAddr)
+		if err != nil {
+			fmt.Println("Could not get the hash seed of the ring:", err)
+		} else {
+			*hashSeed = params["seed"]
+		}
+	}
+	// Show the main menu, marking the debug mode.
+	fmt.Println(mainMenu)
+	if *directAddr != "" {
+		fmt.Println("(debug) Routing is bypassed, every file goes through", *directAddr)
+		fmt.Println()
+	}
+	for {
+		// Ask the user for a selection.
+		fmt.Print("> Please select an option: ")
+		var input string
+		fmt.Scanln(&input)
+		selectedOption, err := strconv.Atoi(input)
+		if err != nil {
+			fmt.Println("Invalid choice.")
+			continue
+		}
+		// Act accordingly.
+		switch selectedOption {
+		case 1:
+			// Ask the filename to hash.
+			fmt.Print("> Enter the file name to store: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			start := time.Now()
+			err := storeFile(fileName, 0, storeAddr)
+			elapsed := time.Since(start)
+			if err != nil {
+				fmt.Println("> Could not store the file:", err)
+			} else {
+				fmt.Println("File successfully stored.")
+			}
+			fmt.Println("Transfer took", elapsed.Microseconds(), "us")
+		case 2:
+			// Ask the filename to hash.
+			fmt.Print("> Enter the file name to retrieve: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			start := time.Now()
+			err := retrieveFile(fileName, storeAddr)
+			elapsed := time.Since(start)
+			if errors.Is(err, ErrNotFound) {
+				fmt.Println("> File does not exist.")
+			} else if err != nil {
+				fmt.Println("> Could not retrieve the file:", err)
+			} else {
+				fmt.Println("File retrieved successfully.")
+			}
+			fmt.Println("Transfer took", elapsed.Microseconds(), "us")
+		case 3:
+			fmt.Println("Goodbye!")
+			return
+		case 4:
+			// Ask the peer to export.
+			fmt.Print("> Enter the peer address to export: ")
+			var exportAddr string
+			fmt.Scanln(&exportAddr)
+			fmt.Print("> Enter the archive name: ")
+			var archiveName string
+			fmt.Scanln(&archiveName)
+			exportFiles(archiveName, exportAddr)
+		case 5:
+			// Ask the archive to import.
+			fmt.Print("> Enter the archive name to import: ")
+			var archiveName string
+			fmt.Scanln(&archiveName)
+			importFiles(archiveName, storeAddr)
+		case 6:
+			// Ask the filename to delete.
+			fmt.Print("> Enter the file name to delete: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			err := deleteFile(fileName, storeAddr)
+			if err != nil {
+				fmt.Println("> Could not delete the file:", err)
+			} else {
+				fmt.Println("File successfully deleted.")
+			}
+		case 7:
+			// Ask the filename to store and its TTL.
+			fmt.Print("> Enter the file name to store: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			fmt.Print("> Enter the TTL in seconds: ")
+			var ttlString string
+			fmt.Scanln(&ttlString)
+			ttl, err := strconv.Atoi(ttlString)
+			if err != nil || ttl <= 0 {
+				fmt.Println("Invalid TTL!")
+				continue
+			}
+			err = storeFile(fileName, ttl, storeAddr)
+			if err != nil {
+				fmt.Println("> Could not store the file:", err)
+			} else {
+				fmt.Println("File successfully stored.")
+			}
+		case 8:
+			// Ask the peer whose neighbors to list.
+			fmt.Print("> Enter the peer address: ")
+			var nodeAddr string
+			fmt.Scanln(&nodeAddr)
+			listNeighborFiles(nodeAddr)
+		case 9:
+			describeRing(storeAddr)
+		case 10:
+			// Ask the old and the new file names.
+			fmt.Print("> Enter the file name to rename: ")
+			var oldName string
+			fmt.Scanln(&oldName)
+			fmt.Print("> Enter the new file name: ")
+			var newName string
+			fmt.Scanln(&newName)
+			err := renameFile(oldName, newName, storeAddr)
+			if err != nil {
+				fmt.Println("> Could not rename the file:", err)
+			} else {
+				fmt.Println("File successfully renamed.")
+			}
+		case 11:
+			// Ask the filename to retrieve and its checksum.
+			fmt.Print("> Enter the file name to retrieve: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			fmt.Print("> Enter the expected SHA-256 checksum: ")
+			var expectedSum string
+			fmt.Scanln(&expectedSum)
+			err := retrieveVerifiedFile(fileName, expectedSum, storeAddr)
+			if errors.Is(err, ErrChecksum) {
+				fmt.Println("> The retrieved file is corrupt and was discarded:", err)
+			} else if err != nil {
+				fmt.Println("> Could not retrieve the file:", err)
+			} else {
+				fmt.Println("File retrieved and verified successfully.")
+			}
+		case 12:
+			// Ask the filename to put.
+			fmt.Print("> Enter the file name to put: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			key, err := putBlob(fileName, storeAddr)
+			if err != nil {
+				fmt.Println("> Could not put the file:", err)
+			} else {
+				fmt.Println("File successfully stored with the key", key)
+			}
+		case 13:
+			// Ask the key to get and where to save it.
+			fmt.Print("> Enter the key to get: ")
+			var key string
+			fmt.Scanln(&key)
+			fmt.Print("> Enter the file name to save as: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			err := getBlob(key, fileName, storeAddr)
+			if errors.Is(err, ErrNotFound) {
+				fmt.Println("> No file is stored with this key.")
+			} else if err != nil {
+				fmt.Println("> Could not get the file:", err)
+			} else {
+				fmt.Println("File retrieved and verified successfully.")
+			}
+		case 14:
+			violations := checkRingInvariants(storeAddr)
+			if len(violations) < 1 {
+				fmt.Println("No violations found.")
+			}
+			for _, violation := range violations {
+				fmt.Println("Violation:", violation)
+			}
+		case 15:
+			// Ask the filename to push and the destination.
+			fmt.Print("> Enter the file name to push: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			fmt.Print("> Enter the destination peer address: ")
+			var destAddr string
+			fmt.Scanln(&destAddr)
+			err := pushFile(fileName, destAddr, storeAddr)
+			if errors.Is(err, ErrNotFound) {
+				fmt.Println("> File does not exist.")
+			} else if err != nil {
+				fmt.Println("> Could not push the file:", err)
+			} else {
+				fmt.Println("File successfully pushed.")
+			}
+		case 16:
+			// Ask the filename to touch and its new TTL.
+			fmt.Print("> Enter the file name to touch: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			fmt.Print("> Enter the new TTL in seconds: ")
+			var ttlString string
+			fmt.Scanln(&ttlString)
+			ttl, err := strconv.Atoi(ttlString)
+			if err != nil || ttl <= 0 {
+				fmt.Println("Invalid TTL!")
+				continue
+			}
+			err = touchFile(fileName, ttl, storeAddr)
+			if errors.Is(err, ErrNotFound) {
+				fmt.Println("> File does not exist.")
+			} else if err != nil {
+				fmt.Println("> Could not touch the file:", err)
+			} else {
+				fmt.Println("File successfully touched.")
+			}
+		case 17:
+			// Ask the filenames to retrieve.
+			fmt.Print("> Enter the file names to retrieve (comma separated): ")
+			var fileList string
+			fmt.Scanln(&fileList)
+			fileNames := strings.Split(fileList, ",")
+			start := time.Now()
+			errs := retrieveFiles(fileNames, storeAddr)
+			elapsed := time.Since(start)
+			for _, fileName := range fileNames {
+				if errors.Is(errs[fileName], ErrNotFound) {
+					fmt.Println(">", fileName, "does not exist.")
+				} else if errs[fileName] != nil {
+					fmt.Println("> Could not retrieve", fileName+":", errs[fileName])
+				} else {
+					fmt.Println(fileName, "retrieved successfully.")
+				}
+			}
+			fmt.Println("Transfer took", elapsed.Microseconds(), "us")
+		case 18:
+			// Ask the key to trace.
+			fmt.Print("> Enter the key to trace: ")
+			var keyString string
+			fmt.Scanln(&keyString)
+			key, err := strconv.Atoi(keyString)
+			if err != nil || key < 0 || key >= int(ringCapacity) {
+				fmt.Println("Invalid key!")
+				continue
+			}
+			traceKey(key, storeAddr)
+		case 19:
+			// Ask the peers to compare.
+			fmt.Print("> Enter the first peer address: ")
+			var firstAddr string
+			fmt.Scanln(&firstAddr)
+			fmt.Print("> Enter the second peer address: ")
+			var secondAddr string
+			fmt.Scanln(&secondAddr)
+			compareKeys(firstAddr, secondAddr)
+		case 20:
+			// Ask the directory to store.
+			fmt.Print("> Enter the directory to store: ")
+			var dirPath string
+			fmt.Scanln(&dirPath)
+			stored, failures, err := storeDirectory(dirPath, storeAddr)
+			if err != nil {
+				fmt.Println("> Not storing the directory:", err)
+				continue
+			}
+			fmt.Println("Stored", stored, "files,", len(failures), "failed.")
+			for fileName, err := range failures {
+				fmt.Println(" ", fileName+":", err)
+			}
+		case 21:
+			// Ask the filename to pin.
+			fmt.Print("> Enter the file name to pin: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			err := pinFile(fileName, storeAddr)
+			if errors.Is(err, ErrNotFound) {
+				fmt.Println("> File does not exist.")
+			} else if err != nil {
+				fmt.Println("> Could not pin the file:", err)
+			} else {
+				fmt.Println("File successfully pinned.")
+			}
+		case 22:
+			printLatencies(storeAddr)
+		case 23:
+			// Ask the pattern to match.
+			fmt.Print("> Enter the pattern to match (e.g. *.txt): ")
+			var pattern string
+			fmt.Scanln(&pattern)
+			matches, err := ListKeys(pattern)
+			if err != nil {
+				fmt.Println("> Could not list the files:", err)
+				continue
+			}
+			if len(matches) < 1 {
+				fmt.Println("No files match the pattern.")
+			}
+			for _, match := range matches {
+				fmt.Println(" ", match.Name, "=>", match.Key, "on", match.Owner, match.Size, "bytes", match.Sum)
+			}
+		case 24:
+			// Ask the filename to forget.
+			fmt.Print("> Enter the file name to forget: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			removedFrom, err := forgetFile(fileName, storeAddr)
+			for _, nodeAddr := range removedFrom {
+				fmt.Println("  Removed from", nodeAddr)
+			}
+			if err != nil {
+				fmt.Println("> The file may not be forgotten everywhere:", err)
+			} else if len(removedFrom) < 1 {
+				fmt.Println("No copies of the file were found.")
+			} else {
+				fmt.Println("File forgotten on every peer.")
+			}
+		case 25:
+			// Ask the files to check, and how thoroughly.
+			fmt.Print("> Enter the file names (comma separated) or a pattern to check: ")
+			var fileList string
+			fmt.Scanln(&fileList)
+			fmt.Print("> Retrieve the files as well? (y/n): ")
+			var full string
+			fmt.Scanln(&full)
+			fileNames := strings.Split(fileList, ",")
+			if strings.ContainsAny(fileList, "*?[") {
+				matches, err := ListKeys(fileList)
+				if err != nil {
+					fmt.Println("> Could not list the files:", err)
+					continue
+				}
+				fileNames = []string{}
+				for _, match := range matches {
+					fileNames = append(fileNames, match.Name)
+				}
+			}
+			problems := checkFiles(fileNames, strings.ToLower(full) == "y", storeAddr)
+			for _, fileName := range fileNames {
+				if problems[fileName] != nil {
+					fmt.Println(">", fileName+":", problems[fileName])
+				}
+			}
+			fmt.Println("Checked", len(fileNames), "files,", len(problems), "have problems.")
+		case 26:
+			// Ask how many files to show.
+			fmt.Print("> Enter the number of files to show: ")
+			var countString string
+			fmt.Scanln(&countString)
+			count, err := strconv.Atoi(countString)
+			if err != nil || count <= 0 {
+				fmt.Println("Invalid count!")
+				continue
+			}
+			hottest, err := hottestFiles(count, storeAddr)
+			if err != nil {
+				fmt.Println("> Could not get the access counts:", err)
+				continue
+			}
+			if len(hottest) < 1 {
+				fmt.Println("No files have been accessed.")
+			}
+			for _, file := range hottest {
+				fmt.Printf("  %s (%d) on %s: %d reads, %d writes, last at %s\n",
+					file.Name, file.Key, file.Owner, file.Reads, file.Writes, file.LastAccess.Format(time.Stamp))
+			}
+		case 27:
+			// Ask the file to watch and how often to poll it.
+			fmt.Print("> Enter the file name to watch: ")
+			var fileName string
+			fmt.Scanln(&fileName)
+			fmt.Print("> Enter the polling interval (e.g. 1s): ")
+			var intervalString string
+			fmt.Scanln(&intervalString)
+			interval, err := time.ParseDuration(intervalString)
+			if err != nil || interval <= 0 {
+				fmt.Println("Invalid interval!")
+				continue
+			}
+			// Watch until interrupted.
+			fmt.Println("Watching", fileName+", press Ctrl-C to stop.")
+			interrupts := make(chan os.Signal, 1)
+			signal.Notify(interrupts, os.Interrupt)
+			stop := make(chan struct{})
+			go func() {
+				<-interrupts
+				close(stop)
+			}()
+			watchFile(fileName, interval, storeAddr, stop)
+			signal.Stop(interrupts)
+		case 28:
+			repaired, err := repairPredecessors(storeAddr)
+			for _, nodeAddr := range repaired {
+				fmt.Println("Repaired the predecessor of", nodeAddr)
+			}
+			if err != nil {
+				fmt.Println("> Could not repair the ring:", err)
+			} else if len(repaired) < 1 {
+				fmt.Println("All predecessors are correct.")
+			}
+		case 29:
+			// Ask the filenames to store.
+			fmt.Print("> Enter the file names to store (comma separated): ")
+			var fileList string
+			fmt.Scanln(&fileList)
+			err := storeFilesAtomically(strings.Split(fileList, ","), storeAddr)
+			if err != nil {
+				fmt.Println("> Could not store the files:", err)
+			} else {
+				fmt.Println("Files successfully stored.")
+			}
 		}
 	}
 }
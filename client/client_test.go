@@ -0,0 +1,1476 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHshConcurrent(t *testing.T) {
+	names := make([]string, 200)
+	want := make([]int, len(names))
+	for i := range names {
+		names[i] = fmt.Sprintf("file-%d.txt", i)
+		want[i] = hsh(names[i])
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, name := range names {
+				if got := hsh(name); got != want[i] {
+					t.Errorf("hsh(%q) = %d, want %d", name, got, want[i])
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// A peer that owns some of the keys, and takes transactions on them.
+type fakeOwner struct {
+	address string
+	// Delays the end of each store, as a slow transfer would.
+	storeDelay time.Duration
+	// Rejects the store of this file.
+	reject string
+	// Discards a transaction that is idle for longer than this, as a peer does.
+	idleTimeout time.Duration
+	// Votes against the transactions.
+	voteAgainst bool
+	// Answers the lookups of the keys, given the address of the peer asked.
+	owner func(id int) string
+
+	mutex      sync.Mutex
+	committed  []string
+	keepAlives int
+	prepares   int
+}
+
+// Starts a fake peer, which answers until the test is over.
+func startFakeOwner(t *testing.T, owner *fakeOwner) {
+	t.Helper()
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ls.Close() })
+	owner.address = ls.Addr().String()
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go owner.serve(conn)
+		}
+	}()
+}
+
+func (f *fakeOwner) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tokens := strings.Fields(line)
+		switch tokens[0] {
+		case "PARAMS":
+			conn.Write([]byte("OK caps=txn\n"))
+		case "SUCC":
+			var id int
+			fmt.Sscan(tokens[1], &id)
+			conn.Write([]byte(f.owner(id) + "\n"))
+		case "TXN":
+			conn.Write([]byte("OK\n"))
+			f.transaction(conn, reader)
+			return
+		default:
+			conn.Write([]byte("ERR Unknown request\n"))
+			return
+		}
+	}
+}
+
+// Takes the stores of a transaction until it is committed, aborted or discarded.
+func (f *fakeOwner) transaction(conn net.Conn, reader *bufio.Reader) {
+	staged := []string{}
+	prepared := false
+	for {
+		if f.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(f.idleTimeout))
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tokens := strings.Fields(line)
+		switch tokens[0] {
+		case "STORE":
+			if tokens[1] == f.reject {
+				conn.Write([]byte("ERR Could not store file.\n"))
+				return
+			}
+			var size int64
+			fmt.Sscan(tokens[2], &size)
+			conn.Write([]byte("OK\n"))
+			conn.SetReadDeadline(time.Time{})
+			_, err := io.CopyN(io.Discard, reader, size)
+			if err != nil {
+				return
+			}
+			time.Sleep(f.storeDelay)
+			staged = append(staged, tokens[1])
+			conn.Write([]byte("OK\n"))
+		case "KEEPALIVE":
+			f.mutex.Lock()
+			f.keepAlives++
+			f.mutex.Unlock()
+			conn.Write([]byte("OK\n"))
+		case "PREPARE":
+			f.mutex.Lock()
+			f.prepares++
+			f.mutex.Unlock()
+			if f.voteAgainst {
+				conn.Write([]byte("ERR Could not prepare.\n"))
+				return
+			}
+			prepared = true
+			conn.Write([]byte("OK\n"))
+		case "COMMIT":
+			if !prepared {
+				conn.Write([]byte("ERR Not prepared.\n"))
+				return
+			}
+			f.mutex.Lock()
+			f.committed = append(f.committed, staged...)
+			f.mutex.Unlock()
+			conn.Write([]byte("OK\n"))
+			return
+		default:
+			return
+		}
+	}
+}
+
+func (f *fakeOwner) committedFiles() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.committed...)
+}
+
+// Starts two fake owners, one for the even keys and a slow one for the odd keys, and
+// creates local files that are split between them.
+func startTwoOwners(t *testing.T) (*fakeOwner, *fakeOwner, []string) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	even := &fakeOwner{idleTimeout: 200 * time.Millisecond}
+	odd := &fakeOwner{storeDelay: 150 * time.Millisecond}
+	route := func(id int) string {
+		if id%2 == 0 {
+			return even.address
+		}
+		return odd.address
+	}
+	even.owner, odd.owner = route, route
+	startFakeOwner(t, even)
+	startFakeOwner(t, odd)
+	fileNames := []string{}
+	evens, odds := 0, 0
+	for i := 0; evens < 2 || odds < 3; i++ {
+		fileName := fmt.Sprintf("file-%d.txt", i)
+		if hsh(fileName)%2 == 0 {
+			if evens == 2 {
+				continue
+			}
+			evens++
+		} else {
+			if odds == 3 {
+				continue
+			}
+			odds++
+		}
+		err := os.WriteFile(fileName, []byte("contents of "+fileName), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileNames = append(fileNames, fileName)
+	}
+	return even, odd, fileNames
+}
+
+func TestAtomicStoreKeepsStagedOwnersAlive(t *testing.T) {
+	defer func(interval time.Duration) { *txnKeepAlive = interval }(*txnKeepAlive)
+	*txnKeepAlive = 50 * time.Millisecond
+	even, odd, fileNames := startTwoOwners(t)
+	// The odd owner takes longer to stage its files than the even owner stays idle.
+	err := storeFilesAtomically(fileNames, even.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(even.committedFiles()) + len(odd.committedFiles()); got != len(fileNames) {
+		t.Errorf("committed %d files, want %d", got, len(fileNames))
+	}
+	even.mutex.Lock()
+	defer even.mutex.Unlock()
+	if even.keepAlives == 0 {
+		t.Error("the staged transaction was not kept alive")
+	}
+}
+
+func TestAtomicStoreCommitsNothingWhenAStoreFails(t *testing.T) {
+	even, odd, fileNames := startTwoOwners(t)
+	for _, fileName := range fileNames {
+		if hsh(fileName)%2 == 1 {
+			odd.reject = fileName
+		}
+	}
+	err := storeFilesAtomically(fileNames, even.address)
+	if !errors.Is(err, ErrServer) {
+		t.Fatalf("err = %v, want ErrServer", err)
+	}
+	// Give the owners the time to see the connections closed.
+	time.Sleep(50 * time.Millisecond)
+	if committed := append(even.committedFiles(), odd.committedFiles()...); len(committed) != 0 {
+		t.Errorf("committed %v", committed)
+	}
+}
+
+func TestAtomicStoreCommitsNothingUnlessEveryOwnerVotesYes(t *testing.T) {
+	defer func(interval time.Duration) { *txnKeepAlive = interval }(*txnKeepAlive)
+	*txnKeepAlive = 50 * time.Millisecond
+	even, odd, fileNames := startTwoOwners(t)
+	// The owner asked last votes against, after the other one has voted yes.
+	first, last := even, odd
+	if last.address < first.address {
+		first, last = last, first
+	}
+	last.voteAgainst = true
+	err := storeFilesAtomically(fileNames, even.address)
+	if err == nil || !strings.Contains(err.Error(), "voted against") {
+		t.Fatalf("err = %v, want the vote against reported", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if committed := append(even.committedFiles(), odd.committedFiles()...); len(committed) != 0 {
+		t.Errorf("committed %v", committed)
+	}
+	first.mutex.Lock()
+	defer first.mutex.Unlock()
+	if first.prepares != 1 {
+		t.Errorf("the other owner voted %d times, want once", first.prepares)
+	}
+}
+
+// A peer that owns a single file, and can cut the first download of it short.
+type fakeFileOwner struct {
+	contents string
+	// The number of bytes after which the next download is cut short, if any.
+	cutAfter int
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+// Starts the fake peer, and routes the requests of the test directly to it.
+func startFakeFileOwner(t *testing.T, owner *fakeFileOwner) {
+	t.Helper()
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ls.Close() })
+	previous := *directAddr
+	t.Cleanup(func() { *directAddr = previous })
+	*directAddr = ls.Addr().String()
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go owner.serve(conn)
+		}
+	}()
+}
+
+func (f *fakeFileOwner) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f.mutex.Lock()
+		f.requests = append(f.requests, strings.TrimSpace(line))
+		cutAfter := f.cutAfter
+		f.cutAfter = 0
+		f.mutex.Unlock()
+		tokens := strings.Fields(line)
+		switch tokens[0] {
+		case "PARAMS":
+			conn.Write([]byte("OK caps=range,stat\n"))
+		case "STAT":
+			conn.Write([]byte(fmt.Sprintf("OK %d 0 %s pinned=false\n", len(f.contents), checksumOf(f.contents))))
+		case "RETRIEVE":
+			offset := 0
+			if len(tokens) > 2 {
+				fmt.Sscan(tokens[2], &offset)
+			}
+			rest := f.contents[offset:]
+			conn.Write([]byte(fmt.Sprintf("OK %d\n", len(rest))))
+			if cutAfter > 0 {
+				conn.Write([]byte(rest[:cutAfter]))
+				return
+			}
+			conn.Write([]byte(rest + "OK\n"))
+		default:
+			return
+		}
+	}
+}
+
+// Returns the requests received so far, and forgets them.
+func (f *fakeFileOwner) takeRequests() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	requests := f.requests
+	f.requests = nil
+	return requests
+}
+
+func checksumOf(contents string) string {
+	sum := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestRetrieveMakesNoExtraRoundTrips(t *testing.T) {
+	t.Chdir(t.TempDir())
+	owner := &fakeFileOwner{contents: "the contents of the file"}
+	startFakeFileOwner(t, owner)
+	// A local file of the same name is not a part of a download, and is replaced.
+	os.WriteFile("a.txt", []byte("unrelated"), 0644)
+	err := retrieveFile("a.txt", *directAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := os.ReadFile("a.txt"); string(contents) != owner.contents {
+		t.Errorf("a.txt = %q", contents)
+	}
+	if requests := owner.takeRequests(); len(requests) != 1 || requests[0] != "RETRIEVE a.txt" {
+		t.Errorf("requests = %q, want a single RETRIEVE", requests)
+	}
+	if _, err := os.Stat("a.txt.part"); err == nil {
+		t.Error("the part file was left behind")
+	}
+}
+
+func TestRetrieveResumesACutDownload(t *testing.T) {
+	t.Chdir(t.TempDir())
+	owner := &fakeFileOwner{contents: "the contents of the file", cutAfter: 10}
+	startFakeFileOwner(t, owner)
+	err := retrieveFile("a.txt", *directAddr)
+	if !errors.Is(err, ErrNetwork) {
+		t.Fatalf("cut download: err = %v, want ErrNetwork", err)
+	}
+	if part, _ := os.ReadFile("a.txt.part"); string(part) != owner.contents[:10] {
+		t.Fatalf("part = %q", part)
+	}
+	owner.takeRequests()
+	err = retrieveFile("a.txt", *directAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := os.ReadFile("a.txt"); string(contents) != owner.contents {
+		t.Errorf("a.txt = %q", contents)
+	}
+	requests := owner.takeRequests()
+	if requests[len(requests)-1] != "RETRIEVE a.txt 10" {
+		t.Errorf("requests = %q, want the rest retrieved", requests)
+	}
+	for _, leftover := range []string{"a.txt.part", "a.txt.part.sum"} {
+		if _, err := os.Stat(leftover); err == nil {
+			t.Errorf("%s was left behind", leftover)
+		}
+	}
+}
+
+func TestRetrieveStartsOverWhenTheFileChanged(t *testing.T) {
+	t.Chdir(t.TempDir())
+	owner := &fakeFileOwner{contents: "the new contents of the file"}
+	startFakeFileOwner(t, owner)
+	// The part belongs to an older version of the file.
+	os.WriteFile("a.txt.part", []byte("the old"), 0644)
+	os.WriteFile("a.txt.part.sum", []byte(checksumOf("the old contents")+"\n"), 0644)
+	err := retrieveFile("a.txt", *directAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := os.ReadFile("a.txt"); string(contents) != owner.contents {
+		t.Errorf("a.txt = %q", contents)
+	}
+	for _, request := range owner.takeRequests() {
+		if strings.HasPrefix(request, "RETRIEVE a.txt ") {
+			t.Errorf("resumed a part of another version: %q", request)
+		}
+	}
+}
+
+func TestVerifiedRetrieveChecksThePartAgainstTheExpectedSum(t *testing.T) {
+	t.Chdir(t.TempDir())
+	owner := &fakeFileOwner{contents: "the new contents of the file"}
+	startFakeFileOwner(t, owner)
+	os.WriteFile("a.txt.part", []byte("the new"), 0644)
+	// The owner has another version than the one expected, so the part is not kept.
+	err := retrieveVerifiedFile("a.txt", checksumOf("the old contents"), *directAddr)
+	if !errors.Is(err, ErrChecksum) {
+		t.Fatalf("err = %v, want ErrChecksum", err)
+	}
+	for _, request := range owner.takeRequests() {
+		if strings.HasPrefix(request, "RETRIEVE a.txt ") {
+			t.Errorf("resumed a part of another version: %q", request)
+		}
+	}
+	if _, err := os.Stat("a.txt.part"); err == nil {
+		t.Error("the part of a mismatching download was kept")
+	}
+}
+
+func TestCapabilitiesAreAskedForOnce(t *testing.T) {
+	owner := &fakeFileOwner{}
+	startFakeFileOwner(t, owner)
+	for _, feature := range []string{"range", "stat", "range"} {
+		if err := requireCapability(*directAddr, feature); err != nil {
+			t.Fatalf("%s: %v", feature, err)
+		}
+	}
+	if err := requireCapability(*directAddr, "txn"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("txn: err = %v, want ErrUnsupported", err)
+	}
+	if requests := owner.takeRequests(); len(requests) != 1 {
+		t.Errorf("requests = %q, want a single PARAMS", requests)
+	}
+	// The capabilities are asked for again once the ring is.
+	invalidateRing()
+	requireCapability(*directAddr, "range")
+	if requests := owner.takeRequests(); len(requests) != 1 {
+		t.Errorf("requests after the ring is dropped = %q, want a single PARAMS", requests)
+	}
+}
+
+// A peer that keeps its files in memory.
+type memoryPeer struct {
+	address string
+	// The neighbors of the peer, or NONE if it is alone.
+	predecessor string
+	successor   string
+	// Answers the lookups of the keys through this peer.
+	route func(id int) string
+	// The errors replied to the next retrieves, in order.
+	refusals []string
+	// Whether the stores of the files that the peer does not own are rejected.
+	assertOwner bool
+	// The stores of the files larger than this are rejected, if it is nonzero.
+	maxFileSize int64
+	// Whether the peer refuses to store any file, as a peer in nostore mode does.
+	noStore bool
+	// The capacity reported in PARAMS replies, if not the one of the client.
+	capacity uint32
+	// Whether the peer replies with the next hop to the lookups that neither it nor its
+	// successor owns, as a peer in iterative mode does.
+	iterative bool
+
+	// The listener of the peer, closed to take it down.
+	listener net.Listener
+
+	mutex     sync.Mutex
+	files     map[string][]byte
+	retrieves int
+	// The number of connections over which files were retrieved.
+	retrieveConns int
+}
+
+// Starts a ring of the given number of memory peers, linked in the order of their ids.
+func startMemoryRing(t *testing.T, n int) []*memoryPeer {
+	t.Helper()
+	peers := []*memoryPeer{}
+	ids := make(map[int]bool)
+	for len(peers) < n {
+		ls, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ls.Close() })
+		p := &memoryPeer{address: ls.Addr().String(), predecessor: "NONE", successor: "NONE", listener: ls, files: make(map[string][]byte)}
+		// Skip the addresses whose ids are taken, so that each peer owns some keys.
+		if ids[hsh(p.address)] {
+			continue
+		}
+		ids[hsh(p.address)] = true
+		go func() {
+			for {
+				conn, err := ls.Accept()
+				if err != nil {
+					return
+				}
+				go p.serve(conn)
+			}
+		}()
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return hsh(peers[i].address) < hsh(peers[j].address) })
+	owner := func(id int) string {
+		for _, p := range peers {
+			if id <= hsh(p.address) {
+				return p.address
+			}
+		}
+		return peers[0].address
+	}
+	for i, p := range peers {
+		p.route = owner
+		if n > 1 {
+			p.predecessor = peers[(i+n-1)%n].address
+			p.successor = peers[(i+1)%n].address
+		}
+	}
+	return peers
+}
+
+// Stores the given contents on the peer as is, wherever the file belongs.
+func (p *memoryPeer) put(fileName string, contents string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.files[fileName] = []byte(contents)
+}
+
+func (p *memoryPeer) get(fileName string) (string, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	contents, ok := p.files[fileName]
+	return string(contents), ok
+}
+
+func (p *memoryPeer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	retrieved := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tokens := strings.Fields(line)
+		p.mutex.Lock()
+		switch tokens[0] {
+		case "PARAMS":
+			capacity := ringCapacity
+			if p.capacity != 0 {
+				capacity = p.capacity
+			}
+			fmt.Fprintf(conn, "OK capacity=%d hash=%s version=%d seed=%s caps=range,stat\n", capacity, hashAlgorithm, protocolVersion, *hashSeed)
+		case "SUCC":
+			var id int
+			fmt.Sscan(tokens[1], &id)
+			owner := p.route(id)
+			if p.iterative && owner != p.address && owner != p.successor {
+				owner = "NEXT " + p.successor
+			}
+			fmt.Fprintln(conn, owner)
+		case "NODEINFO":
+			fmt.Fprintf(conn, "OK %s %s\n", p.predecessor, p.successor)
+		case "LIST":
+			fmt.Fprintf(conn, "OK %d\n", len(p.files))
+			for fileName := range p.files {
+				fmt.Fprintf(conn, "%s %d\n", fileName, hsh(fileName))
+			}
+		case "LISTALL":
+			conn.Write([]byte("OK\n"))
+			for fileName, contents := range p.files {
+				sum := sha256.Sum256(contents)
+				fmt.Fprintf(conn, "%s %d %d %s\n", fileName, hsh(fileName), len(contents), hex.EncodeToString(sum[:]))
+			}
+			conn.Write([]byte("\n"))
+		case "STORE":
+			if p.assertOwner && p.route(hsh(tokens[1])) != p.address {
+				conn.Write([]byte("ERR Not the owner.\n"))
+				break
+			}
+			if p.noStore {
+				conn.Write([]byte("ERR Node stores no data\n"))
+				break
+			}
+			var size int64
+			fmt.Sscan(tokens[2], &size)
+			if p.maxFileSize != 0 && size > p.maxFileSize {
+				conn.Write([]byte("ERR No space left.\n"))
+				break
+			}
+			conn.Write([]byte("OK\n"))
+			contents := make([]byte, size)
+			_, err := io.ReadFull(reader, contents)
+			if err != nil {
+				p.mutex.Unlock()
+				return
+			}
+			p.files[tokens[1]] = contents
+			conn.Write([]byte("OK\n"))
+		case "RETRIEVE":
+			p.retrieves++
+			if !retrieved {
+				retrieved = true
+				p.retrieveConns++
+			}
+			contents, ok := p.files[tokens[1]]
+			if len(p.refusals) > 0 {
+				fmt.Fprintf(conn, "ERR %s\n", p.refusals[0])
+				p.refusals = p.refusals[1:]
+			} else if !ok {
+				conn.Write([]byte("ERR File does not exist.\n"))
+			} else {
+				fmt.Fprintf(conn, "OK %d\n%sOK\n", len(contents), contents)
+			}
+		case "STAT":
+			contents, ok := p.files[tokens[1]]
+			if !ok {
+				conn.Write([]byte("ERR File does not exist.\n"))
+				break
+			}
+			fmt.Fprintf(conn, "OK %d 0 %s pinned=false\n", len(contents), checksumOf(string(contents)))
+		case "DELETE":
+			if _, ok := p.files[tokens[1]]; !ok {
+				conn.Write([]byte("ERR File does not exist.\n"))
+				break
+			}
+			delete(p.files, tokens[1])
+			conn.Write([]byte("OK\n"))
+		case "EXPORT":
+			conn.Write([]byte("OK\n"))
+			tw := tar.NewWriter(conn)
+			for fileName, contents := range p.files {
+				tw.WriteHeader(&tar.Header{Name: fileName, Mode: 0644, Size: int64(len(contents))})
+				tw.Write(contents)
+			}
+			tw.Close()
+			p.mutex.Unlock()
+			return
+		case "PING":
+			conn.Write([]byte("OK\n"))
+		case "UPDATE":
+			if len(tokens) == 3 && tokens[1] == "KEEP" {
+				p.predecessor = tokens[2]
+			}
+			conn.Write([]byte("OK\n"))
+		default:
+			conn.Write([]byte("ERR Unknown request\n"))
+		}
+		p.mutex.Unlock()
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	t.Chdir(t.TempDir())
+	source := startMemoryRing(t, 1)[0]
+	want := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		fileName := fmt.Sprintf("file-%d.txt", i)
+		want[fileName] = "contents of " + fileName
+		source.put(fileName, want[fileName])
+	}
+	exportFiles("backup.tar", source.address)
+	// Import the archive into a fresh ring, which routes each file to its owner.
+	ring := startMemoryRing(t, 3)
+	importFiles("backup.tar", ring[0].address)
+	if violations := checkRingInvariants(ring[0].address); len(violations) != 0 {
+		t.Errorf("violations after the import: %v", violations)
+	}
+	for fileName, contents := range want {
+		err := retrieveFile(fileName, ring[1].address)
+		if err != nil {
+			t.Errorf("%s: %v", fileName, err)
+			continue
+		}
+		if retrieved, _ := os.ReadFile(fileName); string(retrieved) != contents {
+			t.Errorf("%s = %q, want %q", fileName, retrieved, contents)
+		}
+	}
+}
+
+func TestCheckRingInvariantsReportsMisplacedFiles(t *testing.T) {
+	ring := startMemoryRing(t, 2)
+	// Store a file on the peer that does not own it.
+	fileName := "a.txt"
+	misplaced := ring[0]
+	if ring[0].route(hsh(fileName)) == ring[0].address {
+		misplaced = ring[1]
+	}
+	misplaced.put(fileName, "contents")
+	violations := checkRingInvariants(ring[0].address)
+	if len(violations) != 1 || !strings.Contains(violations[0].Error(), "does not own it") {
+		t.Errorf("violations = %v, want the misplaced file", violations)
+	}
+	// The same file on both peers.
+	for _, p := range ring {
+		p.put(fileName, "contents")
+	}
+	violations = checkRingInvariants(ring[0].address)
+	found := false
+	for _, violation := range violations {
+		found = found || strings.Contains(violation.Error(), "is stored on both")
+	}
+	if !found {
+		t.Errorf("violations = %v, want the file stored twice", violations)
+	}
+}
+
+func TestRetrieveRetriesWhileNotReady(t *testing.T) {
+	t.Chdir(t.TempDir())
+	p := startMemoryRing(t, 1)[0]
+	p.put("a.txt", "contents")
+	p.refusals = []string{"Not ready, retry", "Not ready, retry"}
+	err := retrieveFile("a.txt", p.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.retrieves != 3 {
+		t.Errorf("retrieves = %d, want 3", p.retrieves)
+	}
+}
+
+func TestRetrieveLooksUpTheOwnerAgainWhenNotOwner(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ring := startMemoryRing(t, 2)
+	fileName := "a.txt"
+	ownerAddr := ring[0].route(hsh(fileName))
+	owner, other := ring[0], ring[1]
+	if owner.address != ownerAddr {
+		owner, other = other, owner
+	}
+	owner.put(fileName, "contents")
+	// The first lookup is answered with a stale owner, as during a join.
+	lookups := 0
+	other.route = func(id int) string {
+		lookups++
+		if lookups == 1 {
+			return other.address
+		}
+		return ownerAddr
+	}
+	other.refusals = []string{"Not the owner."}
+	err := retrieveFile(fileName, other.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retrieved, _ := os.ReadFile(fileName); string(retrieved) != "contents" {
+		t.Errorf("%s = %q", fileName, retrieved)
+	}
+	if lookups != 2 {
+		t.Errorf("lookups = %d, want the owner looked up again", lookups)
+	}
+}
+
+func TestRetrieveErrorsAreTyped(t *testing.T) {
+	t.Chdir(t.TempDir())
+	p := startMemoryRing(t, 1)[0]
+	p.put("corrupt.txt", "contents")
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := ls.Addr().String()
+	ls.Close()
+	if err := retrieveFile("missing.txt", p.address); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing file: err = %v, want ErrNotFound", err)
+	}
+	if err := retrieveFile("a.txt", deadAddr); !errors.Is(err, ErrNetwork) {
+		t.Errorf("unreachable peer: err = %v, want ErrNetwork", err)
+	}
+	p.refusals = []string{"File is corrupt."}
+	if err := retrieveFile("corrupt.txt", p.address); !errors.Is(err, ErrServer) {
+		t.Errorf("corrupt file: err = %v, want ErrServer", err)
+	}
+}
+
+func TestDirectStoreOnANonOwner(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ring := startMemoryRing(t, 2)
+	fileName := "a.txt"
+	nonOwner := ring[0]
+	if nonOwner.route(hsh(fileName)) == nonOwner.address {
+		nonOwner = ring[1]
+	}
+	os.WriteFile(fileName, []byte("contents"), 0644)
+	oldDirectAddr := *directAddr
+	t.Cleanup(func() { *directAddr = oldDirectAddr })
+	*directAddr = nonOwner.address
+	// Without the owner assertion, the file is stored where it is sent.
+	if err := storeFile(fileName, 0, ring[0].address); err != nil {
+		t.Fatal(err)
+	}
+	if contents, ok := nonOwner.get(fileName); !ok || contents != "contents" {
+		t.Errorf("non-owner has %q, %v", contents, ok)
+	}
+	// With it, the store is rejected.
+	nonOwner.mutex.Lock()
+	delete(nonOwner.files, fileName)
+	nonOwner.assertOwner = true
+	nonOwner.mutex.Unlock()
+	if err := storeFile(fileName, 0, ring[0].address); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("err = %v, want ErrNotOwner", err)
+	}
+	if _, ok := nonOwner.get(fileName); ok {
+		t.Errorf("non-owner stored the file")
+	}
+}
+
+// Runs the given function and returns what it prints.
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdout := os.Stdout
+	os.Stdout = w
+	output := make(chan string)
+	go func() {
+		contents, _ := io.ReadAll(r)
+		output <- string(contents)
+	}()
+	f()
+	os.Stdout = oldStdout
+	w.Close()
+	return <-output
+}
+
+// Returns a file name with the given key.
+func nameWithKey(key int) string {
+	for i := 0; ; i++ {
+		fileName := fmt.Sprintf("file-%d.txt", i)
+		if hsh(fileName) == key {
+			return fileName
+		}
+	}
+}
+
+func TestNeighborListingsSplitAtTheBoundaries(t *testing.T) {
+	ring := startMemoryRing(t, 3)
+	predID, selfID := hsh(ring[0].address), hsh(ring[1].address)
+	// The last and the first keys of each boundary around the middle peer.
+	predLast, selfFirst := nameWithKey(predID), nameWithKey((predID+1)%int(ringCapacity))
+	selfLast, succFirst := nameWithKey(selfID), nameWithKey((selfID+1)%int(ringCapacity))
+	for _, fileName := range []string{predLast, selfFirst, selfLast, succFirst} {
+		for _, p := range ring {
+			if p.route(hsh(fileName)) == p.address {
+				p.put(fileName, "contents")
+			}
+		}
+	}
+	output := captureOutput(t, func() { listNeighborFiles(ring[1].address) })
+	predPart, succPart, found := strings.Cut(output, "Successor: ")
+	if !found {
+		t.Fatalf("no successor in the output:\n%s", output)
+	}
+	if !strings.Contains(predPart, ring[0].address) || !strings.Contains(predPart, predLast) {
+		t.Errorf("predecessor listing misses %s:\n%s", predLast, predPart)
+	}
+	if !strings.Contains(succPart, ring[2].address) || !strings.Contains(succPart, succFirst) {
+		t.Errorf("successor listing misses %s:\n%s", succFirst, succPart)
+	}
+	for _, fileName := range []string{selfFirst, selfLast} {
+		if strings.Contains(output, fileName+" ") {
+			t.Errorf("%s of the middle peer is listed on a neighbor:\n%s", fileName, output)
+		}
+	}
+}
+
+func TestDescribeRingCountsNodesAndKeys(t *testing.T) {
+	ring := startMemoryRing(t, 3)
+	// Two files share a key, so four files occupy three keys.
+	sameKey := []string{}
+	for i := 0; len(sameKey) < 2; i++ {
+		fileName := fmt.Sprintf("file-%d.txt", i)
+		if hsh(fileName) == hsh("file-0.txt") {
+			sameKey = append(sameKey, fileName)
+		}
+	}
+	fileNames := append(sameKey, nameWithKey((hsh(sameKey[0])+1)%int(ringCapacity)), nameWithKey((hsh(sameKey[0])+2)%int(ringCapacity)))
+	for _, fileName := range fileNames {
+		for _, p := range ring {
+			if p.route(hsh(fileName)) == p.address {
+				p.put(fileName, "contents")
+			}
+		}
+	}
+	output := captureOutput(t, func() { describeRing(ring[0].address) })
+	for _, want := range []string{"Ring:", fmt.Sprintf("Capacity: %d", ringCapacity), "Nodes: 3", "Files: 4", "Occupied keys: 3", "Load factor: 1.33 files per node"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output misses %q:\n%s", want, output)
+		}
+	}
+	// Cut the ring after the second peer, whose successor now points back at itself.
+	ring[1].mutex.Lock()
+	ring[1].successor = ring[1].address
+	ring[1].mutex.Unlock()
+	output = captureOutput(t, func() { describeRing(ring[0].address) })
+	if !strings.Contains(output, "The ring is partitioned") || !strings.Contains(output, "Partition 2:") {
+		t.Errorf("partition not reported:\n%s", output)
+	}
+}
+
+func TestRetrieveIntoAnUncreatableFileFailsCleanly(t *testing.T) {
+	t.Chdir(t.TempDir())
+	p := startMemoryRing(t, 1)[0]
+	p.put("a.txt", "contents")
+	// A regular file stands where the directory of the local file should be.
+	os.WriteFile("blocked", nil, 0644)
+	err := retrieveContents("a.txt", p.address, filepath.Join("blocked", "a.txt"))
+	if err == nil || !strings.Contains(err.Error(), "could not create the local file") {
+		t.Fatalf("err = %v, want the local file error", err)
+	}
+	if errors.Is(err, ErrNetwork) {
+		t.Errorf("err = %v, the local error is reported as a network one", err)
+	}
+	if p.retrieves != 1 {
+		t.Errorf("retrieves = %d, want no retries", p.retrieves)
+	}
+}
+
+func TestRenameMovesTheFileToTheNewOwner(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ring := startMemoryRing(t, 2)
+	oldName := nameWithKey(hsh(ring[0].address))
+	newName := nameWithKey(hsh(ring[1].address))
+	// Another name with the same key as the new one.
+	sameOwnerName := ""
+	for i := 0; sameOwnerName == ""; i++ {
+		fileName := fmt.Sprintf("other-%d.txt", i)
+		if hsh(fileName) == hsh(newName) {
+			sameOwnerName = fileName
+		}
+	}
+	ring[0].put(oldName, "contents")
+	// Across owners.
+	if err := renameFile(oldName, newName, ring[0].address); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ring[0].get(oldName); ok {
+		t.Errorf("%s is still stored", oldName)
+	}
+	if contents, ok := ring[1].get(newName); !ok || contents != "contents" {
+		t.Errorf("new owner has %q, %v", contents, ok)
+	}
+	if err := retrieveFile(oldName, ring[0].address); !errors.Is(err, ErrNotFound) {
+		t.Errorf("retrieve of %s: err = %v, want ErrNotFound", oldName, err)
+	}
+	if err := retrieveFile(newName, ring[0].address); err != nil {
+		t.Errorf("retrieve of %s: %v", newName, err)
+	}
+	// Both names owned by the same peer.
+	if err := renameFile(newName, sameOwnerName, ring[0].address); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ring[1].get(newName); ok {
+		t.Errorf("%s is still stored", newName)
+	}
+	if contents, ok := ring[1].get(sameOwnerName); !ok || contents != "contents" {
+		t.Errorf("owner has %q, %v", contents, ok)
+	}
+}
+
+func TestBlobRoundTrip(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ring := startMemoryRing(t, 3)
+	os.WriteFile("blob.bin", []byte("blob contents"), 0644)
+	key, err := putBlob("blob.bin", ring[0].address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != checksumOf("blob contents") {
+		t.Errorf("key = %s, want the checksum of the contents", key)
+	}
+	// Get it back through another peer.
+	err = getBlob(key, "copy.bin", ring[2].address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := os.ReadFile("copy.bin"); string(contents) != "blob contents" {
+		t.Errorf("copy = %q", contents)
+	}
+}
+
+func TestBulkOperationsRefuseAMismatchingRing(t *testing.T) {
+	t.Chdir(t.TempDir())
+	p := startMemoryRing(t, 1)[0]
+	p.mutex.Lock()
+	p.capacity = 2 * ringCapacity
+	p.mutex.Unlock()
+	os.Mkdir("dir", 0755)
+	os.WriteFile(filepath.Join("dir", "a.txt"), []byte("contents"), 0644)
+	stored, _, err := storeDirectory("dir", p.address)
+	if err == nil || !strings.Contains(err.Error(), "capacity") {
+		t.Errorf("err = %v, want the capacity mismatch", err)
+	}
+	if stored != 0 {
+		t.Errorf("stored %d files", stored)
+	}
+	// The importer refuses to start, too.
+	archive, err := os.Create("backup.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(archive)
+	tw.WriteHeader(&tar.Header{Name: "b.txt", Mode: 0644, Size: 8})
+	tw.Write([]byte("contents"))
+	tw.Close()
+	archive.Close()
+	output := captureOutput(t, func() { importFiles("backup.tar", p.address) })
+	if !strings.Contains(output, "Not importing") {
+		t.Errorf("output = %q, want the import refused", output)
+	}
+	for _, fileName := range []string{"a.txt", "b.txt"} {
+		if _, ok := p.get(fileName); ok {
+			t.Errorf("%s was stored", fileName)
+		}
+	}
+}
+
+func TestRetrieveFilesOfOneOwnerOverOneConnection(t *testing.T) {
+	t.Chdir(t.TempDir())
+	p := startMemoryRing(t, 1)[0]
+	fileNames := []string{"a.txt", "b.txt", "c.txt"}
+	for _, fileName := range fileNames {
+		p.put(fileName, "contents of "+fileName)
+	}
+	errs := retrieveFiles(fileNames, p.address)
+	if len(errs) != 0 {
+		t.Fatalf("errors = %v", errs)
+	}
+	for _, fileName := range fileNames {
+		if contents, _ := os.ReadFile(fileName); string(contents) != "contents of "+fileName {
+			t.Errorf("%s = %q", fileName, contents)
+		}
+	}
+	if p.retrieves != 3 || p.retrieveConns != 1 {
+		t.Errorf("%d retrieves over %d connections, want 3 over 1", p.retrieves, p.retrieveConns)
+	}
+}
+
+func TestTraceFollowsTheNextHops(t *testing.T) {
+	peers := startMemoryRing(t, 4)
+	for _, p := range peers {
+		p.iterative = true
+	}
+	// The key of the last peer is owned by it, so the trace from the first peer
+	// passes through the second and the third.
+	key := hsh(peers[3].address)
+	output := captureOutput(t, func() { traceKey(key, peers[0].address) })
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("trace has %d hops:\n%s", len(lines), output)
+	}
+	for i, p := range peers {
+		if !strings.HasPrefix(lines[i], fmt.Sprintf("%d) %s (%d)", i+1, p.address, hsh(p.address))) {
+			t.Errorf("hop %d is %q, want %s", i+1, lines[i], p.address)
+		}
+	}
+	// The first peer passes the lookup on past its successor.
+	nextID := hsh(peers[1].address)
+	if !strings.HasSuffix(lines[0], fmt.Sprintf("narrows to (%d, %d]", nextID, key)) {
+		t.Errorf("first hop does not narrow the search: %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[2], "names the owner") || !strings.HasSuffix(lines[3], "=> owner") {
+		t.Errorf("trace does not end at the owner:\n%s", output)
+	}
+}
+
+func TestStoreAndRetrieveOverAUnixSocket(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ls, err := net.Listen("unix", filepath.Join(t.TempDir(), "peer.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ls.Close() })
+	address := "unix:" + ls.Addr().String()
+	p := &memoryPeer{address: address, predecessor: "NONE", successor: "NONE", files: make(map[string][]byte)}
+	p.route = func(id int) string { return address }
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	os.WriteFile("a.txt", []byte("contents"), 0644)
+	if err := storeFile("a.txt", 0, address); err != nil {
+		t.Fatal(err)
+	}
+	if contents, ok := p.get("a.txt"); !ok || contents != "contents" {
+		t.Fatalf("peer has %q", contents)
+	}
+	os.Remove("a.txt")
+	if err := retrieveFile("a.txt", address); err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := os.ReadFile("a.txt"); string(contents) != "contents" {
+		t.Errorf("a.txt = %q", contents)
+	}
+}
+
+func TestCompareKeysReportsAKeyClaimedByBoth(t *testing.T) {
+	peers := startMemoryRing(t, 2)
+	peers[0].put("a.txt", "contents")
+	peers[1].put("b.txt", "contents")
+	output := captureOutput(t, func() { compareKeys(peers[0].address, peers[1].address) })
+	if !strings.Contains(output, "No keys are claimed by both peers.") {
+		t.Errorf("healthy peers: %q", output)
+	}
+	// Storing a.txt directly on the other peer, which does not own it, creates an overlap.
+	peers[1].put("a.txt", "contents")
+	output = captureOutput(t, func() { compareKeys(peers[0].address, peers[1].address) })
+	if !strings.Contains(output, fmt.Sprintf("Key %d is claimed by both", hsh("a.txt"))) {
+		t.Errorf("overlap is not reported: %q", output)
+	}
+}
+
+func TestStoreDirectoryReportsTheRejectedFiles(t *testing.T) {
+	peers := startMemoryRing(t, 1)
+	peers[0].maxFileSize = 10
+	dirPath := t.TempDir()
+	os.WriteFile(filepath.Join(dirPath, "a.txt"), []byte("small"), 0644)
+	os.WriteFile(filepath.Join(dirPath, "b.txt"), []byte("too large to store"), 0644)
+	os.WriteFile(filepath.Join(dirPath, "c.txt"), []byte("small"), 0644)
+	oldContinueOnError := *continueOnError
+	t.Cleanup(func() { *continueOnError = oldContinueOnError })
+	// The files after the rejected one are still stored, and the failure is reported.
+	*continueOnError = true
+	var stored int
+	var failures map[string]error
+	var err error
+	captureOutput(t, func() { stored, failures, err = storeDirectory(dirPath, peers[0].address) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != 2 || len(failures) != 1 || failures["b.txt"] == nil {
+		t.Errorf("stored = %d, failures = %v", stored, failures)
+	}
+	if _, ok := peers[0].get("c.txt"); !ok {
+		t.Error("c.txt was not stored")
+	}
+	// Otherwise, the store stops at the rejected file.
+	*continueOnError = false
+	peers[0].mutex.Lock()
+	peers[0].files = make(map[string][]byte)
+	peers[0].mutex.Unlock()
+	captureOutput(t, func() { stored, failures, err = storeDirectory(dirPath, peers[0].address) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 || len(failures) != 1 || failures["b.txt"] == nil {
+		t.Errorf("stored = %d, failures = %v", stored, failures)
+	}
+	if _, ok := peers[0].get("c.txt"); ok {
+		t.Error("c.txt was stored after the failure")
+	}
+}
+
+func TestConnectingToAClosedPortFailsCleanly(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ls.Addr().String()
+	ls.Close()
+	oldConnectTimeout := *connectTimeout
+	t.Cleanup(func() { *connectTimeout = oldConnectTimeout })
+	*connectTimeout = 500 * time.Millisecond
+	start := time.Now()
+	_, _, err = connectToPeer(address)
+	if elapsed := time.Since(start); elapsed > 2**connectTimeout {
+		t.Errorf("connecting took %v", elapsed)
+	}
+	if !errors.Is(err, ErrNetwork) || !strings.Contains(err.Error(), "could not connect to "+address+": ") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestCachedRingOwnersMatchTheRing(t *testing.T) {
+	peers := startMemoryRing(t, 4)
+	oldRingCacheTTL := *ringCacheTTL
+	t.Cleanup(func() {
+		*ringCacheTTL = oldRingCacheTTL
+		invalidateRing()
+	})
+	*ringCacheTTL = time.Minute
+	invalidateRing()
+	for key := 0; key < int(ringCapacity); key++ {
+		ownerAddr, err := cachedOwner(key, peers[0].address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer, err := askForSuccesor(key, peers[0].address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.TrimSpace(answer); ownerAddr != want {
+			t.Errorf("key %d: cached owner = %s, want %s", key, ownerAddr, want)
+		}
+	}
+}
+
+func TestLatenciesListTheDownPeersLast(t *testing.T) {
+	peers := startMemoryRing(t, 3)
+	peers[2].listener.Close()
+	output := captureOutput(t, func() { printLatencies(peers[0].address) })
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("output:\n%s", output)
+	}
+	// The walk stops at the peer that is down.
+	if !strings.HasPrefix(lines[0], "Could not walk the whole ring:") {
+		t.Errorf("the failed walk is not reported: %q", lines[0])
+	}
+	for _, line := range lines[1:3] {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[2] != "us" || (fields[0] != peers[0].address && fields[0] != peers[1].address) {
+			t.Errorf("live peer line = %q", line)
+		}
+	}
+	if fields := strings.Fields(lines[3]); len(fields) != 2 || fields[0] != peers[2].address || fields[1] != "down" {
+		t.Errorf("down peer line = %q", lines[3])
+	}
+}
+
+func TestListKeysFiltersByGlob(t *testing.T) {
+	peers := startMemoryRing(t, 3)
+	oldEntryAddr := entryAddr
+	t.Cleanup(func() { entryAddr = oldEntryAddr })
+	entryAddr = peers[0].address
+	owners := make(map[string]*memoryPeer)
+	for _, fileName := range []string{"a.txt", "b.txt", "notes.md", "a1.log", "b22.log", "c.txt"} {
+		owner := peers[hsh(fileName)%len(peers)]
+		owner.put(fileName, "contents of "+fileName)
+		owners[fileName] = owner
+	}
+	for pattern, want := range map[string][]string{
+		"*.txt":    {"a.txt", "b.txt", "c.txt"},
+		"?.txt":    {"a.txt", "b.txt", "c.txt"},
+		"[ab]*":    {"a.txt", "b.txt", "a1.log", "b22.log"},
+		"[a-b]?.*": {"a1.log"},
+		"*.md":     {"notes.md"},
+		"*.exe":    {},
+	} {
+		matches, err := ListKeys(pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", pattern, err)
+		}
+		got := []string{}
+		for _, match := range matches {
+			got = append(got, match.Name)
+			contents := "contents of " + match.Name
+			sum := sha256.Sum256([]byte(contents))
+			if match.Owner != owners[match.Name].address || match.Size != int64(len(contents)) || match.Sum != hex.EncodeToString(sum[:]) {
+				t.Errorf("%s: %+v", match.Name, match)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: matches = %v, want %v", pattern, got, want)
+		}
+	}
+	if _, err := ListKeys("[a"); err == nil {
+		t.Error("a malformed pattern was accepted")
+	}
+}
+
+func TestForgetRemovesEveryCopy(t *testing.T) {
+	peers := startMemoryRing(t, 3)
+	// a.txt was pushed to another peer besides its owner.
+	peers[0].put("a.txt", "contents")
+	peers[2].put("a.txt", "contents")
+	peers[1].put("b.txt", "contents")
+	removedFrom, err := forgetFile("a.txt", peers[0].address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(removedFrom)
+	want := []string{peers[0].address, peers[2].address}
+	sort.Strings(want)
+	if strings.Join(removedFrom, " ") != strings.Join(want, " ") {
+		t.Errorf("removed from %v, want %v", removedFrom, want)
+	}
+	for _, p := range peers {
+		if _, ok := p.get("a.txt"); ok {
+			t.Errorf("a.txt is still on %s", p.address)
+		}
+	}
+	if _, ok := peers[1].get("b.txt"); !ok {
+		t.Error("b.txt was removed")
+	}
+	// A peer that can not be reached may still hold a copy, which is an error.
+	peers[2].put("a.txt", "contents")
+	peers[1].listener.Close()
+	removedFrom, err = forgetFile("a.txt", peers[2].address)
+	if err == nil {
+		t.Errorf("forgot with a peer down, removed from %v", removedFrom)
+	}
+}
+
+func TestCheckFilesFlagsTheCorruptedBlob(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ring := startMemoryRing(t, 3)
+	keys := []string{}
+	for i := 0; i < 4; i++ {
+		os.WriteFile("blob.bin", []byte(fmt.Sprintf("blob %d", i)), 0644)
+		key, err := putBlob("blob.bin", ring[0].address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// The contents of one blob rot on its owner.
+	corrupted := keys[2]
+	for _, p := range ring {
+		if _, ok := p.get(corrupted); ok {
+			p.put(corrupted, "rotten")
+		}
+	}
+	// Only a full check retrieves the contents.
+	if problems := checkFiles(keys, false, ring[0].address); len(problems) > 0 {
+		t.Errorf("quick check: problems = %v", problems)
+	}
+	problems := checkFiles(keys, true, ring[0].address)
+	if len(problems) != 1 || !errors.Is(problems[corrupted], ErrChecksum) {
+		t.Errorf("full check: problems = %v, want %s corrupted", problems, corrupted)
+	}
+}
+
+func TestHashCommandPrintsTheKeys(t *testing.T) {
+	inputs := []string{"a.txt", "127.0.0.1:5000", "with space", ""}
+	oldHashSeed, oldStdin := *hashSeed, os.Stdin
+	t.Cleanup(func() { *hashSeed, os.Stdin = oldHashSeed, oldStdin })
+	for _, seed := range []string{"", "ring-2"} {
+		*hashSeed = seed
+		want := ""
+		for _, input := range inputs {
+			want += fmt.Sprintf("%d\n", hsh(input))
+		}
+		if output := captureOutput(t, func() { printKeys(inputs) }); output != want {
+			t.Errorf("seed %q: arguments: output = %q, want %q", seed, output, want)
+		}
+		// The same strings, one per line on the standard input.
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(strings.Join(inputs, "\n") + "\n"))
+		w.Close()
+		os.Stdin = r
+		if output := captureOutput(t, func() { printKeys(nil) }); output != want {
+			t.Errorf("seed %q: stdin: output = %q, want %q", seed, output, want)
+		}
+		r.Close()
+	}
+}
+
+func TestWatchReportsTheChanges(t *testing.T) {
+	ring := startMemoryRing(t, 3)
+	fileName := nameWithKey(hsh(ring[1].address))
+	store := func(contents string) {
+		err := storeContents(fileName, int64(len(contents)), strings.NewReader(contents), 0, "", ring[0].address)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store("first version")
+	stop := make(chan struct{})
+	output := captureOutput(t, func() {
+		done := make(chan struct{})
+		go func() {
+			watchFile(fileName, 10*time.Millisecond, ring[2].address, stop)
+			close(done)
+		}()
+		// Another client updates the file, then deletes it.
+		time.Sleep(100 * time.Millisecond)
+		store("second version")
+		time.Sleep(100 * time.Millisecond)
+		if err := deleteFile(fileName, ring[0].address); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		close(stop)
+		<-done
+	})
+	for _, event := range []string{fileName + " exists (13 bytes", fileName + " was changed (14 bytes)", fileName + " was deleted"} {
+		if !strings.Contains(output, event) {
+			t.Errorf("the watcher did not report %q:\n%s", event, output)
+		}
+	}
+}
+
+func TestRepairPredecessorsRestoresTheRing(t *testing.T) {
+	ring := startMemoryRing(t, 5)
+	// Lost updates leave some predecessors at departed or wrong nodes.
+	ring[0].predecessor = "127.0.0.1:1"
+	ring[2].predecessor = ring[0].address
+	ring[3].predecessor = "NONE"
+	repaired, err := repairPredecessors(ring[1].address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(repaired)
+	want := []string{ring[0].address, ring[2].address, ring[3].address}
+	sort.Strings(want)
+	if fmt.Sprint(repaired) != fmt.Sprint(want) {
+		t.Errorf("repaired = %v, want %v", repaired, want)
+	}
+	for i, p := range ring {
+		if wantPred := ring[(i+len(ring)-1)%len(ring)].address; p.predecessor != wantPred {
+			t.Errorf("the predecessor of %s is %s, want %s", p.address, p.predecessor, wantPred)
+		}
+	}
+	if violations := checkRingInvariants(ring[0].address); len(violations) != 0 {
+		t.Errorf("violations after the repair: %v", violations)
+	}
+	// A consistent ring is left as is.
+	if repaired, err := repairPredecessors(ring[4].address); err != nil || len(repaired) != 0 {
+		t.Errorf("second repair = %v, %v, want nothing to repair", repaired, err)
+	}
+}
+
+func TestStoreOnARingThatStoresNothingFailsWithNoOwner(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.WriteFile("a.txt", []byte("contents"), 0644)
+	ring := startMemoryRing(t, 3)
+	for _, p := range ring {
+		p.noStore = true
+	}
+	err := storeFile("a.txt", 0, ring[0].address)
+	if !errors.Is(err, ErrNoOwner) {
+		t.Errorf("err = %v, want ErrNoOwner", err)
+	}
+	for _, p := range ring {
+		if _, ok := p.get("a.txt"); ok {
+			t.Errorf("a.txt was stored on %s", p.address)
+		}
+	}
+}
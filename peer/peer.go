@@ -1,17 +1,30 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"log"
+	"math/bits"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type node struct {
@@ -34,41 +47,384 @@ var mainMenu = `
 4) Display pred-id, my-id, and succ-id
 5) Display the stored filenames and their keys
 6) Display my address
-7) Exit`
+7) Exit
+8) Pause the node
+9) Resume the node
+10) Rebuild the file index from disk`
 
-var hasher = fnv.New32a()
 var ringCapacity uint32 = 127
 
+// The name of the hash function used for the ids & keys, and the version of the
+// protocol between the peers & clients. Reported in PARAMS replies.
+const hashAlgorithm = "fnv32a"
+const protocolVersion = 1
+
+// The seed mixed into the hash of the ids & keys, so that separate rings can have
+// independent key layouts. All peers & clients of a ring must use the same seed.
+var hashSeed = flag.String("hashseed", "", "seed mixed into the hash of the ids & keys, must be the same on every peer of the ring")
+
 // Information about self.
 var self = newNode()
 
+// When set, new connections are rejected, e.g. during maintenance. Only the requests
+// to inspect & resume the node are still handled.
+var paused atomic.Bool
+
+// The number of the requests being handled, and the slots that cap it (nil if there
+// is no cap).
+var activeHandlers atomic.Int64
+var handlerSlots chan struct{}
+
+// How long a new connection waits for a free handler before it is rejected.
+const handlerWait = time.Second
+
+// Reserves a handler for a new connection. Returns false if the handlers are capped
+// and none becomes free in time.
+func acquireHandler() bool {
+	if handlerSlots != nil {
+		select {
+		case handlerSlots <- struct{}{}:
+		case <-time.After(handlerWait):
+			return false
+		}
+	}
+	activeHandlers.Add(1)
+	return true
+}
+
+// Frees the handler reserved by acquireHandler. It is counted as active until its
+// slot is freed.
+func releaseHandler() {
+	if handlerSlots != nil {
+		<-handlerSlots
+	}
+	activeHandlers.Add(-1)
+}
+
+// The slots that cap the transfers copying at once (nil if there is no cap).
+var transferSlots chan struct{}
+
+// The size of the chunks after which a transfer gives its slot to the next waiting one.
+const transferChunkSize = 1 << 20
+
+// Waits for a free transfer slot. The waiting transfers get the slots in order.
+func acquireTransfer() {
+	if transferSlots != nil {
+		transferSlots <- struct{}{}
+	}
+}
+
+// Frees the transfer slot reserved by acquireTransfer.
+func releaseTransfer() {
+	if transferSlots != nil {
+		<-transferSlots
+	}
+}
+
+// Copies the given number of bytes (or until EOF if negative) from the source to the
+// destination, and counts them towards the given transfer. Each chunk is copied in a
+// transfer slot, so that a large transfer takes turns with the others instead of
+// holding its slot until it ends.
+func copyChunked(dst io.Writer, src io.Reader, n int64, t *transfer) (int64, error) {
+	var written int64
+	for n < 0 || written < n {
+		size := int64(transferChunkSize)
+		if n >= 0 && n-written < size {
+			size = n - written
+		}
+		acquireTransfer()
+		copied, err := io.CopyN(dst, src, size)
+		releaseTransfer()
+		written += copied
+		t.done.Add(copied)
+		if err == io.EOF && n < 0 {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
 // CW neighbor.
 var successor = newNode()
 
 // CCW neighbor.
 var predecessor = newNode()
 
-// The map of stored files' names to their keys.
-var storedFiles = make(map[string]int)
+// Information about a stored file.
+type storedFile struct {
+	Key int
+	// The time after which the file is removed. Zero if the file never expires.
+	Expiry time.Time
+	// Pinned files are never removed automatically, regardless of their expiry.
+	Pinned bool
+	// The SHA-256 checksum of the contents when they were stored. Empty if it is not
+	// known yet, e.g. for a file found on disk without an index.
+	Sum string
+	// Set by the scrubber once the contents no longer match the checksum.
+	Corrupt bool
+}
+
+// Checks whether the file has passed its expiry.
+func (f storedFile) expired() bool {
+	return !f.Pinned && !f.Expiry.IsZero() && time.Now().After(f.Expiry)
+}
+
+// The map of stored files' names to their information.
+var storedFiles = make(map[string]storedFile)
 var storedFilesMutex sync.Mutex
 
+// The access counts of a stored file since this peer started.
+type accessStat struct {
+	Reads      int64
+	Writes     int64
+	LastAccess time.Time
+}
+
+// The access counts of the files by their names. They are kept in memory only.
+var accessStats = make(map[string]*accessStat)
+var accessStatsMutex sync.Mutex
+
+// Counts a read or a write of the given file.
+func recordAccess(fileName string, write bool) {
+	accessStatsMutex.Lock()
+	defer accessStatsMutex.Unlock()
+	stat, ok := accessStats[fileName]
+	if !ok {
+		stat = &accessStat{}
+		accessStats[fileName] = stat
+	}
+	if write {
+		stat.Writes++
+	} else {
+		stat.Reads++
+	}
+	stat.LastAccess = time.Now()
+}
+
+// The files kept from before this peer joined the ring, which are not served until the
+// cooldown ends, unless they are stored again. Guarded by the stored files mutex.
+var heldFiles = make(map[string]bool)
+var heldUntil time.Time
+
+// Checks whether the given file is held back. Must be called while holding the stored
+// files mutex.
+func fileHeld(fileName string) bool {
+	return heldFiles[fileName] && time.Now().Before(heldUntil)
+}
+
+// The cache of the retrieved files, created once the flags are parsed.
+var readCache *fileCache
+
+var unixPath = flag.String("unix", "", "listen on the Unix domain socket at the given path instead of the port, and use unix:<path> as the address")
+var advertiseAddr = flag.String("advertise", "", "host:port that other peers use to reach this peer (default: own IP and the listen port)")
+var cacheSize = flag.Int64("cachesize", 0, "size of the in-memory cache of the retrieved files in bytes (0 disables the cache)")
+var statePath = flag.String("state", "", "file to remember this peer's address across restarts (disabled if empty)")
+var rekey = flag.Bool("rekey", false, "move the files of the previous ID under the new one if the address has changed")
+var controlTimeout = flag.Duration("controltimeout", 30*time.Second, "timeout for sending & receiving requests and responses")
+var joinTimeout = flag.Duration("jointimeout", 10*time.Minute, "how long a join waits for the files of the new peer to be moved to it")
+var stallTimeout = flag.Duration("stalltimeout", time.Minute, "timeout for a file transfer that makes no progress")
+var zeroCopy = flag.Bool("zerocopy", true, "send files with zero-copy where the platform supports it")
+var maxRequestLength = flag.Int("maxrequest", 8192, "maximum length of a request line in bytes")
+var connRequests = flag.Int("connrequests", 0, "maximum number of requests on a single connection, after which it is closed (0 for no limit)")
+var connRate = flag.Int("connrate", 0, "maximum number of requests per second on a single connection, after which it is closed (0 for no limit)")
+var breakerFailures = flag.Int("breakerfailures", 3, "consecutive connection failures after which a peer address fails fast")
+var breakerCooldown = flag.Duration("breakercooldown", 10*time.Second, "how long a peer address fails fast before it is tried again")
+var allowedExtensions = flag.String("allowext", "", "comma separated extensions that can be stored, \".\" for no extension (default: all)")
+var deniedExtensions = flag.String("denyext", "", "comma separated extensions that can not be stored, \".\" for no extension")
+var slowRequestThreshold = flag.Duration("slowrequest", 0, "log the requests that take longer than this (0 disables)")
+var gossipInterval = flag.Duration("gossip", 0, "interval between the exchanges of known peer addresses with another peer (0 disables)")
+var maxHops = flag.Int("maxhops", defaultMaxHops(ringCapacity), "number of hops after which a lookup is dropped (raise it for rings of more peers, as the lookups follow the successors)")
+var warnHops = flag.Int("warnhops", 0, "number of hops after which a lookup is logged as slow (default: 3/4 of maxhops)")
+var maxTransfers = flag.Int("maxtransfers", 0, "maximum number of file transfers copying at once, the rest take turns chunk by chunk (0 for no limit)")
+var maxHandlers = flag.Int("maxhandlers", 0, "maximum number of requests handled at once (0 for no limit)")
+var keepData = flag.Bool("keepdata", false, "keep the files of a lone peer on exit and index them again on the next start (otherwise they are removed)")
+var reclaimCooldown = flag.Duration("reclaimcooldown", 10*time.Second, "after joining a ring with the files of a previous run, how long they are held back so that their newer versions can arrive from the other peers")
+var indexFlush = flag.Duration("indexflush", 0, "with -keepdata, interval between the snapshots of the file index, whose changes in between are logged to survive a crash (0 disables)")
+var indexBatch = flag.Int("indexbatch", 100, "number of logged file index changes after which the index is snapshotted early")
+var dirMode = fileMode(0755)
+var storedFileMode = fileMode(0644)
+var lookupMode = flag.String("lookup", "recursive", "how to answer successor requests: recursive (forward them) or iterative (reply with the next hop)")
+
+// When set, the stores of files that this peer does not own are rejected, instead of
+// being stored wherever they are sent, e.g. by a client in direct mode.
+var assertOwner = flag.Bool("assertowner", false, "reject the stores of files whose keys this peer does not own")
+
+var noStore = flag.Bool("nostore", false, "only route the lookups to the ring through the initiator, without taking over a key range or storing any files (proxy mode)")
+
+// The peer of the ring through which the lookups are routed in nostore mode. Empty
+// until the node is attached to a ring. A node in nostore mode stays out of the ring,
+// so that its key range does not turn into a hole that no one stores.
+var proxyEntry string
+
+// The idempotency tokens of the recently completed stores, mapped to their completion time.
+var recentTokens = make(map[string]time.Time)
+var recentTokensMutex sync.Mutex
+
+var tokenTTL = flag.Duration("tokenttl", 10*time.Minute, "how long the tokens of the completed stores are remembered")
+var sweepInterval = flag.Duration("sweep", 10*time.Second, "interval between the removals of the expired files")
+var scrubInterval = flag.Duration("scrub", 0, "interval between the checks of the stored files against their checksums (0 disables)")
+var scrubRate = flag.Int64("scrubrate", 0, "maximum number of bytes per second read by the checks of the stored files (0 for no limit)")
+
+// An in-memory LRU cache of the contents of the recently retrieved files.
+type fileCache struct {
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	// Incremented with each invalidation, see put.
+	gen int
+	// The cached files, the most recently used one at the front.
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// A single file in the cache.
+type cacheEntry struct {
+	fileName string
+	contents []byte
+}
+
+// Creates an empty cache that can hold up to the given number of bytes.
+func newFileCache(capacity int64) *fileCache {
+	return &fileCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Returns the cached contents of the given file, if any.
+func (c *fileCache) get(fileName string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[fileName]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).contents, true
+}
+
+// Returns the current generation of the cache. It should be acquired before reading
+// a file from the disk and passed to put along with the contents.
+func (c *fileCache) generation() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.gen
+}
+
+// Caches the contents of the given file, evicting the least recently used files if
+// needed. If there has been an invalidation since the given generation, the contents
+// might be stale and are not cached.
+func (c *fileCache) put(fileName string, contents []byte, gen int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if gen != c.gen || int64(len(contents)) > c.capacity {
+		return
+	}
+	c.remove(fileName)
+	for c.size+int64(len(contents)) > c.capacity {
+		c.remove(c.order.Back().Value.(*cacheEntry).fileName)
+	}
+	c.entries[fileName] = c.order.PushFront(&cacheEntry{fileName: fileName, contents: contents})
+	c.size += int64(len(contents))
+}
+
+// Removes the given file from the cache. Should be called whenever the file changes.
+func (c *fileCache) invalidate(fileName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.gen++
+	c.remove(fileName)
+}
+
+// Removes the given file from the cache. The caller must hold the mutex.
+func (c *fileCache) remove(fileName string) {
+	element, ok := c.entries[fileName]
+	if !ok {
+		return
+	}
+	c.order.Remove(element)
+	delete(c.entries, fileName)
+	c.size -= int64(len(element.Value.(*cacheEntry).contents))
+}
+
+// Returns the address of the given node, or NONE if it is a `nil` node.
+func nodeAddress(n node) string {
+	if n.ID == -1 {
+		return "NONE"
+	}
+	return n.Address
+}
+
 // Finds the IP (v4) of this peer.
 // Taken from https://stackoverflow.com/questions/23558425/how-do-i-get-the-local-ip-address-in-go
 func getSelfIP() string {
 	host, _ := os.Hostname()
 	addrs, _ := net.LookupIP(host)
 	for _, addr := range addrs {
-		if ipv4 := addr.To4(); ipv4 != nil {
+		if ipv4 := addr.To4(); ipv4 != nil && !ipv4.IsUnspecified() {
+			return ipv4.String()
+		}
+	}
+	// The host name does not resolve, so fall back to the addresses of the interfaces.
+	interfaceAddrs, _ := net.InterfaceAddrs()
+	for _, addr := range interfaceAddrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if ipv4 := ipNet.IP.To4(); ipv4 != nil {
 			return ipv4.String()
 		}
 	}
 	return ""
 }
 
+// Checks whether the given host can not be dialed by the other peers, i.e. it is
+// empty or a wildcard such as 0.0.0.0 or ::.
+func unroutableHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || (ip != nil && ip.IsUnspecified())
+}
+
+// A file mode flag, given and shown in octal.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *fileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return errors.New("not an octal permission mode")
+	}
+	*m = fileMode(mode)
+	return nil
+}
+
+func init() {
+	flag.Var(&dirMode, "dirmode", "permissions of the peer directory, in octal")
+	flag.Var(&storedFileMode, "filemode", "permissions of the stored files, in octal")
+}
+
+// The prefix of the temporary files that the files are received into.
+const tempFilePrefix = ".incoming-"
+
 // Returns the full file path of the given file on the peer.
 func filePath(fileName string) string {
 	folder := fmt.Sprintf("%d", self.ID)
-	os.Mkdir(folder, 0777)
+	err := os.Mkdir(folder, os.FileMode(dirMode))
+	if err == nil {
+		// Set the permissions regardless of the umask.
+		err = os.Chmod(folder, os.FileMode(dirMode))
+	}
+	if err != nil && !os.IsExist(err) {
+		log.Println("Could not create the peer directory:", err)
+	}
 	return filepath.Join(folder, fileName)
 }
 
@@ -87,12 +443,27 @@ func between(low int, n int, high int) bool {
 	return (n > low && n < high)
 }
 
+// Checks whether the node with the given id & address owns the given key, given the id
+// & address of its predecessor, i.e. whether the key is in (predecessor, node]. On a
+// small ring, neighbors can hash to the same id. Ties are broken by the addresses: of
+// the nodes with the same id, the one with the lowest address owns the keys up to the
+// id, and the others own none.
+func ownsKey(predID int, predAddr string, nodeID int, nodeAddr string, key int) bool {
+	if predID == nodeID {
+		// A predecessor that sorts after the node can only be the wrap around of a ring
+		// in which all nodes share the same id.
+		return predAddr >= nodeAddr
+	}
+	return between(predID, key, nodeID) || key == nodeID
+}
+
 // Returns the id of a node (given its full address) or key of a file (given its name).
 func hsh(in string) int {
+	// A hasher per call, as the ids & keys are hashed from many goroutines at once.
+	hasher := fnv.New32a()
+	hasher.Write([]byte(*hashSeed))
 	hasher.Write([]byte(in))
-	digest := hasher.Sum32()
-	hasher.Reset()
-	return int(digest % ringCapacity)
+	return int(hasher.Sum32() % ringCapacity)
 }
 
 // "<prefix> <msg>\n" => "<prefix>", "<msg>"
@@ -114,48 +485,460 @@ func extractServerResponse(resp string) (string, string) {
 	return prefix, msg
 }
 
-// Connects to the peer at the given address.
-func connectToPeer(address string) (net.Conn, *bufio.Reader) {
+// The prefix of the peer addresses that are Unix domain sockets.
+const unixPrefix = "unix:"
+
+// Returns the network and the address to dial for the given peer address.
+func splitNetwork(address string) (string, string) {
+	if strings.HasPrefix(address, unixPrefix) {
+		return "unix", strings.TrimPrefix(address, unixPrefix)
+	}
+	return "tcp", address
+}
+
+// Connects to the peer at the given address, or returns an error if the peer can not
+// be reached. Fails fast while the breaker of the address is open.
+func dialPeer(address string) (net.Conn, *bufio.Reader, error) {
 	address = strings.TrimSpace(address)
-	conn, err := net.Dial("tcp", address)
+	err := checkBreaker(address)
 	if err != nil {
-		log.Println("Could not connect to the peer.")
-		log.Fatalln(err)
+		return nil, nil, err
+	}
+	return dialNeighbor(address)
+}
+
+// Connects to the peer at the given address like dialPeer, but regardless of its
+// breaker. The updates of the ring pointers go through this, as a lost update would
+// break the ring even though the peer may be back already.
+func dialNeighbor(address string) (net.Conn, *bufio.Reader, error) {
+	address = strings.TrimSpace(address)
+	network, dialAddr := splitNetwork(address)
+	tcpConn, err := net.Dial(network, dialAddr)
+	recordDial(address, err)
+	if err != nil {
+		return nil, nil, err
 	}
+	conn := &deadlineConn{Conn: tcpConn, timeout: *controlTimeout}
 	// Create a buffered reader.
 	reader := bufio.NewReader(conn)
-	return conn, reader
+	return conn, reader, nil
+}
+
+var errBreakerOpen = errors.New("the peer is unreachable, not retrying until the cooldown ends")
+
+// Consecutive connection failures to a peer address. Once there are enough of them,
+// the connections to the address fail fast until the cooldown ends.
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+var breakers = make(map[string]*breaker)
+var breakersMutex sync.Mutex
+
+// Returns errBreakerOpen if the connections to the given address should fail fast.
+// Once the cooldown ends, lets a single trial connection through and fails the others
+// fast until the trial's result is recorded.
+func checkBreaker(address string) error {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	b, ok := breakers[address]
+	if !ok || b.failures < *breakerFailures {
+		return nil
+	}
+	if time.Now().Before(b.openUntil) {
+		return errBreakerOpen
+	}
+	b.openUntil = time.Now().Add(*breakerCooldown)
+	return nil
+}
+
+// Records the result of a connection attempt to the given address.
+func recordDial(address string, err error) {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	if err == nil {
+		delete(breakers, address)
+		return
+	}
+	b, ok := breakers[address]
+	if !ok {
+		b = &breaker{}
+		breakers[address] = b
+	}
+	b.failures++
+	if b.failures == *breakerFailures {
+		log.Println("Could not connect to", address, b.failures, "times, failing fast for", *breakerCooldown)
+	}
+	if b.failures >= *breakerFailures {
+		b.openUntil = time.Now().Add(*breakerCooldown)
+	}
+}
+
+// A connection on which each read & write times out if it can not make progress
+// within the timeout. As the deadline is extended with each read & write, a long
+// transfer only times out if it stalls.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+	limiter requestLimiter
+}
+
+// Counts the requests of a connection against the per connection limits.
+type requestLimiter struct {
+	sync.Mutex
+	count int
+	// The requests since the start of the current one second window.
+	windowStart time.Time
+	windowCount int
+}
+
+// Counts a request, and checks whether it is within the limits.
+func (l *requestLimiter) allow() bool {
+	l.Lock()
+	defer l.Unlock()
+	l.count++
+	if *connRequests > 0 && l.count > *connRequests {
+		return false
+	}
+	if time.Since(l.windowStart) >= time.Second {
+		l.windowStart = time.Now()
+		l.windowCount = 0
+	}
+	l.windowCount++
+	return *connRate <= 0 || l.windowCount <= *connRate
+}
+
+// Counts a request of the given connection, and checks whether it is within the per
+// connection limits. If not, the connection should be closed.
+func allowRequest(conn net.Conn) bool {
+	dc, ok := conn.(*deadlineConn)
+	if !ok {
+		return true
+	}
+	if dc.limiter.allow() {
+		return true
+	}
+	log.Println("Closing the connection from", conn.RemoteAddr(), "over the request limit.")
+	return false
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// The size of the chunks sent with zero-copy, after each of which the deadline of the
+// connection is extended.
+const zeroCopyChunkSize = 1 << 20
+
+// Sends the given file through the connection. If enabled and supported, the file is
+// sent with the zero-copy (sendfile) path of the TCP connection. Otherwise, it falls
+// back to a buffered copy.
+func sendFile(conn net.Conn, srcFile *os.File, t *transfer) (int64, error) {
+	dc, ok := conn.(*deadlineConn)
+	if !*zeroCopy || !ok {
+		return copyChunked(conn, srcFile, -1, t)
+	}
+	tcpConn, ok := dc.Conn.(*net.TCPConn)
+	if !ok {
+		return copyChunked(conn, srcFile, -1, t)
+	}
+	// The kernel does the copying, so extend the deadline between the chunks instead.
+	var written int64
+	for {
+		tcpConn.SetWriteDeadline(time.Now().Add(dc.timeout))
+		acquireTransfer()
+		n, err := tcpConn.ReadFrom(io.LimitReader(srcFile, zeroCopyChunkSize))
+		releaseTransfer()
+		written += n
+		t.done.Add(n)
+		if err != nil || n < zeroCopyChunkSize {
+			return written, err
+		}
+	}
+}
+
+// A file being sent or received, listed in TRANSFERS replies.
+type transfer struct {
+	ID       int64
+	FileName string
+	// Either "in" or "out".
+	Direction string
+	// The size of the file, or -1 if it is not known in advance.
+	Size int64
+	done atomic.Int64
+	conn net.Conn
+}
+
+// The transfers in progress by their ids.
+var transfers = make(map[int64]*transfer)
+var transfersMutex sync.Mutex
+var lastTransferID atomic.Int64
+
+// Switches the given connection from the control timeout to the transfer (stall)
+// timeout, and registers the transfer of the given file through it, so that it can
+// be listed and killed. Should be called right before a file is sent or received, and
+// the transfer ended once it is done.
+func startTransfer(conn net.Conn, fileName string, direction string, size int64) *transfer {
+	if dc, ok := conn.(*deadlineConn); ok {
+		dc.timeout = *stallTimeout
+	}
+	t := &transfer{ID: lastTransferID.Add(1), FileName: fileName, Direction: direction, Size: size, conn: conn}
+	transfersMutex.Lock()
+	transfers[t.ID] = t
+	transfersMutex.Unlock()
+	return t
+}
+
+// Removes the transfer from the transfers in progress.
+func (t *transfer) end() {
+	transfersMutex.Lock()
+	delete(transfers, t.ID)
+	transfersMutex.Unlock()
 }
 
 // Runs the server at the given port, assigns its own ID and address, and
 // starts listening to connections.
 func serverRunner(port string) {
-	ls, err := net.Listen("tcp", ":"+port)
+	network, listenAddr := "tcp", ":"+port
+	if *unixPath != "" {
+		network, listenAddr = "unix", *unixPath
+		// Remove the socket left behind by a previous run.
+		if info, err := os.Stat(*unixPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(*unixPath)
+		}
+	}
+	ls, err := net.Listen(network, listenAddr)
 	if err != nil {
 		log.Println("Could not start the server.")
 		log.Fatalln(err)
 	}
 	// Acquire self address and id.
-	self.Address = getSelfIP() + ":" + port
+	if *unixPath != "" {
+		self.Address = unixPrefix + *unixPath
+	} else {
+		self.Address, err = advertisedAddress(port)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
 	self.ID = hsh(self.Address)
+	if *statePath != "" {
+		checkAddressChange(*statePath, *rekey)
+	}
+	if *keepData && !*noStore {
+		loadStoredFiles()
+	}
+	acceptRequests(ls)
+}
+
+// Returns the address that the other peers use to reach this peer listening at the
+// given port: the advertised address if one is given, or the own IP with the port.
+func advertisedAddress(port string) (string, error) {
+	if *advertiseAddr == "" {
+		selfIP := getSelfIP()
+		if unroutableHost(selfIP) {
+			return "", errors.New("could not determine the address of this peer, give one with -advertise")
+		}
+		return selfIP + ":" + port, nil
+	}
+	host, _, err := net.SplitHostPort(*advertiseAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid advertise address: %w", err)
+	}
+	if unroutableHost(host) {
+		return "", fmt.Errorf("the advertise address %s can not be dialed by the other peers, give a concrete host", *advertiseAddr)
+	}
+	// Make sure that the advertised address can be reached.
+	conn, err := net.DialTimeout("tcp", *advertiseAddr, 5*time.Second)
+	if err != nil {
+		log.Println("Warning: could not reach the advertised address", *advertiseAddr)
+		log.Println(err)
+	} else {
+		conn.Close()
+	}
+	return *advertiseAddr, nil
+}
+
+// Handles the connections accepted by the given listener until it is closed.
+func acceptRequests(ls net.Listener) {
 	for {
 		// Wait for a connection.
 		conn, err := ls.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println("Could not accept the connection.")
 			log.Println(err)
 			continue
 		}
-		// Once received, handle the request in the background.
-		go handleRequest(conn)
+		// Wait briefly for a free handler, then turn the connection away.
+		if !acquireHandler() {
+			log.Println("Rejected a connection, all", *maxHandlers, "handlers are busy.")
+			conn.Write([]byte("ERR Too many requests\n"))
+			conn.Close()
+			continue
+		}
+		// Once received, handle the request in the background. While paused, the
+		// requests in flight go on, but the new connections are turned away. As the
+		// neighbors can not reach the node meanwhile, it should only be paused for a
+		// short maintenance.
+		go func() {
+			defer releaseHandler()
+			if paused.Load() {
+				handlePausedConn(conn)
+				return
+			}
+			handleRequest(conn)
+		}()
+	}
+}
+
+// Compares the address of this peer with the one of its previous run, persisted in the
+// state file. As the ID is derived from the address, a changed address orphans the
+// files stored under the old ID. Warns about such a change and, if rekey is set, moves
+// the old files under the new ID. Then, persists the current address.
+func checkAddressChange(statePath string, rekey bool) {
+	state, err := os.ReadFile(statePath)
+	lastAddress := strings.TrimSpace(string(state))
+	if err == nil && lastAddress != self.Address {
+		lastID := hsh(lastAddress)
+		oldFolder := fmt.Sprintf("%d", lastID)
+		entries, _ := os.ReadDir(oldFolder)
+		if lastID != self.ID && len(entries) > 0 {
+			log.Printf("Warning: the address changed from %s to %s, which changes the ID from %d to %d.\n",
+				lastAddress, self.Address, lastID, self.ID)
+			if !rekey {
+				log.Printf("Warning: %d files under %s are not served, restart with -rekey to move them.\n",
+					len(entries), oldFolder)
+			} else {
+				rekeyFiles(oldFolder, entries)
+			}
+		}
+	}
+	err = os.WriteFile(statePath, []byte(self.Address), 0644)
+	if err != nil {
+		log.Println("Could not save the state.")
+		log.Println(err)
+	}
+}
+
+// Moves the given files in the old folder under the folder of this peer and adds
+// them to the stored files.
+func rekeyFiles(oldFolder string, entries []os.DirEntry) {
+	storedFilesMutex.Lock()
+	defer storedFilesMutex.Unlock()
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+		fileName := entry.Name()
+		err := os.Rename(filepath.Join(oldFolder, fileName), filePath(fileName))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		storedFiles[fileName] = storedFile{Key: hsh(fileName)}
+		logIndexChange(fileName)
+		log.Println("Moved", fileName, "from", oldFolder)
 	}
+	os.Remove(oldFolder)
 }
 
 // Multiplexer for the requests from the clients
 func handleRequest(conn net.Conn) {
-	reader := bufio.NewReader(conn)
-	request, _ := reader.ReadString('\n')
-	request = strings.TrimSpace(request)
+	var request string
+	dc := &deadlineConn{Conn: conn, timeout: *controlTimeout}
+	conn = dc
+	defer conn.Close()
+	// A panic in a handler should not bring down the whole node. Report it back to the
+	// client instead, before the connection is closed.
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from a panic while handling %q: %v\n", request, r)
+			conn.Write([]byte("ERR Internal error\n"))
+		}
+	}()
+	// The buffer can hold at most one request line, so longer lines are rejected
+	// instead of being buffered without a bound.
+	reader := bufio.NewReaderSize(conn, *maxRequestLength)
+	// Retrieve requests can be sent back-to-back on the same connection, and a
+	// successor request can be followed by a request to the successor, in case it is
+	// this node. Any other request ends the connection.
+	for strings.HasPrefix(request, "RETRIEVE") || strings.HasPrefix(request, "SUCC") || request == "" {
+		// The previous request might have switched to the transfer timeout.
+		dc.timeout = *controlTimeout
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			log.Println("Rejected a request longer than", *maxRequestLength, "bytes.")
+			conn.Write([]byte("ERR Request too large\n"))
+			conn.Close()
+			return
+		}
+		if err != nil && len(line) == 0 {
+			return
+		}
+		request = strings.TrimSpace(string(line))
+		if request != "" && !allowRequest(conn) {
+			conn.Write([]byte("ERR Rate limit exceeded\n"))
+			return
+		}
+		if request != "" {
+			start := time.Now()
+			dispatchRequest(conn, reader, request)
+			checkSlowRequest(request, conn.RemoteAddr(), time.Since(start))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// The number of requests that took longer than the slow request threshold.
+var slowRequests atomic.Int64
+
+// Logs the given request and counts it if it took longer than the threshold.
+func checkSlowRequest(request string, remoteAddr net.Addr, elapsed time.Duration) {
+	if *slowRequestThreshold <= 0 || elapsed < *slowRequestThreshold {
+		return
+	}
+	slowRequests.Add(1)
+	log.Printf("Slow request from %s took %v: %q\n", remoteAddr, elapsed, request)
+}
+
+// The requests that are handled on the connections accepted while the node is paused.
+var pausedRequests = []string{"PAUSE", "RESUME", "STATUS"}
+
+// Handles a connection accepted while the node is paused. Its request is rejected
+// unless it is one of the paused requests, and the connection is closed.
+func handlePausedConn(conn net.Conn) {
+	conn = &deadlineConn{Conn: conn, timeout: *controlTimeout}
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, *maxRequestLength)
+	request, err := lineFramer{}.readMessage(reader)
+	if err != nil {
+		conn.Write([]byte("ERR Node paused\n"))
+		return
+	}
+	command, _, _ := strings.Cut(request, " ")
+	for _, pausedCommand := range pausedRequests {
+		if command == pausedCommand {
+			dispatchRequest(conn, reader, request)
+			return
+		}
+	}
+	conn.Write([]byte("ERR Node paused\n"))
+}
+
+// Passes the given request to its handler.
+func dispatchRequest(conn net.Conn, reader *bufio.Reader, request string) {
 	if strings.HasPrefix(request, "JOIN") {
 		handleJoinRequest(conn, reader, request)
 	} else if strings.HasPrefix(request, "SUCC") {
@@ -166,318 +949,2604 @@ func handleRequest(conn net.Conn) {
 		handleStoreRequest(conn, reader, request)
 	} else if strings.HasPrefix(request, "RETRIEVE") {
 		handleRetrieveRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "EXPORT") {
+		handleExportRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "DELETE") {
+		handleDeleteRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "NODEINFO") {
+		handleNodeInfoRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "LISTALL") {
+		handleListAllRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "LIST") {
+		handleListRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "PUSH") {
+		handlePushRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "TOUCH") {
+		handleTouchRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "PARAMS") {
+		handleParamsRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "PEERS") {
+		handlePeersRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "FRAMING") {
+		handleFramingRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "MUX") {
+		handleMuxRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "HOTKEYS") {
+		handleHotKeysRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "TRANSFERS") {
+		handleTransfersRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "KILL") {
+		handleKillRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "SUBSCRIBE") {
+		handleSubscribeRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "STATUS") {
+		handleStatusRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "STAT") {
+		handleStatRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "PING") {
+		handlePingRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "TXN") {
+		handleTransactionRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "PIN") {
+		handlePinRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "PAUSE") {
+		handlePauseRequest(conn, reader, request)
+	} else if strings.HasPrefix(request, "RESUME") {
+		handleResumeRequest(conn, reader, request)
+	} else {
+		log.Printf("Received an unknown command: %q\n", request)
+		conn.Write([]byte("ERR Unknown command\n"))
+		conn.Close()
 	}
 }
 
-// Handles a `RETRIEVE` request (RETRIEVE <file name>)
-// Sends back the size of the file, then directly uploads the file through the connection.
-func handleRetrieveRequest(conn net.Conn, reader *bufio.Reader, request string) {
-	tokens := strings.Split(request, " ")
-	fileName := tokens[1]
-	_, ok := storedFiles[fileName]
-	// Could not find the file.
-	if !ok {
-		conn.Write([]byte("ERR File does not exist.\n"))
-		return
-	}
-	// Open the file.
-	srcFile, err := os.Open(filePath(fileName))
-	if err != nil {
-		log.Println(err)
-		conn.Write([]byte("ERR File does not exist.\n"))
-		return
-	}
-	fileInfo, _ := srcFile.Stat()
-	// Send back the size of the file.
-	conn.Write([]byte(fmt.Sprintf("OK %d\n", fileInfo.Size())))
-	// Send back the file itself.
-	_, err = io.Copy(conn, srcFile)
-	if err != nil {
-		log.Println(err)
-		conn.Write([]byte("ERR Could not copy the file.\n"))
+// The requests that can be sent over a multiplexed connection. Only the ones that do
+// not stream a file or change the ring are allowed.
+var muxRequests = []string{"SUCC", "NODEINFO", "LIST", "HOTKEYS", "PARAMS", "PEERS", "PING", "PIN", "TOUCH", "DELETE", "PUSH", "TRANSFERS", "KILL", "STAT"}
+
+// The most requests of a single multiplexed connection that are handled at once.
+const maxMuxInFlight = 64
+
+// A connection that collects what a handler writes, so that it can be sent back as a
+// single multiplexed response.
+type recordingConn struct {
+	net.Conn
+	response bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	return c.response.Write(b)
+}
+
+// The multiplexed connection remains open when a handler closes its connection.
+func (c *recordingConn) Close() error {
+	return nil
+}
+
+// Handles a `MUX` request by switching the connection to multiplexed requests.
+// Afterwards, each request is sent with an id on a single line, and handled at once.
+// The response of each request is sent back with its id and length as soon as it is
+// ready, so the responses may arrive in a different order than the requests.
+// MUX => OK, then <id> <request> => <id> <response length>\n<response>
+func handleMuxRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	conn.Write([]byte("OK\n"))
+	var writeMutex sync.Mutex
+	inFlight := make(chan struct{}, maxMuxInFlight)
+	// Send back the responses of the requests in flight before the connection is closed.
+	defer func() {
+		for i := 0; i < maxMuxInFlight; i++ {
+			inFlight <- struct{}{}
+		}
+	}()
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			log.Println("Rejected a multiplexed request longer than", *maxRequestLength, "bytes.")
+			return
+		}
+		if err != nil {
+			return
+		}
+		id, muxRequest, _ := strings.Cut(strings.TrimSpace(string(line)), " ")
+		if !allowRequest(conn) {
+			response := "ERR Rate limit exceeded\n"
+			writeMutex.Lock()
+			conn.Write([]byte(fmt.Sprintf("%s %d\n%s", id, len(response), response)))
+			writeMutex.Unlock()
+			return
+		}
+		inFlight <- struct{}{}
+		go func() {
+			defer func() { <-inFlight }()
+			rc := &recordingConn{Conn: conn}
+			if !muxable(muxRequest) {
+				rc.Write([]byte("ERR Not allowed over a multiplexed connection\n"))
+			} else {
+				handleMuxedRequest(rc, muxRequest)
+			}
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			conn.Write([]byte(fmt.Sprintf("%s %d\n", id, rc.response.Len())))
+			conn.Write(rc.response.Bytes())
+		}()
+	}
+}
+
+// Reads & writes the control messages of a connection.
+type controlFramer interface {
+	readMessage(reader *bufio.Reader) (string, error)
+	writeMessage(w io.Writer, message string) error
+}
+
+// Frames each message as a single line, which is the default.
+type lineFramer struct{}
+
+func (lineFramer) readMessage(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errRequestTooLarge
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+func (lineFramer) writeMessage(w io.Writer, message string) error {
+	_, err := w.Write([]byte(message))
+	return err
+}
+
+// Frames each message with its length as a varint, so that it can contain any bytes,
+// including newlines.
+type lengthFramer struct{}
+
+func (lengthFramer) readMessage(reader *bufio.Reader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(*maxRequestLength) {
+		return "", errRequestTooLarge
+	}
+	message := make([]byte, length)
+	_, err = io.ReadFull(reader, message)
+	return string(message), err
+}
+
+func (lengthFramer) writeMessage(w io.Writer, message string) error {
+	frame := binary.AppendUvarint(nil, uint64(len(message)))
+	_, err := w.Write(append(frame, message...))
+	return err
+}
+
+var errRequestTooLarge = errors.New("request too large")
+
+// Handles a `FRAMING` request (FRAMING line | length)
+// Switches the framing of the control messages of the connection. With the length
+// framing, each request and its whole response are sent as a single length prefixed
+// message, and only the requests that can be multiplexed are allowed, as the others
+// stream files.
+// FRAMING <framing> => OK | ERR <msg>
+func handleFramingRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	var framer controlFramer
+	if len(tokens) > 1 && tokens[1] == "line" {
+		framer = lineFramer{}
+	} else if len(tokens) > 1 && tokens[1] == "length" {
+		framer = lengthFramer{}
+	} else {
+		conn.Write([]byte("ERR Unknown framing.\n"))
+		return
+	}
+	conn.Write([]byte("OK\n"))
+	for {
+		framedRequest, err := framer.readMessage(reader)
+		if err == errRequestTooLarge {
+			log.Println("Rejected a request longer than", *maxRequestLength, "bytes.")
+			framer.writeMessage(conn, "ERR Request too large\n")
+			return
+		}
+		if err != nil {
+			return
+		}
+		if !allowRequest(conn) {
+			framer.writeMessage(conn, "ERR Rate limit exceeded\n")
+			return
+		}
+		rc := &recordingConn{Conn: conn}
+		if !muxable(framedRequest) {
+			rc.Write([]byte("ERR Not allowed with this framing\n"))
+		} else {
+			handleMuxedRequest(rc, framedRequest)
+		}
+		err = framer.writeMessage(conn, rc.response.String())
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Checks whether the given request can be sent over a multiplexed connection.
+func muxable(request string) bool {
+	for _, prefix := range muxRequests {
+		if strings.HasPrefix(request, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles a single request of a multiplexed connection. A panic is reported back as
+// the response, as it happens outside of handleRequest.
+func handleMuxedRequest(rc *recordingConn, request string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from a panic while handling %q: %v\n", request, r)
+			rc.response.Reset()
+			rc.Write([]byte("ERR Internal error\n"))
+		}
+	}()
+	start := time.Now()
+	dispatchRequest(rc, nil, request)
+	checkSlowRequest(request, rc.RemoteAddr(), time.Since(start))
+}
+
+// Handles a `NODEINFO` request by replying back with the neighbors of this node.
+// NODEINFO => OK <pred addr> <succ addr>
+func handleNodeInfoRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	conn.Write([]byte(fmt.Sprintf("OK %s %s\n", nodeAddress(predecessor), nodeAddress(successor))))
+}
+
+// The number of events that can wait for a slow subscriber before it is dropped.
+const subscriberBacklog = 16
+
+// A client waiting for the changes of a file, see SUBSCRIBE. Its events are closed
+// once it is dropped.
+type subscriber struct {
+	events chan string
+}
+
+// The subscribers of each file, by file name.
+var subscribers = make(map[string]map[*subscriber]bool)
+var subscribersMutex sync.Mutex
+
+// Sends the given event line to the subscribers of the given file. A subscriber that
+// can not keep up is dropped, and has to subscribe again.
+func notifySubscribers(fileName string, event string) {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	for sub := range subscribers[fileName] {
+		select {
+		case sub.events <- event:
+		default:
+			delete(subscribers[fileName], sub)
+			close(sub.events)
+		}
+	}
+	if len(subscribers[fileName]) == 0 {
+		delete(subscribers, fileName)
+	}
+}
+
+// Tells the subscribers of the given files that the files have moved to another node,
+// so that they subscribe again through the new owner, and drops them.
+func handOffSubscribers(fileNames ...string) {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	for _, fileName := range fileNames {
+		for sub := range subscribers[fileName] {
+			// A full subscriber finds out from the closed connection instead.
+			select {
+			case sub.events <- fmt.Sprintf("MOVED %s\n", fileName):
+			default:
+			}
+			close(sub.events)
+		}
+		delete(subscribers, fileName)
+	}
+}
+
+// Handles a `SUBSCRIBE` request (SUBSCRIBE <file name>)
+// Keeps the connection open, and sends a `CHANGED <file name> <sha256>` line whenever
+// the file is stored, or a `CHANGED <file name> NONE` line when it is deleted or
+// expires, until the client sends UNSUBSCRIBE or disconnects. If the file moves to
+// another node, sends a `MOVED <file name>` line and ends the subscription.
+// SUBSCRIBE <file name> => OK, followed by the events
+// UNSUBSCRIBE => OK
+func handleSubscribeRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	if len(tokens) < 2 {
+		conn.Write([]byte("ERR Malformed subscribe request.\n"))
+		return
+	}
+	fileName := tokens[1]
+	// Only the owner hears of the changes of a file.
+	if !ownsFile(fileName) {
+		conn.Write([]byte("ERR Not the owner.\n"))
+		return
+	}
+	sub := &subscriber{events: make(chan string, subscriberBacklog)}
+	subscribersMutex.Lock()
+	if subscribers[fileName] == nil {
+		subscribers[fileName] = make(map[*subscriber]bool)
+	}
+	subscribers[fileName][sub] = true
+	subscribersMutex.Unlock()
+	defer func() {
+		subscribersMutex.Lock()
+		if subscribers[fileName][sub] {
+			delete(subscribers[fileName], sub)
+			if len(subscribers[fileName]) == 0 {
+				delete(subscribers, fileName)
+			}
+		}
+		subscribersMutex.Unlock()
+	}()
+	conn.Write([]byte("OK\n"))
+	// Wait for the client to unsubscribe or disconnect. A subscription can stay idle
+	// for longer than the control timeout.
+	unsubscribed := make(chan bool, 1)
+	go func() {
+		for {
+			line, err := lineFramer{}.readMessage(reader)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			unsubscribed <- err == nil && line == "UNSUBSCRIBE"
+			return
+		}
+	}()
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			_, err := conn.Write([]byte(event))
+			if err != nil {
+				return
+			}
+		case ok := <-unsubscribed:
+			if ok {
+				conn.Write([]byte("OK\n"))
+			}
+			return
+		}
+	}
+}
+
+// Handles a `STAT` request (STAT <file name>) by replying back with the size, the
+// modification time and the SHA-256 checksum of the file, so that the requester can
+// tell whether it has changed, and whether the file is pinned. The checksum is the one
+// recorded when the file was stored, so the file is only read if it has none yet.
+// STAT <file name> => OK <size> <modification unix nano time> <sha256> pinned=<true|false> | ERR <msg>
+func handleStatRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	if len(tokens) < 2 {
+		conn.Write([]byte("ERR Malformed stat request.\n"))
+		return
+	}
+	fileName := tokens[1]
+	storedFilesMutex.Lock()
+	file, ok := storedFiles[fileName]
+	storedFilesMutex.Unlock()
+	if (!ok || file.expired()) && !ownsFile(fileName) {
+		conn.Write([]byte("ERR Not the owner.\n"))
+		return
+	}
+	if !ok || file.expired() {
+		conn.Write([]byte("ERR File does not exist.\n"))
+		return
+	}
+	fileInfo, err := os.Stat(filePath(fileName))
+	if err != nil {
+		conn.Write([]byte("ERR File does not exist.\n"))
+		return
+	}
+	if file.Sum == "" {
+		file.Sum, err = recordChecksum(fileName)
+		if err != nil {
+			conn.Write([]byte("ERR Could not read the file.\n"))
+			return
+		}
+	}
+	conn.Write([]byte(fmt.Sprintf("OK %d %d %s pinned=%t\n", fileInfo.Size(), fileInfo.ModTime().UnixNano(), file.Sum, file.Pinned)))
+}
+
+// Computes the checksum of a stored file that has none recorded yet, e.g. one found on
+// disk without an index, and records it.
+func recordChecksum(fileName string) (string, error) {
+	srcFile, err := os.Open(filePath(fileName))
+	if err != nil {
+		return "", err
+	}
+	defer srcFile.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, srcFile)
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	storedFilesMutex.Lock()
+	defer storedFilesMutex.Unlock()
+	// A store in the meantime records the checksum of its own contents.
+	if file, ok := storedFiles[fileName]; ok && file.Sum == "" {
+		file.Sum = sum
+		storedFiles[fileName] = file
+		logIndexChange(fileName)
+	}
+	return sum, nil
+}
+
+// Handles a `PING` request by replying back immediately, so that the requester can
+// measure the round trip time.
+// PING => OK
+func handlePingRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	conn.Write([]byte("OK\n"))
+}
+
+// Handles a `PAUSE` request by turning away the connections accepted from now on.
+// PAUSE => OK
+func handlePauseRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	paused.Store(true)
+	log.Println("Paused, new connections are rejected.")
+	conn.Write([]byte("OK\n"))
+}
+
+// Handles a `RESUME` request by accepting the new connections again.
+// RESUME => OK
+func handleResumeRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	paused.Store(false)
+	log.Println("Resumed accepting connections.")
+	conn.Write([]byte("OK\n"))
+}
+
+// Handles a `STATUS` request by replying back with the state of the node.
+// STATUS => OK state=<serving | paused> handlers=<requests being handled> files=<file count>
+func handleStatusRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	state := "serving"
+	if paused.Load() {
+		state = "paused"
+	}
+	storedFilesMutex.Lock()
+	fileCount := len(storedFiles)
+	storedFilesMutex.Unlock()
+	conn.Write([]byte(fmt.Sprintf("OK state=%s handlers=%d files=%d\n", state, activeHandlers.Load(), fileCount)))
+}
+
+// Handles a `HOTKEYS` request (HOTKEYS <n>) by replying back with the n most accessed
+// files stored on this node, the most accessed first.
+// HOTKEYS <n> => OK <file count>, followed by a
+// `<file name> <key> <reads> <writes> <last access unix time>` line for each file.
+func handleHotKeysRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	if len(tokens) < 2 {
+		conn.Write([]byte("ERR Malformed hotkeys request.\n"))
+		return
+	}
+	count, err := strconv.Atoi(tokens[1])
+	if err != nil || count <= 0 {
+		conn.Write([]byte("ERR Invalid count.\n"))
+		return
+	}
+	// Only report the files that are still stored.
+	type hotKey struct {
+		fileName string
+		key      int
+		stat     accessStat
+	}
+	hotKeys := []hotKey{}
+	storedFilesMutex.Lock()
+	accessStatsMutex.Lock()
+	for fileName, stat := range accessStats {
+		if file, ok := storedFiles[fileName]; ok {
+			hotKeys = append(hotKeys, hotKey{fileName, file.Key, *stat})
+		}
+	}
+	accessStatsMutex.Unlock()
+	storedFilesMutex.Unlock()
+	sort.Slice(hotKeys, func(i, j int) bool {
+		return hotKeys[i].stat.Reads+hotKeys[i].stat.Writes > hotKeys[j].stat.Reads+hotKeys[j].stat.Writes
+	})
+	if len(hotKeys) > count {
+		hotKeys = hotKeys[:count]
+	}
+	conn.Write([]byte(fmt.Sprintf("OK %d\n", len(hotKeys))))
+	for _, hk := range hotKeys {
+		conn.Write([]byte(fmt.Sprintf("%s %d %d %d %d\n",
+			hk.fileName, hk.key, hk.stat.Reads, hk.stat.Writes, hk.stat.LastAccess.Unix())))
+	}
+}
+
+// Handles a `TRANSFERS` request by replying back with the transfers in progress.
+// TRANSFERS => OK <transfer count>, followed by a
+// `<id> <in|out> <file name> <bytes done> <size> <peer addr>` line for each transfer.
+// The size is -1 for a streamed file.
+func handleTransfersRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	transfersMutex.Lock()
+	defer transfersMutex.Unlock()
+	conn.Write([]byte(fmt.Sprintf("OK %d\n", len(transfers))))
+	for _, t := range transfers {
+		conn.Write([]byte(fmt.Sprintf("%d %s %s %d %d %s\n",
+			t.ID, t.Direction, t.FileName, t.done.Load(), t.Size, t.conn.RemoteAddr())))
+	}
+}
+
+// Handles a `KILL` request (KILL <transfer id>)
+// Aborts the transfer by closing its connection. A file being received is discarded.
+// KILL <transfer id> => OK | ERR <msg>
+func handleKillRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	if len(tokens) < 2 {
+		conn.Write([]byte("ERR Malformed kill request.\n"))
+		return
+	}
+	id, err := strconv.ParseInt(tokens[1], 10, 64)
+	if err != nil {
+		conn.Write([]byte("ERR Invalid transfer id.\n"))
+		return
+	}
+	transfersMutex.Lock()
+	t, ok := transfers[id]
+	transfersMutex.Unlock()
+	if !ok {
+		conn.Write([]byte("ERR Transfer does not exist.\n"))
+		return
+	}
+	log.Println("Killed the transfer of", t.FileName, "with", t.conn.RemoteAddr())
+	t.conn.Close()
+	conn.Write([]byte("OK\n"))
+}
+
+// Handles a `LIST` request by replying back with the files stored on this node.
+// LIST => OK <file count>, followed by a `<file name> <key> [pinned]` line for each file.
+func handleListRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	storedFilesMutex.Lock()
+	defer storedFilesMutex.Unlock()
+	conn.Write([]byte(fmt.Sprintf("OK %d\n", len(storedFiles))))
+	for fileName, file := range storedFiles {
+		line := fmt.Sprintf("%s %d", fileName, file.Key)
+		if file.Pinned {
+			line += " pinned"
+		}
+		conn.Write([]byte(line + "\n"))
+	}
+}
+
+// Handles a `LISTALL` request by streaming the files stored on this node along with
+// their sizes and checksums. Unlike LIST, the files are not counted up front, and the
+// index is not locked while they are sent. Expired files are left out.
+// LISTALL => OK, followed by a `<file name> <key> <size> <sha256>` line for each file
+// (- if the checksum is not known), and an empty line.
+func handleListAllRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	storedFilesMutex.Lock()
+	files := make(map[string]storedFile, len(storedFiles))
+	for fileName, file := range storedFiles {
+		files[fileName] = file
+	}
+	storedFilesMutex.Unlock()
+	conn.Write([]byte("OK\n"))
+	for fileName, file := range files {
+		if file.expired() {
+			continue
+		}
+		// The file might have been deleted since.
+		fileInfo, err := os.Stat(filePath(fileName))
+		if err != nil {
+			continue
+		}
+		sum := file.Sum
+		if sum == "" {
+			sum = "-"
+		}
+		_, err = conn.Write([]byte(fmt.Sprintf("%s %d %d %s\n", fileName, file.Key, fileInfo.Size(), sum)))
+		if err != nil {
+			return
+		}
+	}
+	conn.Write([]byte("\n"))
+}
+
+// Handles a `DELETE` request (DELETE <file name>)
+// Removes the file from the local storage and replies back with OK.
+func handleDeleteRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	if len(tokens) < 2 {
+		conn.Write([]byte("ERR Malformed delete request.\n"))
+		return
+	}
+	fileName := tokens[1]
+	lockFile(fileName)
+	defer unlockFile(fileName)
+	// Remove the file from the index first, so that it can not be retrieved anymore.
+	storedFilesMutex.Lock()
+	_, ok := storedFiles[fileName]
+	if ok {
+		delete(storedFiles, fileName)
+		logIndexChange(fileName)
+	}
+	storedFilesMutex.Unlock()
+	readCache.invalidate(fileName)
+	// Could not find the file.
+	if !ok {
+		conn.Write([]byte("ERR File does not exist.\n"))
+		return
+	}
+	err := os.Remove(filePath(fileName))
+	if err != nil {
+		log.Println(err)
+	}
+	notifySubscribers(fileName, fmt.Sprintf("CHANGED %s NONE\n", fileName))
+	conn.Write([]byte("OK\n"))
+}
+
+// The optional features that this peer supports, reported in PARAMS replies.
+var capabilities = []string{"ttl", "token", "touch", "push", "export", "delete", "list", "pipeline", "peers", "pin", "ping", "stream", "transfers", "mux", "hotkeys", "framing", "stat", "subscribe", "range", "txn"}
+
+// Handles a `PARAMS` request by replying back with the parameters that the peers
+// & clients must agree on, and the optional features that this peer supports.
+// PARAMS => OK capacity=<ring capacity> hash=<hash algorithm> version=<protocol version> caps=<feature>,... seed=<hash seed>
+func handleParamsRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	conn.Write([]byte(fmt.Sprintf("OK capacity=%d hash=%s version=%d caps=%s seed=%s\n",
+		ringCapacity, hashAlgorithm, protocolVersion, strings.Join(capabilities, ","), *hashSeed)))
+}
+
+// Asks the given peer for its parameters and returns an error if the ones that the
+// peers must agree on do not match the ones of this peer.
+// PARAMS => OK <name>=<value> ...
+func checkRingParams(peerAddr string) error {
+	conn, reader, err := dialPeer(peerAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.Write([]byte("PARAMS\n"))
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("could not get the ring parameters: %w", err)
+	}
+	if !strings.HasPrefix(answer, "OK ") {
+		return fmt.Errorf("could not get the ring parameters: %q", strings.TrimSpace(answer))
+	}
+	params := make(map[string]string)
+	for _, token := range strings.Split(strings.TrimSpace(answer)[3:], " ") {
+		key, value, _ := strings.Cut(token, "=")
+		params[key] = value
+	}
+	expected := map[string]string{
+		"capacity": strconv.Itoa(int(ringCapacity)),
+		"hash":     hashAlgorithm,
+		"seed":     *hashSeed,
+	}
+	for key, value := range expected {
+		if params[key] != value {
+			return fmt.Errorf("the ring has %s %q, expected %q", key, params[key], value)
+		}
+	}
+	return nil
+}
+
+// Handles a `TOUCH` request (TOUCH <file name> <ttl>)
+// Makes the file expire after the given TTL in seconds from now.
+// TOUCH <file name> <ttl> => OK | ERR <msg>
+func handleTouchRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	if len(tokens) < 3 {
+		conn.Write([]byte("ERR Malformed touch request.\n"))
+		return
+	}
+	fileName := tokens[1]
+	ttl, err := strconv.Atoi(tokens[2])
+	if err != nil || ttl <= 0 {
+		conn.Write([]byte("ERR Invalid TTL.\n"))
+		return
+	}
+	storedFilesMutex.Lock()
+	file, ok := storedFiles[fileName]
+	// An expired file can not be brought back, even if the sweeper has not removed it yet.
+	if ok && !file.expired() {
+		file.Expiry = time.Now().Add(time.Duration(ttl) * time.Second)
+		storedFiles[fileName] = file
+		logIndexChange(fileName)
+	}
+	storedFilesMutex.Unlock()
+	if !ok || file.expired() {
+		conn.Write([]byte("ERR File does not exist.\n"))
+		return
+	}
+	conn.Write([]byte("OK\n"))
+}
+
+// Handles a `PIN` request (PIN <file name>)
+// Pins the file, so that it is not removed once its TTL passes.
+// PIN <file name> => OK | ERR <msg>
+func handlePinRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	if len(tokens) < 2 {
+		conn.Write([]byte("ERR Malformed pin request.\n"))
+		return
+	}
+	fileName := tokens[1]
+	storedFilesMutex.Lock()
+	file, ok := storedFiles[fileName]
+	// An expired file can not be brought back, even if the sweeper has not removed it yet.
+	if ok && !file.expired() {
+		file.Pinned = true
+		storedFiles[fileName] = file
+		logIndexChange(fileName)
+	}
+	storedFilesMutex.Unlock()
+	if !ok || file.expired() {
+		conn.Write([]byte("ERR File does not exist.\n"))
+		return
+	}
+	conn.Write([]byte("OK\n"))
+}
+
+// Handles a `PUSH` request (PUSH <file name> <dest addr>)
+// Stores the file on the peer at the destination address, so that the file does not
+// pass through the requester. Replies once the destination has stored the file.
+// PUSH <file name> <dest addr> => OK | ERR <msg>
+func handlePushRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	if len(tokens) < 3 {
+		conn.Write([]byte("ERR Malformed push request.\n"))
+		return
+	}
+	fileName, destAddr := tokens[1], tokens[2]
+	storedFilesMutex.Lock()
+	file, ok := storedFiles[fileName]
+	storedFilesMutex.Unlock()
+	if !ok || file.expired() {
+		conn.Write([]byte("ERR File does not exist.\n"))
+		return
+	}
+	err := storeFile(fileName, destAddr)
+	if err != nil {
+		log.Println("Could not push", fileName, "to", destAddr+":", err)
+		conn.Write([]byte(fmt.Sprintf("ERR Could not push the file: %v\n", err)))
+		return
+	}
+	conn.Write([]byte("OK\n"))
+}
+
+// Handles an `EXPORT` request (EXPORT)
+// Sends back OK, then streams all of the stored files as a single tar archive and
+// closes the connection.
+func handleExportRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	defer conn.Close()
+	// Take a snapshot of the stored file names.
+	storedFilesMutex.Lock()
+	fileNames := []string{}
+	for fileName := range storedFiles {
+		fileNames = append(fileNames, fileName)
+	}
+	storedFilesMutex.Unlock()
+	conn.Write([]byte("OK\n"))
+	t := startTransfer(conn, "*", "out", -1)
+	defer t.end()
+	tw := tar.NewWriter(conn)
+	for _, fileName := range fileNames {
+		srcFile, err := os.Open(filePath(fileName))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		fileInfo, _ := srcFile.Stat()
+		header := &tar.Header{
+			Name:    fileName,
+			Mode:    int64(storedFileMode),
+			Size:    fileInfo.Size(),
+			ModTime: fileInfo.ModTime(),
+		}
+		// Write the header, then the contents of the file.
+		err = tw.WriteHeader(header)
+		if err == nil {
+			_, err = copyChunked(tw, srcFile, -1, t)
+		}
+		srcFile.Close()
+		if err != nil {
+			log.Println("Could not export the files.")
+			log.Println(err)
+			return
+		}
+	}
+	tw.Close()
+}
+
+// Handles a `RETRIEVE` request (RETRIEVE <file name> [<offset>])
+// Sends back the size of the file, then directly uploads the file through the connection.
+// With an offset, only the part of the file from the offset on is sent, so that an
+// interrupted download can be resumed.
+func handleRetrieveRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	if len(tokens) < 2 {
+		conn.Write([]byte("ERR Malformed retrieve request.\n"))
+		return
+	}
+	fileName := tokens[1]
+	var offset int64
+	if len(tokens) > 2 {
+		var err error
+		offset, err = strconv.ParseInt(tokens[2], 10, 64)
+		if err != nil || offset < 0 {
+			conn.Write([]byte("ERR Invalid offset.\n"))
+			return
+		}
+	}
+	storedFilesMutex.Lock()
+	file, ok := storedFiles[fileName]
+	held := fileHeld(fileName)
+	storedFilesMutex.Unlock()
+	// Could not find the file. An expired file is treated as if it does not exist.
+	// Unless this node owns the file, the request was misrouted, e.g. by a lookup in
+	// the middle of a join or leave, so the requester should look up the owner again.
+	if (!ok || file.expired()) && !ownsFile(fileName) {
+		conn.Write([]byte("ERR Not the owner.\n"))
+		return
+	}
+	if !ok || file.expired() {
+		conn.Write([]byte("ERR File does not exist.\n"))
+		return
+	}
+	// A newer version of the file may still be on its way.
+	if held {
+		conn.Write([]byte("ERR Not ready, retry\n"))
+		return
+	}
+	if file.Corrupt {
+		conn.Write([]byte("ERR File is corrupt.\n"))
+		return
+	}
+	recordAccess(fileName, false)
+	// Serve the file from the cache if possible.
+	contents, ok := readCache.get(fileName)
+	if ok {
+		if offset > int64(len(contents)) {
+			conn.Write([]byte("ERR Invalid offset.\n"))
+			return
+		}
+		contents = contents[offset:]
+		conn.Write([]byte(fmt.Sprintf("OK %d\n", len(contents))))
+		t := startTransfer(conn, fileName, "out", int64(len(contents)))
+		defer t.end()
+		copyChunked(conn, bytes.NewReader(contents), int64(len(contents)), t)
+		conn.Write([]byte("OK\n"))
+		return
+	}
+	// Open the file.
+	cacheGeneration := readCache.generation()
+	srcFile, err := os.Open(filePath(fileName))
+	if err != nil {
+		log.Println(err)
+		conn.Write([]byte("ERR File does not exist.\n"))
+		return
+	}
+	defer srcFile.Close()
+	fileInfo, _ := srcFile.Stat()
+	// If the file fits into the cache, read it into the cache first.
+	if readCache.capacity > 0 && fileInfo.Size() <= readCache.capacity {
+		contents, err := io.ReadAll(srcFile)
+		if err != nil {
+			log.Println(err)
+			conn.Write([]byte("ERR Could not read the file.\n"))
+			return
+		}
+		readCache.put(fileName, contents, cacheGeneration)
+		if offset > int64(len(contents)) {
+			conn.Write([]byte("ERR Invalid offset.\n"))
+			return
+		}
+		contents = contents[offset:]
+		conn.Write([]byte(fmt.Sprintf("OK %d\n", len(contents))))
+		t := startTransfer(conn, fileName, "out", int64(len(contents)))
+		defer t.end()
+		copyChunked(conn, bytes.NewReader(contents), int64(len(contents)), t)
+		conn.Write([]byte("OK\n"))
+		return
+	}
+	if offset > fileInfo.Size() {
+		conn.Write([]byte("ERR Invalid offset.\n"))
+		return
+	}
+	_, err = srcFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		log.Println(err)
+		conn.Write([]byte("ERR Could not read the file.\n"))
+		return
+	}
+	// Send back the size of the (rest of the) file.
+	conn.Write([]byte(fmt.Sprintf("OK %d\n", fileInfo.Size()-offset)))
+	// Send back the file itself.
+	t := startTransfer(conn, fileName, "out", fileInfo.Size()-offset)
+	defer t.end()
+	_, err = sendFile(conn, srcFile, t)
+	if err != nil {
+		log.Println(err)
+		conn.Write([]byte("ERR Could not copy the file.\n"))
 		return
 	}
 	conn.Write([]byte("OK\n"))
 }
 
-// Handles a `STORE` request (STORE <file name> <file size>)
-// Downloads the file from the client and saves it into local storage.
+// Handles a `STORE` request (STORE <file name> <file size> | stream [ttl=<seconds>] [token=<token>] [pin=true] [sum=<sha256>])
+// Downloads the file from the client and saves it into local storage. With `stream`
+// instead of the size, the file is read until the client closes its side of the
+// connection. If a store with the same token was completed recently, replies back
+// with `OK STORED` and does not expect the file. If a checksum is given, the received
+// file is discarded unless it matches.
 func handleStoreRequest(conn net.Conn, reader *bufio.Reader, request string) {
 	tokens := strings.Split(request, " ")
-	// Acquire the file name & size.
+	if len(tokens) < 3 {
+		conn.Write([]byte("ERR Malformed store request.\n"))
+		return
+	}
+	// Acquire the file name & size. A streamed file has no size until it is received.
 	fileName := tokens[1]
-	fileSize, _ := strconv.Atoi(tokens[2])
-	// Create the file on the system.
-	dstFile, err := os.Create(filePath(fileName))
-	defer dstFile.Close()
+	var fileSize int64 = -1
+	if tokens[2] != "stream" {
+		var err error
+		fileSize, err = strconv.ParseInt(tokens[2], 10, 64)
+		if err != nil || fileSize < 0 {
+			conn.Write([]byte("ERR Invalid size.\n"))
+			return
+		}
+	}
+	// Acquire the optional arguments.
+	var expiry time.Time
+	var storeToken string
+	var pinned bool
+	var expectedSum string
+	for _, token := range tokens[3:] {
+		if strings.HasPrefix(token, "ttl=") {
+			ttl, err := strconv.Atoi(strings.TrimPrefix(token, "ttl="))
+			if err != nil || ttl <= 0 {
+				conn.Write([]byte("ERR Invalid TTL.\n"))
+				return
+			}
+			expiry = time.Now().Add(time.Duration(ttl) * time.Second)
+		} else if strings.HasPrefix(token, "token=") {
+			storeToken = strings.TrimPrefix(token, "token=")
+		} else if token == "pin=true" {
+			pinned = true
+		} else if strings.HasPrefix(token, "sum=") {
+			expectedSum = strings.ToLower(strings.TrimPrefix(token, "sum="))
+		}
+	}
+	if *noStore {
+		conn.Write([]byte("ERR Node stores no data\n"))
+		return
+	}
+	if !extensionAllowed(fileName) {
+		conn.Write([]byte("ERR File extension not allowed.\n"))
+		return
+	}
+	// A node that knows only one of its neighbors is still settling into the ring,
+	// and can not tell which keys it owns.
+	if (predecessor.ID == -1) != (successor.ID == -1) {
+		conn.Write([]byte("ERR Not ready, retry\n"))
+		return
+	}
+	if *assertOwner && !ownsFile(fileName) {
+		conn.Write([]byte("ERR Not the owner.\n"))
+		return
+	}
+	// Stores (and deletes) of the same file are applied one at a time, in order.
+	lockFile(fileName)
+	defer unlockFile(fileName)
+	// A retry of a completed store is not ingested again.
+	if storeToken != "" && seenToken(storeToken) {
+		conn.Write([]byte("OK STORED\n"))
+		return
+	}
+	// Receive the file into a temporary file first, so that an aborted transfer does
+	// not leave a partial file behind, or replace the previous version of the file.
+	dstPath := filePath(fileName)
+	dstFile, err := os.CreateTemp(filepath.Dir(dstPath), tempFilePrefix+"*")
 	if err != nil {
 		log.Println(err)
 		conn.Write([]byte("ERR Could not store file.\n"))
 		return
 	}
+	defer os.Remove(dstFile.Name())
+	defer dstFile.Close()
+	// Temporary files are only readable by the owner by default.
+	dstFile.Chmod(os.FileMode(storedFileMode))
 	conn.Write([]byte("OK\n"))
 	// Get the file from the connection.
-	_, err = io.CopyN(dstFile, reader, int64(fileSize))
+	t := startTransfer(conn, fileName, "in", fileSize)
+	defer t.end()
+	// A streamed file is read until EOF.
+	hasher := sha256.New()
+	_, err = copyChunked(io.MultiWriter(dstFile, hasher), reader, fileSize, t)
 	if err != nil {
-		log.Println(err)
+		log.Println("Aborted the store of", fileName+":", err)
 		conn.Write([]byte("ERR Could not copy file.\n"))
 		return
 	}
+	if expectedSum != "" && hex.EncodeToString(hasher.Sum(nil)) != expectedSum {
+		log.Println("Discarded the store of", fileName, "with a checksum mismatch.")
+		conn.Write([]byte("ERR Checksum mismatch.\n"))
+		return
+	}
+	dstFile.Close()
+	readCache.invalidate(fileName)
+	err = os.Rename(dstFile.Name(), dstPath)
+	if err != nil {
+		log.Println(err)
+		conn.Write([]byte("ERR Could not store file.\n"))
+		return
+	}
 	fileKey := hsh(fileName)
-	storedFiles[fileName] = fileKey
+	storedFilesMutex.Lock()
+	storedFiles[fileName] = storedFile{Key: fileKey, Expiry: expiry, Pinned: pinned, Sum: hex.EncodeToString(hasher.Sum(nil))}
+	logIndexChange(fileName)
+	delete(heldFiles, fileName)
+	storedFilesMutex.Unlock()
+	recordAccess(fileName, true)
+	readCache.invalidate(fileName)
+	if storeToken != "" {
+		recordToken(storeToken)
+	}
+	notifySubscribers(fileName, fmt.Sprintf("CHANGED %s %s\n", fileName, hex.EncodeToString(hasher.Sum(nil))))
+	conn.Write([]byte("OK\n"))
+}
+
+// A file received by a transaction, which is not visible until the transaction commits.
+type stagedFile struct {
+	tempPath string
+	file     storedFile
+}
+
+// Handles a `TXN` request (TXN <transaction id>)
+// Keeps the connection open for the stores of the transaction, whose files are staged
+// instead of being stored. On `PREPARE`, the node checks that it can take the staged
+// files and votes on the transaction. Once it votes yes, the files are held back from
+// the other stores & deletes, and no more files can be staged. On `COMMIT`, the staged
+// files become visible all at once. On `ABORT`, a failed store, or if the client
+// disconnects first, they are discarded. A transaction idle for longer than the control
+// timeout is discarded as well, unless the client keeps it alive.
+// TXN <transaction id> => OK
+// STORE <file name> <file size> [ttl=<seconds>] [pin=true] [sum=<sha256>] => OK, the file, OK
+// KEEPALIVE => OK
+// PREPARE => OK | ERR <msg>
+// COMMIT => OK | ERR <msg>
+// ABORT => OK
+func handleTransactionRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	if len(tokens) < 2 || tokens[1] == "" {
+		conn.Write([]byte("ERR Malformed transaction request.\n"))
+		return
+	}
+	txnID := tokens[1]
+	if *noStore {
+		conn.Write([]byte("ERR Node stores no data\n"))
+		return
+	}
+	staged := make(map[string]stagedFile)
+	defer func() {
+		for _, f := range staged {
+			os.Remove(f.tempPath)
+		}
+	}()
+	// The files of the transaction, locked once it is prepared.
+	var prepared []string
+	defer func() {
+		for _, fileName := range prepared {
+			unlockFile(fileName)
+		}
+	}()
+	conn.Write([]byte("OK\n"))
+	for {
+		// The previous store might have switched to the transfer timeout.
+		if dc, ok := conn.(*deadlineConn); ok {
+			dc.timeout = *controlTimeout
+		}
+		line, err := lineFramer{}.readMessage(reader)
+		if err == errRequestTooLarge {
+			log.Println("Discarded the transaction", txnID, "after a request longer than", *maxRequestLength, "bytes.")
+			conn.Write([]byte("ERR Request too large\n"))
+			return
+		}
+		if err != nil {
+			log.Println("Discarded the transaction", txnID, "as the connection ended.")
+			return
+		}
+		if strings.HasPrefix(line, "STORE") && prepared != nil {
+			log.Println("Discarded the transaction", txnID, "after a store once prepared.")
+			conn.Write([]byte("ERR Transaction is prepared\n"))
+			return
+		} else if strings.HasPrefix(line, "STORE") {
+			fileName, f, ok := stageFile(conn, reader, line)
+			if !ok {
+				log.Println("Discarded the transaction", txnID, "after a failed store.")
+				return
+			}
+			// A file staged again replaces its earlier version.
+			if previous, ok := staged[fileName]; ok {
+				os.Remove(previous.tempPath)
+			}
+			staged[fileName] = f
+		} else if line == "KEEPALIVE" {
+			conn.Write([]byte("OK\n"))
+		} else if line == "PREPARE" && prepared != nil {
+			conn.Write([]byte("OK\n"))
+		} else if line == "PREPARE" {
+			fileNames, err := prepareTransaction(staged)
+			if err != nil {
+				log.Println("Voted against the transaction", txnID+":", err)
+				conn.Write([]byte("ERR Could not prepare.\n"))
+				return
+			}
+			prepared = fileNames
+			conn.Write([]byte("OK\n"))
+		} else if line == "COMMIT" {
+			// A client that does not vote its owners commits the transaction at once.
+			if prepared == nil {
+				fileNames, err := prepareTransaction(staged)
+				if err != nil {
+					log.Println("Could not commit the transaction", txnID+":", err)
+					conn.Write([]byte("ERR Could not commit.\n"))
+					return
+				}
+				prepared = fileNames
+			}
+			err := commitTransaction(prepared, staged)
+			if err != nil {
+				log.Println("Could not commit the transaction", txnID+":", err)
+				conn.Write([]byte("ERR Could not commit.\n"))
+				return
+			}
+			log.Println("Committed the transaction", txnID, "with", len(staged), "files.")
+			staged = nil
+			conn.Write([]byte("OK\n"))
+			return
+		} else if line == "ABORT" {
+			conn.Write([]byte("OK\n"))
+			return
+		} else {
+			conn.Write([]byte("ERR Unknown transaction command\n"))
+			return
+		}
+	}
+}
+
+// Receives the file of a store request within a transaction into a temporary file.
+// Replies back like a `STORE` request, and returns the name & the staged file, or
+// false if the store failed.
+func stageFile(conn net.Conn, reader *bufio.Reader, request string) (string, stagedFile, bool) {
+	tokens := strings.Split(request, " ")
+	if len(tokens) < 3 {
+		conn.Write([]byte("ERR Malformed store request.\n"))
+		return "", stagedFile{}, false
+	}
+	fileName := tokens[1]
+	fileSize, err := strconv.ParseInt(tokens[2], 10, 64)
+	if err != nil || fileSize < 0 {
+		conn.Write([]byte("ERR Invalid size.\n"))
+		return "", stagedFile{}, false
+	}
+	file := storedFile{Key: hsh(fileName)}
+	var expectedSum string
+	for _, token := range tokens[3:] {
+		if strings.HasPrefix(token, "ttl=") {
+			ttl, err := strconv.Atoi(strings.TrimPrefix(token, "ttl="))
+			if err != nil || ttl <= 0 {
+				conn.Write([]byte("ERR Invalid TTL.\n"))
+				return "", stagedFile{}, false
+			}
+			file.Expiry = time.Now().Add(time.Duration(ttl) * time.Second)
+		} else if token == "pin=true" {
+			file.Pinned = true
+		} else if strings.HasPrefix(token, "sum=") {
+			expectedSum = strings.ToLower(strings.TrimPrefix(token, "sum="))
+		}
+	}
+	if !extensionAllowed(fileName) {
+		conn.Write([]byte("ERR File extension not allowed.\n"))
+		return "", stagedFile{}, false
+	}
+	if (predecessor.ID == -1) != (successor.ID == -1) {
+		conn.Write([]byte("ERR Not ready, retry\n"))
+		return "", stagedFile{}, false
+	}
+	// Stage the file next to where it will be stored, so that it can be moved into
+	// place without copying.
+	tempFile, err := os.CreateTemp(filepath.Dir(filePath(fileName)), tempFilePrefix+"*")
+	if err != nil {
+		log.Println(err)
+		conn.Write([]byte("ERR Could not store file.\n"))
+		return "", stagedFile{}, false
+	}
+	defer tempFile.Close()
+	tempFile.Chmod(os.FileMode(storedFileMode))
+	conn.Write([]byte("OK\n"))
+	t := startTransfer(conn, fileName, "in", fileSize)
+	defer t.end()
+	hasher := sha256.New()
+	_, err = copyChunked(io.MultiWriter(tempFile, hasher), reader, fileSize, t)
+	if err != nil {
+		log.Println("Aborted the store of", fileName+":", err)
+		os.Remove(tempFile.Name())
+		conn.Write([]byte("ERR Could not copy file.\n"))
+		return "", stagedFile{}, false
+	}
+	file.Sum = hex.EncodeToString(hasher.Sum(nil))
+	if expectedSum != "" && file.Sum != expectedSum {
+		log.Println("Discarded the store of", fileName, "with a checksum mismatch.")
+		os.Remove(tempFile.Name())
+		conn.Write([]byte("ERR Checksum mismatch.\n"))
+		return "", stagedFile{}, false
+	}
 	conn.Write([]byte("OK\n"))
+	return fileName, stagedFile{tempPath: tempFile.Name(), file: file}, true
+}
+
+// Checks that the given staged files can be committed, and holds back the other stores
+// & deletes of the files until the transaction ends. Returns the names of the files,
+// which are locked, or an error, in which case none of them are.
+func prepareTransaction(staged map[string]stagedFile) ([]string, error) {
+	// The locks are taken in order so that two transactions can not wait on each other.
+	fileNames := make([]string, 0, len(staged))
+	for fileName := range staged {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+	for _, fileName := range fileNames {
+		lockFile(fileName)
+	}
+	err := checkStagedFiles(fileNames, staged)
+	if err != nil {
+		for _, fileName := range fileNames {
+			unlockFile(fileName)
+		}
+		return nil, err
+	}
+	return fileNames, nil
+}
+
+// Checks that the node can still take the given staged files, see prepareTransaction.
+func checkStagedFiles(fileNames []string, staged map[string]stagedFile) error {
+	if (predecessor.ID == -1) != (successor.ID == -1) {
+		return errors.New("not settled into the ring")
+	}
+	for _, fileName := range fileNames {
+		// The key of the file might have moved to a joined node since it was staged.
+		if *assertOwner && !ownsFile(fileName) {
+			return fmt.Errorf("not the owner of %s anymore", fileName)
+		}
+		_, err := os.Stat(staged[fileName].tempPath)
+		if err != nil {
+			return fmt.Errorf("lost the staged %s: %w", fileName, err)
+		}
+		info, err := os.Stat(filePath(fileName))
+		if err == nil && !info.Mode().IsRegular() {
+			return fmt.Errorf("%s can not be replaced", filePath(fileName))
+		}
+	}
+	return nil
+}
+
+// Moves the given staged files into place. The files must be locked already, see
+// prepareTransaction. The index is held throughout, so that the files are either all
+// visible to the other requests or none of them are.
+func commitTransaction(fileNames []string, staged map[string]stagedFile) error {
+	storedFilesMutex.Lock()
+	err := moveStagedFiles(fileNames, staged)
+	if err != nil {
+		storedFilesMutex.Unlock()
+		return err
+	}
+	for _, fileName := range fileNames {
+		storedFiles[fileName] = staged[fileName].file
+		logIndexChange(fileName)
+		delete(heldFiles, fileName)
+	}
+	storedFilesMutex.Unlock()
+	for _, fileName := range fileNames {
+		readCache.invalidate(fileName)
+		recordAccess(fileName, true)
+		notifySubscribers(fileName, fmt.Sprintf("CHANGED %s %s\n", fileName, staged[fileName].file.Sum))
+	}
+	return nil
+}
+
+// Moves the given staged files into place. The files replaced are set aside until
+// every staged file is in place, so that if one can not be moved, they are put back
+// and the files are left as they were.
+func moveStagedFiles(fileNames []string, staged map[string]stagedFile) error {
+	// The paths that the replaced files are set aside to, by the files.
+	replaced := make(map[string]string)
+	moved := []string{}
+	var err error
+	for _, fileName := range fileNames {
+		var asidePath string
+		asidePath, err = setAside(filePath(fileName))
+		if err != nil {
+			break
+		}
+		if asidePath != "" {
+			replaced[fileName] = asidePath
+		}
+		err = os.Rename(staged[fileName].tempPath, filePath(fileName))
+		if err != nil {
+			break
+		}
+		moved = append(moved, fileName)
+	}
+	if err != nil {
+		for _, fileName := range moved {
+			os.Remove(filePath(fileName))
+		}
+		for fileName, asidePath := range replaced {
+			os.Rename(asidePath, filePath(fileName))
+		}
+		return err
+	}
+	for _, asidePath := range replaced {
+		os.Remove(asidePath)
+	}
+	return nil
+}
+
+// Moves the file at the given path to a temporary path next to it, and returns the
+// temporary path, or "" if there is no file at the given path.
+func setAside(path string) (string, error) {
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	asideFile, err := os.CreateTemp(filepath.Dir(path), tempFilePrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	asideFile.Close()
+	err = os.Rename(path, asideFile.Name())
+	if err != nil {
+		os.Remove(asideFile.Name())
+		return "", err
+	}
+	return asideFile.Name(), nil
+}
+
+// A lock for the writes to a single file, along with the number of its holders and
+// waiters, so that it can be dropped once no one needs it.
+type fileLock struct {
+	sync.Mutex
+	users int
+}
+
+var fileLocks = make(map[string]*fileLock)
+var fileLocksMutex sync.Mutex
+
+// Blocks until no one else is writing to the given file.
+func lockFile(fileName string) {
+	fileLocksMutex.Lock()
+	lock, ok := fileLocks[fileName]
+	if !ok {
+		lock = &fileLock{}
+		fileLocks[fileName] = lock
+	}
+	lock.users++
+	fileLocksMutex.Unlock()
+	lock.Lock()
+}
+
+// Releases the lock acquired by lockFile.
+func unlockFile(fileName string) {
+	fileLocksMutex.Lock()
+	lock := fileLocks[fileName]
+	lock.users--
+	if lock.users == 0 {
+		delete(fileLocks, fileName)
+	}
+	fileLocksMutex.Unlock()
+	lock.Unlock()
+}
+
+// Checks whether the file name's extension passes the allow & deny lists. Matching is
+// case-insensitive, and a file without an extension is matched by a "." entry.
+func extensionAllowed(fileName string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))
+	if ext == "" {
+		ext = "."
+	}
+	if *allowedExtensions != "" && !extensionListed(*allowedExtensions, ext) {
+		return false
+	}
+	return !extensionListed(*deniedExtensions, ext)
+}
+
+// Checks whether the comma separated list of extensions contains the given one.
+func extensionListed(list string, ext string) bool {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "." {
+			entry = strings.TrimPrefix(entry, ".")
+		}
+		if entry == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether a store with the given idempotency token was completed recently.
+func seenToken(token string) bool {
+	recentTokensMutex.Lock()
+	defer recentTokensMutex.Unlock()
+	completedAt, ok := recentTokens[token]
+	return ok && time.Since(completedAt) < *tokenTTL
+}
+
+// Records the given idempotency token as completed and forgets the expired ones.
+func recordToken(token string) {
+	recentTokensMutex.Lock()
+	defer recentTokensMutex.Unlock()
+	for oldToken, completedAt := range recentTokens {
+		if time.Since(completedAt) >= *tokenTTL {
+			delete(recentTokens, oldToken)
+		}
+	}
+	recentTokens[token] = time.Now()
 }
 
 // Handles an UPDATE request by updating its successor & predecessor according to
-// the request. Does not reply back.
-// UPDATE <new succ addr> <new pred addr>
+// the request. Replies back with OK once the update is applied.
+// UPDATE <new succ addr> <new pred addr> => OK
 func handleUpdateRequest(conn net.Conn, reader *bufio.Reader, request string) {
 	tokens := strings.Split(request, " ")
 	// Get the new successor and predecessor addresses of this node.
 	newSuccAddr := tokens[1]
 	newPredAddr := tokens[2]
 	if newSuccAddr != "KEEP" {
-		// If the node claims that my new successor is myself, I am the only node left
-		// in the ring.
-		if newSuccAddr == self.Address {
-			successor = newNode()
-			predecessor = newNode()
-		} else {
-			successor.Address = newSuccAddr
-			successor.ID = hsh(successor.Address)
-		}
+		successor.Address = newSuccAddr
+		successor.ID = hsh(successor.Address)
 	}
 	if newPredAddr != "KEEP" {
-		// If the node claims that my new predecessor is myself, I am the only node left
-		// in the ring.
-		if newPredAddr == self.Address {
-			successor = newNode()
-			predecessor = newNode()
-		} else {
-			predecessor.Address = newPredAddr
-			predecessor.ID = hsh(predecessor.Address)
-		}
+		predecessor.Address = newPredAddr
+		predecessor.ID = hsh(predecessor.Address)
 	}
+	// If the node claims that my new successor or predecessor is myself, I am the
+	// only node left in the ring.
+	if successor.Address == self.Address || predecessor.Address == self.Address {
+		successor = newNode()
+		predecessor = newNode()
+	}
+	conn.Write([]byte("OK\n"))
 }
 
 // Handles and replies back to a JOIN request. The node that receives this request acts as
 // an initiator.
-// JOIN <new node addr> => <succ addr> <predec addr>
+// JOIN <new node addr> => <succ addr> <predec addr> | ERR <msg>
 func handleJoinRequest(conn net.Conn, reader *bufio.Reader, request string) {
 	tokens := strings.Split(request, " ")
 	// Get the address & id of the new node.
 	newNodeAddr := tokens[1]
 	newNodeID := hsh(newNodeAddr)
-	// If a node is trying to initiate itself, there is a problem. For now,
-	// close the connection and report the problem.
-	if self.ID == newNodeID {
+	rememberPeers(newNodeAddr)
+	// A node can not join through itself, let it pick another initiator.
+	if self.Address == newNodeAddr {
 		log.Println("Self-initiation is not allowed.")
-		conn.Close()
+		conn.Write([]byte("ERR Cannot join through self\n"))
 		return
 	}
-	// If this is the only node in the system, join through this node.
-	if successor.ID == -1 && predecessor.ID == -1 {
-		// Move the files.
-		moveFilesToNewNode(newNodeAddr, newNodeID)
-		// Send itself as the successor & predecessor of the new node
-		conn.Write([]byte(self.Address + " " + self.Address + "\n"))
-		successor.Address = newNodeAddr
-		successor.ID = newNodeID
-		predecessor.Address = newNodeAddr
-		predecessor.ID = newNodeID
+	// A node in nostore mode is not a part of the ring, pass the join on to the ring.
+	if *noStore {
+		if proxyEntry == "" {
+			conn.Write([]byte("ERR Not in a ring\n"))
+			return
+		}
+		newNodeSucc, newNodePred, err := sendJoinRequest(newNodeAddr, proxyEntry)
+		if err != nil {
+			log.Println("Could not route the join request:", err)
+			conn.Write([]byte(fmt.Sprintf("ERR Could not route the join request: %v\n", err)))
+			return
+		}
+		conn.Write([]byte(newNodeSucc + " " + newNodePred + "\n"))
 		return
 	}
-	// Find the successor for the new node.
-	newNodeSuccessorAddr := findSuccessor(newNodeID)
-	// If this is the successor of the new node, join through this node.
-	if newNodeSuccessorAddr == self.Address {
-		// The new node's successor is this node and the new node's predecessor
-		// is this node's old predecessor.
-		conn.Write([]byte(self.Address + " " + predecessor.Address + "\n"))
-		// Tell this node's predecessor to update its successor.
-		sendUpdateRequest(newNodeAddr, "KEEP", predecessor.Address)
-		// Move the files.
-		moveFilesToNewNode(newNodeAddr, newNodeID)
-		// Update this node's predecessor.
-		predecessor.Address = newNodeAddr
-		predecessor.ID = newNodeID
+	newNodeSuccessorAddr, placed := placeNewNode(conn, newNodeAddr, newNodeID)
+	if placed {
 		return
 	}
 	// If this is not the successor of the new node, route the join request to
 	// the new node's successor.
-	newNodeSucc, newNodePred := sendJoinRequest(newNodeAddr, newNodeSuccessorAddr)
+	newNodeSucc, newNodePred, err := sendJoinRequest(newNodeAddr, newNodeSuccessorAddr)
+	if err != nil {
+		log.Println("Could not route the join request:", err)
+		conn.Write([]byte(fmt.Sprintf("ERR Could not route the join request: %v\n", err)))
+		return
+	}
 	// Route the answer back to the new node.
 	conn.Write([]byte(newNodeSucc + " " + newNodePred + "\n"))
 }
 
+// Serializes the joins placed by this node, see placeNewNode.
+var joinMutex sync.Mutex
+
+// Links the new node into the ring if it goes right before or after this node, and
+// replies back to its join request. Otherwise, returns the address of the successor of
+// the new node, which should place it instead. The joins are placed one at a time, so
+// that two new nodes that go into the same gap do not both link to the same neighbors,
+// leaving one of them out of the ring.
+func placeNewNode(conn net.Conn, newNodeAddr string, newNodeID int) (string, bool) {
+	joinMutex.Lock()
+	defer joinMutex.Unlock()
+	// If this is the only node in the system, join through this node.
+	if successor.ID == -1 && predecessor.ID == -1 {
+		err := moveFilesToNewNode(newNodeAddr, newNodeID, func() {
+			// Send itself as the successor & predecessor of the new node.
+			conn.Write([]byte(self.Address + " " + self.Address + "\n"))
+			successor.Address = newNodeAddr
+			successor.ID = newNodeID
+			predecessor.Address = newNodeAddr
+			predecessor.ID = newNodeID
+		})
+		if err != nil {
+			rejectJoin(conn, newNodeAddr, err)
+		}
+		return "", true
+	}
+	// Find the successor for the new node.
+	newNodeSuccessorAddr := findSuccessor(newNodeID)
+	// If the new node has the same id as this node but a higher address, it goes
+	// after this node, which keeps owning the keys up to the id.
+	if newNodeSuccessorAddr == self.Address && newNodeID == self.ID && newNodeAddr > self.Address {
+		err := insertAfterSelf(conn, newNodeAddr, newNodeID)
+		if err != nil {
+			log.Println("Could not place the colliding node:", err)
+			conn.Write([]byte(fmt.Sprintf("ERR Could not place the node: %v\n", err)))
+		}
+		return "", true
+	}
+	// If this is the successor of the new node, join through this node.
+	if newNodeSuccessorAddr == self.Address {
+		err := moveFilesToNewNode(newNodeAddr, newNodeID, func() {
+			// The new node's successor is this node and the new node's predecessor
+			// is this node's old predecessor.
+			conn.Write([]byte(self.Address + " " + predecessor.Address + "\n"))
+			// Tell this node's predecessor to update its successor.
+			sendUpdateRequest(newNodeAddr, "KEEP", predecessor.Address)
+			// Update this node's predecessor.
+			predecessor.Address = newNodeAddr
+			predecessor.ID = newNodeID
+		})
+		if err != nil {
+			rejectJoin(conn, newNodeAddr, err)
+		}
+		return "", true
+	}
+	return newNodeSuccessorAddr, false
+}
+
 // Handles and replies back to a SUCC request.
-// SUCC <id> => <succ addr>
+// SUCC <id> [<hops left>] => <succ addr> | NEXT <next hop addr> | ERR <msg>
 func handleSuccessorRequest(conn net.Conn, reader *bufio.Reader, request string) {
 	tokens := strings.Split(request, " ")
+	if len(tokens) < 2 {
+		conn.Write([]byte("ERR Malformed successor request.\n"))
+		return
+	}
 	// Get the requested id.
 	id, err := strconv.Atoi(tokens[1])
 	if err != nil {
-		log.Println("Could not handle successor request")
-		log.Fatalln(err)
+		conn.Write([]byte("ERR Invalid id\n"))
+		return
+	}
+	// Get the number of hops that the lookup can still take. Requesters that do not
+	// send it get the full budget.
+	hopsLeft := *maxHops
+	if len(tokens) > 2 {
+		hopsLeft, err = strconv.Atoi(tokens[2])
+		if err != nil {
+			conn.Write([]byte("ERR Invalid hop limit\n"))
+			return
+		}
+	}
+	if hopsLeft <= 0 {
+		log.Println("Dropped the lookup of", id, "after", *maxHops, "hops.")
+		conn.Write([]byte("ERR Hop limit exceeded\n"))
+		return
+	}
+	if *maxHops-hopsLeft == *warnHops {
+		log.Println("Warning: the lookup of", id, "has taken", *warnHops, "hops, the routing might be degraded.")
+	}
+	if *noStore && proxyEntry == "" {
+		conn.Write([]byte("ERR Not ready, retry\n"))
+		return
+	}
+	// In iterative mode, only answer if the successor is known locally. Otherwise, let
+	// the requester ask the next hop itself.
+	if *lookupMode == "iterative" {
+		answer, found := localSuccessor(id)
+		if !found {
+			answer = "NEXT " + nextHop()
+		}
+		conn.Write([]byte(answer + "\n"))
+		return
 	}
 	// Find the successor.
-	answer := findSuccessor(id)
+	answer := findSuccessorWithin(id, hopsLeft-1)
 	// Send back the successor.
 	conn.Write([]byte(answer + "\n"))
 }
 
-// Checks through the files that are owned by this node and for the files
-// that should be moved to the new node, moves them.
-func moveFilesToNewNode(newNodeAddr string, newNodeID int) {
+// Places a new node with the same id as this node, but a higher address, into the ring.
+// The nodes with the same id follow each other in the order of their addresses, so the
+// new node goes after the last of them with a lower address. It owns no keys, so no
+// files are moved to it.
+func insertAfterSelf(conn net.Conn, newNodeAddr string, newNodeID int) error {
+	predAddr := self.Address
+	succAddr := successor.Address
+	for succAddr != self.Address && hsh(succAddr) == newNodeID && succAddr < newNodeAddr {
+		nextAddr, err := askForSuccessorOf(succAddr)
+		if err != nil {
+			return err
+		}
+		predAddr = succAddr
+		succAddr = nextAddr
+	}
+	conn.Write([]byte(succAddr + " " + predAddr + "\n"))
+	// Tell the new node's neighbors to update their links.
+	if succAddr == self.Address {
+		predecessor.Address = newNodeAddr
+		predecessor.ID = newNodeID
+	} else {
+		sendUpdateRequest("KEEP", newNodeAddr, succAddr)
+	}
+	if predAddr == self.Address {
+		successor.Address = newNodeAddr
+		successor.ID = newNodeID
+	} else {
+		sendUpdateRequest(newNodeAddr, "KEEP", predAddr)
+	}
+	return nil
+}
+
+// Returns the address of the successor of the node at the given address.
+// NODEINFO => OK <pred addr> <succ addr>
+func askForSuccessorOf(peerAddr string) (string, error) {
+	conn, reader, err := dialPeer(peerAddr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.Write([]byte("NODEINFO\n"))
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	tokens := strings.Split(strings.TrimSpace(answer), " ")
+	if len(tokens) != 3 || tokens[0] != "OK" || tokens[2] == "NONE" {
+		return "", fmt.Errorf("malformed node info from %s: %q", peerAddr, strings.TrimSpace(answer))
+	}
+	return tokens[2], nil
+}
+
+// Replies back to a join that could not be placed.
+func rejectJoin(conn net.Conn, newNodeAddr string, err error) {
+	log.Println("Rejected the join of", newNodeAddr+":", err)
+	conn.Write([]byte(fmt.Sprintf("ERR Could not move the files to the new node: %v\n", err)))
+}
+
+// Moves the files that the new node owns to it, then calls link to link it into the
+// ring. The new node verifies each file against its checksum, and the files are only
+// removed from this node once all of them are copied. If a file can not be copied,
+// even after another try, none are removed and link is not called, so that the join
+// can be rejected with this node still holding every file of its range.
+func moveFilesToNewNode(newNodeAddr string, newNodeID int, link func()) error {
 	// Acquire the list of files that need to be transferred to the new node.
 	toTransfer := []string{}
-	for fileName, fileKey := range storedFiles {
-		if between(newNodeID, fileKey, self.ID) {
+	storedFilesMutex.Lock()
+	for fileName, file := range storedFiles {
+		if ownsKey(newNodeID, newNodeAddr, self.ID, self.Address, file.Key) {
 			continue
 		}
 		toTransfer = append(toTransfer, fileName)
 	}
+	storedFilesMutex.Unlock()
+	// Do not let a store or a delete of the files slip in until they are moved. The
+	// locks are taken in order, like the ones of a transaction.
+	sort.Strings(toTransfer)
+	for _, fileName := range toTransfer {
+		lockFile(fileName)
+		defer unlockFile(fileName)
+	}
+	// Try the files that could not be copied once more, after the rest.
+	failed := copyFiles(toTransfer, newNodeAddr)
+	if len(failed) > 0 {
+		failed = copyFiles(failed, newNodeAddr)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not copy %s", strings.Join(failed, ", "))
+	}
+	link()
+	// The new node has every file now, remove them from this node.
+	storedFilesMutex.Lock()
 	for _, fileName := range toTransfer {
-		// Store the file in the new peer.
-		storeFile(fileName, newNodeAddr)
-		// Remove the file from this peer.
+		if _, ok := storedFiles[fileName]; !ok {
+			continue
+		}
 		os.Remove(filePath(fileName))
 		delete(storedFiles, fileName)
+		logIndexChange(fileName)
 	}
+	storedFilesMutex.Unlock()
+	for _, fileName := range toTransfer {
+		readCache.invalidate(fileName)
+	}
+	// The subscribers of the keys that the new node owns now, whether the files exist
+	// or not, follow the keys.
+	subscribersMutex.Lock()
+	moved := []string{}
+	for fileName := range subscribers {
+		if !ownsKey(newNodeID, newNodeAddr, self.ID, self.Address, hsh(fileName)) {
+			moved = append(moved, fileName)
+		}
+	}
+	subscribersMutex.Unlock()
+	handOffSubscribers(moved...)
+	return nil
+}
+
+// Copies the given files to the given peer, which verifies & stores each of them.
+// Returns the files that could not be copied. The files deleted in the meantime are
+// skipped.
+func copyFiles(fileNames []string, peerAddr string) []string {
+	failed := []string{}
+	for _, fileName := range fileNames {
+		storedFilesMutex.Lock()
+		_, ok := storedFiles[fileName]
+		storedFilesMutex.Unlock()
+		if !ok {
+			continue
+		}
+		err := storeFile(fileName, peerAddr)
+		if err != nil {
+			log.Println("Could not copy", fileName, "to", peerAddr+":", err)
+			failed = append(failed, fileName)
+		}
+	}
+	return failed
 }
 
 // Stores the given file to the given peer.
-func storeFile(fileName string, peerAddr string) {
-	conn, reader := connectToPeer(peerAddr)
-	defer conn.Close()
+func storeFile(fileName string, peerAddr string) error {
 	srcFile, err := os.Open(filePath(fileName))
+	if err != nil {
+		return err
+	}
 	defer srcFile.Close()
+	conn, reader, err := dialPeer(peerAddr)
 	if err != nil {
-		log.Println("Could not send store request")
-		log.Fatalln(err)
+		return err
 	}
+	defer conn.Close()
 	fileInfo, _ := srcFile.Stat()
 	fileSize := fileInfo.Size()
-	// Send the store request.
-	storeRequest := fmt.Sprintf("STORE %s %d\n", fileName, fileSize)
-	conn.Write([]byte(storeRequest))
+	// Compute the checksum, so that the peer can verify what it receives.
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, srcFile)
+	if err != nil {
+		return err
+	}
+	srcFile.Seek(0, io.SeekStart)
+	// Send the store request, carrying over the remaining lifetime & the pin of the file.
+	storeRequest := fmt.Sprintf("STORE %s %d sum=%s", fileName, fileSize, hex.EncodeToString(hasher.Sum(nil)))
+	storedFilesMutex.Lock()
+	file := storedFiles[fileName]
+	storedFilesMutex.Unlock()
+	// The expiry of a pinned file does not matter, and may have already passed.
+	if !file.Pinned && !file.Expiry.IsZero() {
+		ttl := int(time.Until(file.Expiry).Seconds()) + 1
+		storeRequest += fmt.Sprintf(" ttl=%d", ttl)
+	}
+	if file.Pinned {
+		storeRequest += " pin=true"
+	}
+	conn.Write([]byte(storeRequest + "\n"))
 	// Read the response.
-	serverResponse, _ := reader.ReadString('\n')
+	serverResponse, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
 	respType, respMsg := extractServerResponse(serverResponse)
 	// Response: ERR <error msg>
 	if respType != "OK" {
-		fmt.Println(respType, respMsg)
-		return
+		return errors.New(respMsg)
 	}
 	// Response: OK
-	io.Copy(conn, srcFile)
-	// No error checking for now...
+	t := startTransfer(conn, fileName, "out", fileSize)
+	defer t.end()
+	_, err = sendFile(conn, srcFile, t)
+	if err != nil {
+		return err
+	}
+	// Wait until the file is stored.
+	serverResponse, err = reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	respType, respMsg = extractServerResponse(serverResponse)
+	if respType != "OK" {
+		return errors.New(respMsg)
+	}
+	return nil
 }
 
 // Constructs an update request with the given new successor and new predecessor addresses
 // for the target peer. Set to `KEEP` if no change should be made to either of them.
-// UPDATE <new succ addr> <new pred addr>
+// Waits until the target peer applies the update, and logs it if the update could not
+// be delivered.
+// UPDATE <new succ addr> <new pred addr> => OK
 func sendUpdateRequest(newSuccAddr string, newPredAddr string, peerAddr string) {
 	// Initiate a connection with the given peer address.
-	conn, _ := connectToPeer(peerAddr)
+	conn, reader, err := dialNeighbor(peerAddr)
+	if err != nil {
+		log.Println("Could not send the update to", peerAddr+":", err)
+		return
+	}
 	defer conn.Close()
 	// Send the successor request.
 	succRequest := fmt.Sprintf("UPDATE %s %s\n", newSuccAddr, newPredAddr)
 	conn.Write([]byte(succRequest))
+	// Wait for the acknowledgement.
+	_, err = reader.ReadString('\n')
+	if err != nil {
+		log.Println("Could not get the update acknowledgement.")
+		log.Println(err)
+	}
 }
 
 // Constructs a successor request with the given id and sends it to the given address.
-// Returns the answer to the request (i.e. the address of the successor).
-// SUCC <id> => <succ addr>
-func sendSuccessorRequest(id int, peerAddr string) string {
+// Returns the answer to the request (i.e. the address of the successor, or the next
+// hop if the peer is in iterative mode).
+// The lookup is dropped once it has taken the given number of hops. If the peer can
+// not be reached, the answer is an `ERR` line like the ones of the peers.
+// SUCC <id> <hops left> => <succ addr> | NEXT <next hop addr> | ERR <msg>
+func sendSuccessorRequest(id int, hopsLeft int, peerAddr string) string {
 	// Initiate a connection with the given peer address.
-	conn, reader := connectToPeer(peerAddr)
+	conn, reader, err := dialPeer(peerAddr)
+	if err != nil {
+		log.Println("Could not forward the lookup of", id, "to", peerAddr+":", err)
+		return "ERR Could not reach " + strings.TrimSpace(peerAddr)
+	}
 	defer conn.Close()
 	// Send the successor request.
-	succRequest := fmt.Sprintf("SUCC %d\n", id)
+	succRequest := fmt.Sprintf("SUCC %d %d\n", id, hopsLeft)
 	conn.Write([]byte(succRequest))
 	// Wait for an answer.
 	answer, err := reader.ReadString('\n')
 	if err != nil {
-		log.Println("Could not get the successor.")
-		log.Fatalln(err)
+		log.Println("Could not get the successor of", id, "from", peerAddr+":", err)
+		return "ERR No answer from " + strings.TrimSpace(peerAddr)
 	}
 	// The answer will only contain the address of the successor.
-	return answer
+	return strings.TrimSpace(answer)
 }
 
 // Constructs a join request with the new peer's id and sends it to the given initiator address.
-// Returns the answer to the request (i.e. the successor & predecessor address of the new peer).
-// JOIN <newNodeAddress> => <succ addr> <predec addr>
-func sendJoinRequest(newNodeAddress string, address string) (string, string) {
+// Returns the answer to the request (i.e. the successor & predecessor address of the new peer),
+// or an error if the initiator rejects the join or there is no well-formed answer.
+// JOIN <newNodeAddress> => <succ addr> <predec addr> | ERR <msg>
+func sendJoinRequest(newNodeAddress string, address string) (string, string, error) {
 	// Initiate a connection with the given initiator.
-	conn, reader := connectToPeer(address)
+	conn, reader, err := dialPeer(address)
+	if err != nil {
+		return "", "", err
+	}
 	defer conn.Close()
+	// The answer only comes once the files of the new node are moved to it.
+	if dc, ok := conn.(*deadlineConn); ok {
+		dc.timeout = *joinTimeout
+	}
 	// Send the join request.
 	conn.Write([]byte("JOIN " + newNodeAddress + "\n"))
 	// Wait for an answer.
 	answer, err := reader.ReadString('\n')
 	if err != nil {
-		log.Println("Could not get the join answer.")
-		log.Fatalln(err)
+		return "", "", fmt.Errorf("no answer from the initiator: %w", err)
+	}
+	// The initiator rejected the join.
+	if strings.HasPrefix(answer, "ERR ") {
+		return "", "", fmt.Errorf("rejected by the initiator: %s", strings.TrimSpace(strings.TrimPrefix(answer, "ERR ")))
 	}
 	// Return the successor and predecessor.
 	tokens := strings.Split(strings.TrimSpace(answer), " ")
-	return tokens[0], tokens[1]
+	if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+		return "", "", fmt.Errorf("malformed answer from the initiator: %q", strings.TrimSpace(answer))
+	}
+	return tokens[0], tokens[1], nil
 }
 
 // Returns the address of the successor of the given id (node or file).
 func findSuccessor(id int) string {
+	return findSuccessorWithin(id, *maxHops)
+}
+
+// Returns the address of the successor of the given id, giving up once the lookup
+// has taken the given number of hops.
+func findSuccessorWithin(id int, hopsLeft int) string {
+	// A node in nostore mode owns no keys, it only passes the lookups on to the ring.
+	if *noStore {
+		return lookupSuccessor(id, hopsLeft, proxyEntry)
+	}
+	if answer, found := localSuccessor(id); found {
+		return answer
+	}
+	// Otherwise, ask to this node's successor.
+	answer := lookupSuccessor(id, hopsLeft, successor.Address)
+	// The successor might have changed while the request was in flight (e.g. due to a
+	// concurrent join), which can result in a wrong answer. If so, retry once through
+	// the current successor.
+	if !plausibleSuccessor(answer, id) {
+		log.Println("Received an implausible successor", answer, "for", id, "retrying.")
+		answer = lookupSuccessor(id, hopsLeft, successor.Address)
+	}
+	return answer
+}
+
+// Returns the address of the successor of the given id if it can be determined
+// without asking another node.
+func localSuccessor(id int) (string, bool) {
+	if *noStore {
+		return "", false
+	}
 	// If I am the only node in the ring, I am the successor of every id.
 	if predecessor.ID == -1 && successor.ID == -1 {
-		return self.Address
+		return self.Address, true
 	}
 	// If the id is between predecessor's id and this node's id, this node is the successor.
-	if between(predecessor.ID, id, self.ID) || id == self.ID {
-		return self.Address
+	if ownsKey(predecessor.ID, predecessor.Address, self.ID, self.Address, id) {
+		return self.Address, true
 	}
 	// If the id is between this node's id and successor's id, my successor is the successor.
-	if between(self.ID, id, successor.ID) || id == successor.ID {
-		return successor.Address
+	if ownsKey(self.ID, self.Address, successor.ID, successor.Address, id) {
+		return successor.Address, true
 	}
-	// Otherwise, ask to this node's successor.
-	return sendSuccessorRequest(id, successor.Address)
+	return "", false
+}
+
+// Checks whether this node owns the key of the given file.
+func ownsFile(fileName string) bool {
+	answer, found := localSuccessor(hsh(fileName))
+	return found && answer == self.Address
+}
+
+// Returns the number of hops after which a lookup is dropped by default. A lookup with
+// finger tables would take about log2(capacity) hops, so taking twice that means that
+// the routing is broken. The lookups walk the ring one successor at a time though, so
+// the rings with more peers than that need a higher limit.
+func defaultMaxHops(capacity uint32) int {
+	return 2 * bits.Len32(capacity)
+}
+
+// Returns the number of hops after which a lookup is logged as slow by default, which
+// is 2*log2(capacity), or 3/4 of the hop limit if that is lower. The warning has to
+// come before the lookup is dropped, so that degraded routing is noticed in time.
+func defaultWarnHops(capacity uint32, maxHops int) int {
+	warn := 2 * bits.Len32(capacity)
+	if warn >= maxHops {
+		warn = maxHops * 3 / 4
+	}
+	return warn
+}
+
+// Returns the address of the peer to pass on the lookups that this node can not answer.
+func nextHop() string {
+	if *noStore {
+		return proxyEntry
+	}
+	return successor.Address
+}
+
+// Asks the given peer for the successor of the given id. If the peer is in iterative
+// mode and replies with the next hop instead, asks that hop, and so on.
+func lookupSuccessor(id int, hopsLeft int, peerAddr string) string {
+	answer := sendSuccessorRequest(id, hopsLeft, peerAddr)
+	for strings.HasPrefix(answer, "NEXT ") {
+		hopsLeft--
+		if hopsLeft <= 0 {
+			log.Println("Gave up the lookup of", id, "after", *maxHops, "hops.")
+			return "ERR Hop limit exceeded"
+		}
+		answer = sendSuccessorRequest(id, hopsLeft, strings.TrimPrefix(answer, "NEXT "))
+	}
+	return answer
+}
+
+// Checks whether the node at the given address can be the successor of the given id
+// that is not owned by this node, i.e. it lies in [id, self) on the ring.
+func plausibleSuccessor(address string, id int) bool {
+	if address == "" || address == self.Address {
+		return false
+	}
+	addressID := hsh(address)
+	return addressID == id || between(id, addressID, self.ID)
+}
+
+// The most known peer addresses to remember, and the most to send in a PEERS reply.
+const maxKnownPeers = 16
+const peersSampleSize = 5
+
+// The addresses of the other peers that this peer has heard of, mapped to when they
+// were last heard of. They can be used as backup initiators.
+var knownPeers = make(map[string]time.Time)
+var knownPeersMutex sync.Mutex
+
+// Remembers the given peer addresses, forgetting the least recently heard of ones
+// beyond the limit.
+func rememberPeers(addresses ...string) {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+	for _, address := range addresses {
+		if address == "" || address == "NONE" || address == self.Address {
+			continue
+		}
+		knownPeers[address] = time.Now()
+	}
+	for len(knownPeers) > maxKnownPeers {
+		oldest := ""
+		for address, seen := range knownPeers {
+			if oldest == "" || seen.Before(knownPeers[oldest]) {
+				oldest = address
+			}
+		}
+		delete(knownPeers, oldest)
+	}
+}
+
+// Returns up to the given number of random known peer addresses.
+func samplePeers(count int) []string {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+	sample := []string{}
+	// Map iteration order is random.
+	for address := range knownPeers {
+		if len(sample) >= count {
+			break
+		}
+		sample = append(sample, address)
+	}
+	return sample
+}
+
+// Handles a `PEERS` request by remembering the requester and replying back with a
+// sample of the known peers, including this one.
+// PEERS [<requester addr>] => OK <addr> ...
+func handlePeersRequest(conn net.Conn, reader *bufio.Reader, request string) {
+	tokens := strings.Split(request, " ")
+	sample := append(samplePeers(peersSampleSize), self.Address)
+	if len(tokens) > 1 {
+		rememberPeers(tokens[1])
+	}
+	conn.Write([]byte("OK " + strings.Join(sample, " ") + "\n"))
+}
+
+// Periodically exchanges known peer addresses with a random known peer (or the
+// successor if none is known yet).
+func gossiper(interval time.Duration) {
+	for range time.Tick(interval) {
+		gossip()
+	}
+}
+
+// Exchanges known peer addresses with a random known peer once. A peer that can not
+// be reached is forgotten.
+func gossip() {
+	rememberPeers(successor.Address, predecessor.Address)
+	sample := samplePeers(1)
+	if len(sample) < 1 {
+		return
+	}
+	peerAddr := sample[0]
+	conn, reader, err := dialPeer(peerAddr)
+	if err != nil {
+		knownPeersMutex.Lock()
+		delete(knownPeers, peerAddr)
+		knownPeersMutex.Unlock()
+		return
+	}
+	conn.Write([]byte("PEERS " + self.Address + "\n"))
+	serverResponse, err := reader.ReadString('\n')
+	conn.Close()
+	respType, respMsg := extractServerResponse(serverResponse)
+	if err != nil || respType != "OK" {
+		return
+	}
+	rememberPeers(strings.Split(respMsg, " ")...)
+}
+
+// Returns the given initiator address if it can be reached. Otherwise, returns the
+// first known peer that can be reached instead, or the given address if there is none.
+func reachableInitiator(initiatorAddr string) string {
+	candidates := append([]string{initiatorAddr}, samplePeers(maxKnownPeers)...)
+	for _, address := range candidates {
+		conn, _, err := dialPeer(address)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		if address != initiatorAddr {
+			log.Println("Could not reach", initiatorAddr+", joining through", address, "instead.")
+		}
+		return address
+	}
+	return initiatorAddr
+}
+
+// Periodically removes the expired files from the local storage.
+func expirySweeper(interval time.Duration) {
+	for range time.Tick(interval) {
+		removeExpiredFiles()
+	}
+}
+
+// Removes the files that have passed their expiry from the index and the disk.
+func removeExpiredFiles() {
+	// Remove the expired files from the index.
+	expiredFiles := []string{}
+	storedFilesMutex.Lock()
+	for fileName, file := range storedFiles {
+		if file.expired() {
+			expiredFiles = append(expiredFiles, fileName)
+			delete(storedFiles, fileName)
+			logIndexChange(fileName)
+		}
+	}
+	storedFilesMutex.Unlock()
+	// Remove the expired files from the disk.
+	for _, fileName := range expiredFiles {
+		readCache.invalidate(fileName)
+		os.Remove(filePath(fileName))
+		notifySubscribers(fileName, fmt.Sprintf("CHANGED %s NONE\n", fileName))
+		log.Println("Removed the expired file", fileName)
+	}
+}
+
+// Periodically reads every stored file and compares it to the checksum recorded when
+// it was stored. A file that no longer matches is marked as corrupt and is not served
+// anymore until it is stored again. A file without a checksum gets the one of its
+// current contents.
+func scrubber(interval time.Duration) {
+	for range time.Tick(interval) {
+		storedFilesMutex.Lock()
+		fileNames := make([]string, 0, len(storedFiles))
+		for fileName, file := range storedFiles {
+			if !file.Corrupt {
+				fileNames = append(fileNames, fileName)
+			}
+		}
+		storedFilesMutex.Unlock()
+		for _, fileName := range fileNames {
+			scrubFile(fileName)
+		}
+	}
+}
+
+// Checks a single stored file against its checksum, see scrubber.
+func scrubFile(fileName string) {
+	// Hold back the stores of the file, so that its contents do not change midway.
+	lockFile(fileName)
+	defer unlockFile(fileName)
+	srcFile, err := os.Open(filePath(fileName))
+	if err != nil {
+		// The file has been moved or removed in the meantime.
+		return
+	}
+	defer srcFile.Close()
+	hasher := sha256.New()
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := srcFile.Read(buffer)
+		hasher.Write(buffer[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println("Could not scrub", fileName+":", err)
+			return
+		}
+		// Spread the reads out to keep the I/O of the scrub within the rate.
+		if *scrubRate > 0 {
+			time.Sleep(time.Duration(int64(n) * int64(time.Second) / *scrubRate))
+		}
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	storedFilesMutex.Lock()
+	defer storedFilesMutex.Unlock()
+	file, ok := storedFiles[fileName]
+	if !ok || file.Sum == sum {
+		return
+	}
+	if file.Sum == "" {
+		file.Sum = sum
+	} else {
+		log.Println("The contents of", fileName, "do not match its checksum, marked it as corrupt.")
+		file.Corrupt = true
+		readCache.invalidate(fileName)
+	}
+	storedFiles[fileName] = file
+	logIndexChange(fileName)
 }
 
 // Joins a ring from the given initiator address.
-func joinRing(initiatorAddress string) {
+func joinRing(initiatorAddress string) error {
+	// Hold back the joins through this node until it is linked into the ring.
+	joinMutex.Lock()
+	defer joinMutex.Unlock()
+	// With different parameters, the peers would not agree on the ids & keys.
+	err := checkRingParams(initiatorAddress)
+	if err != nil {
+		return err
+	}
+	// The files kept from the previous run may have changed in the ring since, and the
+	// successor sends the current versions of the ones in this peer's range before it
+	// answers the join.
+	storedFilesMutex.Lock()
+	keptFiles := make(map[string]bool)
+	heldFiles = make(map[string]bool)
+	for fileName := range storedFiles {
+		keptFiles[fileName] = true
+		heldFiles[fileName] = true
+	}
+	heldUntil = time.Now().Add(*joinTimeout + *reclaimCooldown)
+	storedFilesMutex.Unlock()
 	// Send a join request to the initiator.
-	successorAddr, predecessorAddr := sendJoinRequest(self.Address, initiatorAddress)
+	successorAddr, predecessorAddr, err := sendJoinRequest(self.Address, initiatorAddress)
+	if err != nil {
+		// The successor keeps its files when the join fails, drop the copies received.
+		storedFilesMutex.Lock()
+		for fileName := range storedFiles {
+			if keptFiles[fileName] {
+				continue
+			}
+			os.Remove(filePath(fileName))
+			delete(storedFiles, fileName)
+			logIndexChange(fileName)
+		}
+		heldFiles = make(map[string]bool)
+		storedFilesMutex.Unlock()
+		return err
+	}
 	// Set the successor & predecessor.
 	successor.Address = successorAddr
 	successor.ID = hsh(successorAddr)
 	predecessor.Address = predecessorAddr
 	predecessor.ID = hsh(predecessorAddr)
+	rememberPeers(initiatorAddress, successorAddr, predecessorAddr)
+	storedFilesMutex.Lock()
+	heldUntil = time.Now().Add(*reclaimCooldown)
+	storedFilesMutex.Unlock()
+	return nil
 }
 
-func leaveRing() {
+// Leaves the ring after handing the files over to the successor. If any of the files
+// can not be handed over, the leave is aborted, and the node stays in the ring with
+// all of its files.
+func leaveRing() error {
+	// A node in nostore mode only has to stop routing through the ring.
+	if *noStore {
+		proxyEntry = ""
+		return nil
+	}
 	// You can't leave a ring if there's no ring!
 	if successor.ID == -1 || predecessor.ID == -1 {
-		return
+		return nil
+	}
+	// Transfer the files to the successor while this node still serves them.
+	storedFilesMutex.Lock()
+	fileNames := []string{}
+	for fileName := range storedFiles {
+		fileNames = append(fileNames, fileName)
+	}
+	storedFilesMutex.Unlock()
+	for _, fileName := range fileNames {
+		err := storeFile(fileName, successor.Address)
+		if err != nil {
+			return fmt.Errorf("could not hand %s over to the successor: %w", fileName, err)
+		}
 	}
-	// Update this node's successor's predecessor.
+	// Update this node's successor's predecessor. In a two-node ring, the successor
+	// and the predecessor are the same node, which becomes the only node in the ring
+	// with either of the updates. Each update is acknowledged before the next one
+	// is sent, so they are applied in order.
 	sendUpdateRequest("KEEP", predecessor.Address, successor.Address)
 	// Update this node's predecessor's successor.
 	sendUpdateRequest(successor.Address, "KEEP", predecessor.Address)
-	// Transfer the files to the successor.
-	for fileName := range storedFiles {
-		storeFile(fileName, successor.Address)
+	// The successor owns all of the keys now.
+	subscribersMutex.Lock()
+	subscribed := []string{}
+	for fileName := range subscribers {
+		subscribed = append(subscribed, fileName)
 	}
-	// Remove the peer directory.
-	os.RemoveAll(fmt.Sprintf("%d", self.ID))
+	subscribersMutex.Unlock()
+	handOffSubscribers(subscribed...)
+	discardFiles()
 	successor = newNode()
 	predecessor = newNode()
+	return nil
+}
+
+// Removes all of the files stored on this peer along with the peer directory.
+func discardFiles() {
+	storedFilesMutex.Lock()
+	for fileName := range storedFiles {
+		readCache.invalidate(fileName)
+	}
+	storedFiles = make(map[string]storedFile)
+	snapshotIndex()
+	storedFilesMutex.Unlock()
+	os.RemoveAll(fmt.Sprintf("%d", self.ID))
+}
+
+// Adds the files left in the peer directory by a previous run to the stored files.
+// Their expiry times & pins are recovered from the persisted index if there is one,
+// otherwise they never expire.
+func loadStoredFiles() {
+	recovered := recoverIndex()
+	entries, err := os.ReadDir(fmt.Sprintf("%d", self.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	storedFilesMutex.Lock()
+	defer storedFilesMutex.Unlock()
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+		file := recovered[entry.Name()]
+		file.Key = hsh(entry.Name())
+		storedFiles[entry.Name()] = file
+	}
+	log.Println("Loaded", len(storedFiles), "files from the previous run.")
+	// Start the new run from a snapshot of what was loaded.
+	snapshotIndex()
+}
+
+// The log of the changes to the stored files since the last snapshot of the index.
+// Nil unless the index is persisted.
+var indexLog *os.File
+var indexLogEntries int
+
+// A single change in the index log. A nil file means that the file was removed.
+type indexChange struct {
+	Name string
+	File *storedFile `json:",omitempty"`
+}
+
+// Returns the paths of the index snapshot and the index log. They are kept next to
+// the peer directory, so that they are not mistaken for the stored files.
+func indexPaths() (string, string) {
+	return fmt.Sprintf("%d.index", self.ID), fmt.Sprintf("%d.log", self.ID)
+}
+
+// Appends the current state of the given file to the index log, and snapshots the
+// index once the log is long enough. Must be called while holding the stored files
+// mutex.
+func logIndexChange(fileName string) {
+	if indexLog == nil {
+		return
+	}
+	change := indexChange{Name: fileName}
+	if file, ok := storedFiles[fileName]; ok {
+		change.File = &file
+	}
+	entry, _ := json.Marshal(change)
+	_, err := indexLog.Write(append(entry, '\n'))
+	if err != nil {
+		log.Println("Could not log the index change:", err)
+	}
+	indexLogEntries++
+	if indexLogEntries >= *indexBatch {
+		snapshotIndex()
+	}
+}
+
+// Writes the stored files into the index snapshot and starts a new index log. Must be
+// called while holding the stored files mutex.
+func snapshotIndex() {
+	if !*keepData || *indexFlush <= 0 {
+		return
+	}
+	snapshotPath, logPath := indexPaths()
+	contents, _ := json.Marshal(storedFiles)
+	// Replace the snapshot at once, so that a crash leaves either the old or the new one.
+	err := os.WriteFile(snapshotPath+".tmp", contents, 0644)
+	if err == nil {
+		err = os.Rename(snapshotPath+".tmp", snapshotPath)
+	}
+	if err != nil {
+		log.Println("Could not snapshot the index:", err)
+		return
+	}
+	// The snapshot covers the logged changes, so the log can start over.
+	if indexLog != nil {
+		indexLog.Close()
+	}
+	indexLog, err = os.Create(logPath)
+	if err != nil {
+		log.Println("Could not create the index log:", err)
+		indexLog = nil
+	}
+	indexLogEntries = 0
+}
+
+// Periodically snapshots the index.
+func indexSnapshotter(interval time.Duration) {
+	for range time.Tick(interval) {
+		storedFilesMutex.Lock()
+		if indexLogEntries > 0 {
+			snapshotIndex()
+		}
+		storedFilesMutex.Unlock()
+	}
+}
+
+// Reads the index snapshot of the previous run and replays the index log over it.
+// A partially written last entry, left by a crash, is ignored.
+func recoverIndex() map[string]storedFile {
+	files := make(map[string]storedFile)
+	snapshotPath, logPath := indexPaths()
+	contents, err := os.ReadFile(snapshotPath)
+	if err == nil {
+		err = json.Unmarshal(contents, &files)
+		if err != nil {
+			log.Println("Could not read the index snapshot:", err)
+		}
+	}
+	logFile, err := os.Open(logPath)
+	if err != nil {
+		return files
+	}
+	defer logFile.Close()
+	replayed := 0
+	scanner := bufio.NewScanner(logFile)
+	for scanner.Scan() {
+		var change indexChange
+		if json.Unmarshal(scanner.Bytes(), &change) != nil {
+			break
+		}
+		if change.File == nil {
+			delete(files, change.Name)
+		} else {
+			files[change.Name] = *change.File
+		}
+		replayed++
+	}
+	log.Println("Replayed", replayed, "changes over the index snapshot.")
+	return files
+}
+
+// Rebuilds the stored files from the files in the peer directory. The files that
+// this peer does not own are moved to their owners, and the stored files without a
+// file on disk are dropped. The expiry times of the indexed files are kept.
+func reindexFiles() {
+	entries, err := os.ReadDir(fmt.Sprintf("%d", self.ID))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Could not read the peer directory:", err)
+		return
+	}
+	onDisk := make(map[string]bool)
+	misplaced := []string{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+		fileName := entry.Name()
+		onDisk[fileName] = true
+		if owner, found := localSuccessor(hsh(fileName)); !found || owner != self.Address {
+			misplaced = append(misplaced, fileName)
+		}
+	}
+	// Merge the scan into the live index rather than replacing it, so that the files
+	// stored or deleted while the directory was read are not lost. Whether a file is
+	// on disk is checked again under the lock, since the scan may already be stale.
+	changed := []string{}
+	storedFilesMutex.Lock()
+	for fileName := range onDisk {
+		if _, ok := storedFiles[fileName]; ok {
+			continue
+		}
+		if _, err := os.Stat(filePath(fileName)); err != nil {
+			continue
+		}
+		storedFiles[fileName] = storedFile{Key: hsh(fileName)}
+		logIndexChange(fileName)
+		changed = append(changed, fileName)
+	}
+	for fileName := range storedFiles {
+		if onDisk[fileName] {
+			continue
+		}
+		if _, err := os.Stat(filePath(fileName)); !os.IsNotExist(err) {
+			continue
+		}
+		delete(storedFiles, fileName)
+		logIndexChange(fileName)
+		changed = append(changed, fileName)
+	}
+	indexed := len(storedFiles)
+	snapshotIndex()
+	storedFilesMutex.Unlock()
+	for _, fileName := range changed {
+		readCache.invalidate(fileName)
+	}
+	log.Println("Indexed", indexed, "files,", len(misplaced), "of them belong to other peers.")
+	// Move the misplaced files to their owners.
+	for _, fileName := range misplaced {
+		ownerAddr := findSuccessor(hsh(fileName))
+		err := storeFile(fileName, ownerAddr)
+		if err != nil {
+			log.Println("Could not move", fileName, "to its owner:", err)
+			continue
+		}
+		os.Remove(filePath(fileName))
+		storedFilesMutex.Lock()
+		delete(storedFiles, fileName)
+		logIndexChange(fileName)
+		storedFilesMutex.Unlock()
+		log.Println("Moved", fileName, "to", ownerAddr)
+	}
+}
+
+// Prints the key of each of the given strings on its own line. If none are given, the
+// strings are read from the standard input, one per line.
+func printKeys(inputs []string) {
+	if len(inputs) > 0 {
+		for _, input := range inputs {
+			fmt.Println(hsh(input))
+		}
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fmt.Println(hsh(scanner.Text()))
+	}
 }
 
 func main() {
-	peerPort := os.Args[1]
+	flag.Parse()
+	// peer hash [<string>...] prints the keys of the strings and exits.
+	if flag.Arg(0) == "hash" {
+		printKeys(flag.Args()[1:])
+		return
+	}
+	if *lookupMode != "recursive" && *lookupMode != "iterative" {
+		log.Fatalln("Unknown lookup mode:", *lookupMode)
+	}
+	if strings.ContainsAny(*hashSeed, " \t\n") {
+		log.Fatalln("The hash seed can not contain whitespace.")
+	}
+	if *warnHops == 0 {
+		*warnHops = defaultWarnHops(ringCapacity, *maxHops)
+	}
+	peerPort := flag.Arg(0)
+	readCache = newFileCache(*cacheSize)
+	if *maxHandlers > 0 {
+		handlerSlots = make(chan struct{}, *maxHandlers)
+	}
+	if *maxTransfers > 0 {
+		transferSlots = make(chan struct{}, *maxTransfers)
+	}
 	// Start the server on the background.
 	go serverRunner(peerPort)
+	// Start removing the expired files on the background.
+	go expirySweeper(*sweepInterval)
+	// Start checking the stored files against their checksums on the background.
+	if *scrubInterval > 0 {
+		go scrubber(*scrubInterval)
+	}
+	// Start snapshotting the index on the background.
+	if *keepData && *indexFlush > 0 {
+		go indexSnapshotter(*indexFlush)
+	}
+	// Start exchanging the known peers on the background.
+	if *gossipInterval > 0 {
+		go gossiper(*gossipInterval)
+	}
 	// Show the main menu.
 	fmt.Println(mainMenu)
 	for {
@@ -497,8 +3566,22 @@ func main() {
 			fmt.Print("> Enter the initiator address: ")
 			var initiatorAddr string
 			fmt.Scanln(&initiatorAddr)
-			leaveRing()
-			joinRing(initiatorAddr)
+			err := leaveRing()
+			if err != nil {
+				fmt.Println("Could not leave the ring:", err)
+				continue
+			}
+			if *noStore {
+				proxyEntry = reachableInitiator(initiatorAddr)
+				rememberPeers(proxyEntry)
+				fmt.Println("Routing the lookups through", proxyEntry+".")
+				continue
+			}
+			err = joinRing(reachableInitiator(initiatorAddr))
+			if err != nil {
+				fmt.Println("Could not join the ring:", err)
+				continue
+			}
 			fmt.Println("Connected to the ring!")
 		case 2:
 			// Ask the key.
@@ -522,21 +3605,56 @@ func main() {
 		case 4:
 			// Output the neighbor and self ids.
 			fmt.Printf("(%d, %d, %d)\n", predecessor.ID, self.ID, successor.ID)
+			if paused.Load() {
+				fmt.Println("Paused, new connections are rejected.")
+			}
+			fmt.Println("Requests being handled:", activeHandlers.Load())
+			if *slowRequestThreshold > 0 {
+				fmt.Println("Slow requests:", slowRequests.Load())
+			}
 		case 5:
 			if len(storedFiles) < 1 {
 				fmt.Println("No files are stored!")
 			}
 			// Iterate through the storedFiles map and show each key, value pair.
-			for fileName, key := range storedFiles {
-				fmt.Println(fileName, "=>", key)
+			storedFilesMutex.Lock()
+			for fileName, file := range storedFiles {
+				if file.Pinned {
+					fmt.Println(fileName, "=>", file.Key, "(pinned)")
+				} else if file.Expiry.IsZero() {
+					fmt.Println(fileName, "=>", file.Key)
+				} else {
+					fmt.Println(fileName, "=>", file.Key, "(expires at", file.Expiry.Format(time.Stamp)+")")
+				}
 			}
+			storedFilesMutex.Unlock()
 		case 6:
 			fmt.Println(self.Address)
+			if knownPeers := samplePeers(maxKnownPeers); len(knownPeers) > 0 {
+				fmt.Println("Known peers:", strings.Join(knownPeers, " "))
+			}
 		case 7:
-			leaveRing()
+			err := leaveRing()
+			if err != nil {
+				fmt.Println("Could not leave the ring, keeping the files:", err)
+				continue
+			}
+			// A lone peer has no one to hand its files to.
+			if !*keepData {
+				discardFiles()
+			}
 			fmt.Println("Left the ring.")
 			fmt.Println("Goodbye!")
 			return
+		case 8:
+			paused.Store(true)
+			fmt.Println("Paused, new connections are rejected.")
+		case 9:
+			paused.Store(false)
+			fmt.Println("Resumed accepting connections.")
+		case 10:
+			reindexFiles()
+			fmt.Println("Rebuilt the file index.")
 		}
 	}
 }
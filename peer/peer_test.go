@@ -0,0 +1,2300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Sets up the state that main sets up before serving requests.
+func TestMain(m *testing.M) {
+	readCache = newFileCache(0)
+	os.Exit(m.Run())
+}
+
+func TestHshConcurrent(t *testing.T) {
+	names := make([]string, 200)
+	want := make([]int, len(names))
+	for i := range names {
+		names[i] = fmt.Sprintf("file-%d.txt", i)
+		want[i] = hsh(names[i])
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, name := range names {
+				if got := hsh(name); got != want[i] {
+					t.Errorf("hsh(%q) = %d, want %d", name, got, want[i])
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Runs the given handler on one end of a pipe, and returns the first line that it
+// replies with.
+func handle(t *testing.T, handler func(net.Conn, *bufio.Reader, string), request string) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		handler(server, bufio.NewReader(server), request)
+	}()
+	reply, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("%q: no reply: %v", request, err)
+	}
+	return strings.TrimSpace(reply)
+}
+
+func TestDeleteMalformed(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if reply := handle(t, handleDeleteRequest, "DELETE"); reply != "ERR Malformed delete request." {
+		t.Errorf("reply = %q", reply)
+	}
+}
+
+func TestDeleteMissingFileIsNotLogged(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logFile, err := os.Create("index.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexLog = logFile
+	defer func() { indexLog = nil; logFile.Close() }()
+	if reply := handle(t, handleDeleteRequest, "DELETE missing.txt"); reply != "ERR File does not exist." {
+		t.Errorf("reply = %q", reply)
+	}
+	info, _ := logFile.Stat()
+	if info.Size() != 0 {
+		t.Errorf("the index log has %d bytes, want none", info.Size())
+	}
+}
+
+func TestDefaultWarnHops(t *testing.T) {
+	cases := []struct {
+		capacity uint32
+		maxHops  int
+		want     int
+	}{
+		{127, 127, 14},
+		{1024, 1024, 22},
+		// The warning has to come before the lookup is dropped.
+		{127, 12, 9},
+	}
+	for _, c := range cases {
+		if got := defaultWarnHops(c.capacity, c.maxHops); got != c.want {
+			t.Errorf("defaultWarnHops(%d, %d) = %d, want %d", c.capacity, c.maxHops, got, c.want)
+		}
+	}
+}
+
+// Puts the given file into the local storage with the given information, and removes
+// it once the test is over.
+func storeLocally(t testing.TB, fileName string, contents string, file storedFile) {
+	t.Helper()
+	err := os.WriteFile(filePath(fileName), []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Key = hsh(fileName)
+	storedFilesMutex.Lock()
+	storedFiles[fileName] = file
+	storedFilesMutex.Unlock()
+	t.Cleanup(func() {
+		storedFilesMutex.Lock()
+		delete(storedFiles, fileName)
+		storedFilesMutex.Unlock()
+	})
+}
+
+func TestStatReportsRecordedChecksumAndPin(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// The recorded checksum is reported as is, without reading the file.
+	storeLocally(t, "a.txt", "hello", storedFile{Sum: "recorded", Pinned: true})
+	reply := handle(t, handleStatRequest, "STAT a.txt")
+	if !strings.HasPrefix(reply, "OK 5 ") || !strings.HasSuffix(reply, " recorded pinned=true") {
+		t.Errorf("reply = %q", reply)
+	}
+}
+
+func TestStatRecordsMissingChecksum(t *testing.T) {
+	t.Chdir(t.TempDir())
+	storeLocally(t, "b.txt", "hello", storedFile{})
+	const sum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	reply := handle(t, handleStatRequest, "STAT b.txt")
+	if !strings.HasSuffix(reply, " "+sum+" pinned=false") {
+		t.Errorf("reply = %q", reply)
+	}
+	storedFilesMutex.Lock()
+	recorded := storedFiles["b.txt"].Sum
+	storedFilesMutex.Unlock()
+	if recorded != sum {
+		t.Errorf("recorded checksum = %q, want %q", recorded, sum)
+	}
+}
+
+// Sends the given request to the node at the given address, and returns the reply.
+func request(t *testing.T, address string, line string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(line + "\n"))
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	return strings.TrimSpace(reply)
+}
+
+// Waits until no request is being handled, and returns false if it takes too long.
+func awaitIdleHandlers() bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if activeHandlers.Load() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Serves the connections accepted by the given listener like the node does, until the
+// test is over and the requests in flight are handled.
+func serveListener(t *testing.T, ls net.Listener) {
+	t.Cleanup(func() {
+		ls.Close()
+		awaitIdleHandlers()
+	})
+	go acceptRequests(ls)
+}
+
+func TestPauseRejectsNewConnections(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	storeLocally(t, "c.txt", "hello", storedFile{Sum: "recorded"})
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { paused.Store(false) })
+	serveListener(t, ls)
+	address := ls.Addr().String()
+	if reply := request(t, address, "PAUSE"); reply != "OK" {
+		t.Fatalf("PAUSE: reply = %q", reply)
+	}
+	for _, line := range []string{"STAT c.txt", "NODEINFO", "SUCC 5"} {
+		if reply := request(t, address, line); reply != "ERR Node paused" {
+			t.Errorf("%q while paused: reply = %q", line, reply)
+		}
+	}
+	if reply := request(t, address, "STATUS"); !strings.HasPrefix(reply, "OK state=paused ") {
+		t.Errorf("STATUS while paused: reply = %q", reply)
+	}
+	if reply := request(t, address, "RESUME"); reply != "OK" {
+		t.Fatalf("RESUME: reply = %q", reply)
+	}
+	if reply := request(t, address, "STAT c.txt"); !strings.HasPrefix(reply, "OK 5 ") {
+		t.Errorf("STAT after resume: reply = %q", reply)
+	}
+	if reply := request(t, address, "STATUS"); !strings.HasPrefix(reply, "OK state=serving ") {
+		t.Errorf("STATUS after resume: reply = %q", reply)
+	}
+}
+
+// Returns an address on which no one is listening.
+func deadAddress(t *testing.T) string {
+	t.Helper()
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ls.Addr().String()
+	ls.Close()
+	return address
+}
+
+func TestBreakerTripsAndCoolsDown(t *testing.T) {
+	defer func(cooldown time.Duration) { *breakerCooldown = cooldown }(*breakerCooldown)
+	*breakerCooldown = 200 * time.Millisecond
+	address := deadAddress(t)
+	for i := 0; i < *breakerFailures; i++ {
+		_, _, err := dialPeer(address)
+		if err == nil || errors.Is(err, errBreakerOpen) {
+			t.Fatalf("dial %d: err = %v, want a connection error", i+1, err)
+		}
+	}
+	_, _, err := dialPeer(address)
+	if !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("dial after %d failures: err = %v, want errBreakerOpen", *breakerFailures, err)
+	}
+	// A lookup through the unreachable peer fails instead of bringing the node down.
+	if answer := sendSuccessorRequest(5, 10, address); !strings.HasPrefix(answer, "ERR ") {
+		t.Errorf("lookup through an unreachable peer: answer = %q", answer)
+	}
+	// Once the peer is back & the cooldown is over, the peer is dialed again.
+	ls, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Skip("could not listen on the address again:", err)
+	}
+	defer ls.Close()
+	time.Sleep(*breakerCooldown)
+	conn, _, err := dialPeer(address)
+	if err != nil {
+		t.Fatalf("dial after the cooldown: %v", err)
+	}
+	conn.Close()
+	breakersMutex.Lock()
+	_, open := breakers[address]
+	breakersMutex.Unlock()
+	if open {
+		t.Error("the breaker is still counting failures after a successful dial")
+	}
+}
+
+func TestUpdatesIgnoreTheBreaker(t *testing.T) {
+	address := deadAddress(t)
+	for i := 0; i < *breakerFailures; i++ {
+		dialPeer(address)
+	}
+	ls, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Skip("could not listen on the address again:", err)
+	}
+	defer ls.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ls.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("OK\n"))
+		received <- strings.TrimSpace(line)
+	}()
+	// The breaker is still open, yet the update reaches the peer that is back.
+	sendUpdateRequest("KEEP", "127.0.0.1:1", address)
+	select {
+	case line := <-received:
+		if line != "UPDATE KEEP 127.0.0.1:1" {
+			t.Errorf("received %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Error("the update did not reach the peer")
+	}
+}
+
+// Runs a peer that stores the files sent to it, except for the one with the given
+// name, which it rejects. It applies any update, and rejects the joins routed to it.
+// Returns its address & the files that it has stored.
+func fakePeer(t *testing.T, reject string) (string, *sync.Map) {
+	t.Helper()
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ls.Close() })
+	stored := &sync.Map{}
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				line, _ := reader.ReadString('\n')
+				if strings.HasPrefix(line, "UPDATE ") {
+					conn.Write([]byte("OK\n"))
+					return
+				}
+				if strings.HasPrefix(line, "JOIN ") {
+					conn.Write([]byte("ERR Busy\n"))
+					return
+				}
+				var fileName string
+				var size int
+				fmt.Sscanf(line, "STORE %s %d", &fileName, &size)
+				if fileName == reject {
+					conn.Write([]byte("ERR No space left.\n"))
+					return
+				}
+				conn.Write([]byte("OK\n"))
+				contents := make([]byte, size)
+				_, err := io.ReadFull(reader, contents)
+				if err != nil {
+					return
+				}
+				// Storing a file takes a while, as it does on a real peer.
+				time.Sleep(10 * time.Millisecond)
+				stored.Store(fileName, string(contents))
+				conn.Write([]byte("OK\n"))
+			}()
+		}
+	}()
+	return ls.Addr().String(), stored
+}
+
+// Returns n file names with keys in (from, to).
+func namesInRange(n int, from int, to int) []string {
+	names := []string{}
+	for i := 0; len(names) < n; i++ {
+		name := fmt.Sprintf("file-%d.txt", i)
+		if between(from, hsh(name), to) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Places a new node with the given id through this lone node, and returns the answer
+// to its join once the node is placed.
+func placeLoneJoin(t *testing.T, newNodeAddr string, newNodeID int) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		defer server.Close()
+		placeNewNode(server, newNodeAddr, newNodeID)
+	}()
+	reply, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("no answer to the join: %v", err)
+	}
+	<-done
+	return strings.TrimSpace(reply)
+}
+
+// Checks whether the given file is in the index.
+func indexed(fileName string) bool {
+	storedFilesMutex.Lock()
+	defer storedFilesMutex.Unlock()
+	_, ok := storedFiles[fileName]
+	return ok
+}
+
+// Makes this node a lone node with the given id, and restores it along with the index
+// of the stored files once the test is over.
+func beLoneNode(t testing.TB, id int) {
+	t.Helper()
+	oldSelf, oldSuccessor, oldPredecessor := self, successor, predecessor
+	storedFilesMutex.Lock()
+	oldStoredFiles := maps.Clone(storedFiles)
+	storedFilesMutex.Unlock()
+	t.Cleanup(func() {
+		self, successor, predecessor = oldSelf, oldSuccessor, oldPredecessor
+		storedFilesMutex.Lock()
+		storedFiles = oldStoredFiles
+		storedFilesMutex.Unlock()
+	})
+	self = node{ID: id, Address: "127.0.0.1:1"}
+	successor = newNode()
+	predecessor = newNode()
+}
+
+func TestJoinRejectedWhenOneOfSeveralFilesFails(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	// The new node with id 100 owns the keys in (10, 100].
+	names := namesInRange(3, 10, 100)
+	for _, name := range names {
+		storeLocally(t, name, "contents of "+name, storedFile{})
+	}
+	newNodeAddr, _ := fakePeer(t, names[1])
+	reply := placeLoneJoin(t, newNodeAddr, 100)
+	if !strings.HasPrefix(reply, "ERR ") {
+		t.Fatalf("answer = %q, want the join rejected", reply)
+	}
+	if successor.ID != -1 || predecessor.ID != -1 {
+		t.Errorf("linked the new node: successor = %v, predecessor = %v", successor, predecessor)
+	}
+	// Every file is still served by this node.
+	for _, name := range names {
+		if !indexed(name) {
+			t.Errorf("%s is no longer in the index", name)
+		}
+		contents, err := os.ReadFile(filePath(name))
+		if err != nil || string(contents) != "contents of "+name {
+			t.Errorf("%s: contents = %q, err = %v", name, contents, err)
+		}
+	}
+}
+
+func TestJoinMovesTheFilesBeforeLinking(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	moving := namesInRange(3, 10, 100)
+	staying := namesInRange(2, 100, 10)
+	for _, name := range append(moving, staying...) {
+		storeLocally(t, name, "contents of "+name, storedFile{})
+	}
+	newNodeAddr, stored := fakePeer(t, "")
+	if reply := placeLoneJoin(t, newNodeAddr, 100); reply != self.Address+" "+self.Address {
+		t.Fatalf("answer = %q", reply)
+	}
+	if successor.Address != newNodeAddr || predecessor.Address != newNodeAddr {
+		t.Errorf("not linked: successor = %v, predecessor = %v", successor, predecessor)
+	}
+	for _, name := range moving {
+		if contents, ok := stored.Load(name); !ok || contents != "contents of "+name {
+			t.Errorf("%s: new node has %q", name, contents)
+		}
+		if indexed(name) {
+			t.Errorf("%s is still in the index", name)
+		}
+	}
+	for _, name := range staying {
+		if _, ok := stored.Load(name); ok {
+			t.Errorf("%s was moved", name)
+		}
+		if !indexed(name) {
+			t.Errorf("%s is no longer in the index", name)
+		}
+	}
+}
+
+// Runs the given handler on one end of a pipe, and returns the other end to talk to
+// it, along with a channel that is closed once the handler returns.
+func session(t testing.TB, handler func(net.Conn, *bufio.Reader, string), request string) (net.Conn, *bufio.Reader, chan bool) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		defer server.Close()
+		conn := &deadlineConn{Conn: server, timeout: *controlTimeout}
+		handler(conn, bufio.NewReaderSize(conn, *maxRequestLength), request)
+	}()
+	return client, bufio.NewReader(client), done
+}
+
+// Sends the given line and returns the reply.
+func send(t *testing.T, conn net.Conn, reader *bufio.Reader, line string) string {
+	t.Helper()
+	_, err := conn.Write([]byte(line))
+	if err != nil {
+		t.Fatalf("%q: %v", line, err)
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("%q: no reply: %v", line, err)
+	}
+	return strings.TrimSpace(reply)
+}
+
+// Stages the given contents as the given file within an open transaction.
+func stage(t *testing.T, conn net.Conn, reader *bufio.Reader, fileName string, contents string) {
+	t.Helper()
+	if reply := send(t, conn, reader, fmt.Sprintf("STORE %s %d\n", fileName, len(contents))); reply != "OK" {
+		t.Fatalf("store of %s: reply = %q", fileName, reply)
+	}
+	if reply := send(t, conn, reader, contents); reply != "OK" {
+		t.Fatalf("transfer of %s: reply = %q", fileName, reply)
+	}
+}
+
+func TestTransactionCommitsAllFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	storeLocally(t, "a.txt", "old", storedFile{})
+	t.Cleanup(func() {
+		storedFilesMutex.Lock()
+		delete(storedFiles, "b.txt")
+		storedFilesMutex.Unlock()
+	})
+	conn, reader, done := session(t, handleTransactionRequest, "TXN t1")
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("TXN: reply = %q", reply)
+	}
+	stage(t, conn, reader, "a.txt", "new a")
+	if reply := send(t, conn, reader, "KEEPALIVE\n"); reply != "OK" {
+		t.Errorf("KEEPALIVE: reply = %q", reply)
+	}
+	stage(t, conn, reader, "b.txt", "new b")
+	// Nothing is visible before the commit.
+	if contents, _ := os.ReadFile(filePath("a.txt")); string(contents) != "old" || indexed("b.txt") {
+		t.Fatalf("visible before the commit: a.txt = %q, b.txt indexed = %v", contents, indexed("b.txt"))
+	}
+	if reply := send(t, conn, reader, "COMMIT\n"); reply != "OK" {
+		t.Fatalf("COMMIT: reply = %q", reply)
+	}
+	<-done
+	for fileName, want := range map[string]string{"a.txt": "new a", "b.txt": "new b"} {
+		contents, _ := os.ReadFile(filePath(fileName))
+		if string(contents) != want || !indexed(fileName) {
+			t.Errorf("%s = %q, indexed = %v, want %q", fileName, contents, indexed(fileName), want)
+		}
+	}
+}
+
+func TestPreparedTransactionHoldsItsFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	conn, reader, done := session(t, handleTransactionRequest, "TXN t4")
+	reader.ReadString('\n')
+	stage(t, conn, reader, "a.txt", "new a")
+	if reply := send(t, conn, reader, "PREPARE\n"); reply != "OK" {
+		t.Fatalf("PREPARE: reply = %q", reply)
+	}
+	// The other stores of the file wait for the transaction to end.
+	locked := make(chan bool)
+	go func() {
+		lockFile("a.txt")
+		close(locked)
+		unlockFile("a.txt")
+	}()
+	select {
+	case <-locked:
+		t.Error("a.txt is not held back once prepared")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if indexed("a.txt") {
+		t.Error("a.txt is visible before the commit")
+	}
+	if reply := send(t, conn, reader, "COMMIT\n"); reply != "OK" {
+		t.Fatalf("COMMIT: reply = %q", reply)
+	}
+	<-done
+	<-locked
+	if contents, _ := os.ReadFile(filePath("a.txt")); string(contents) != "new a" || !indexed("a.txt") {
+		t.Errorf("a.txt = %q, indexed = %v, want it committed", contents, indexed("a.txt"))
+	}
+}
+
+func TestTransactionVotesAgainstAFileItCanNotReplace(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	// b.txt can not be moved into place, as a directory is in its way.
+	err := os.MkdirAll(filepath.Join(filePath("b.txt"), "in the way"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, reader, done := session(t, handleTransactionRequest, "TXN t5")
+	reader.ReadString('\n')
+	stage(t, conn, reader, "a.txt", "new a")
+	stage(t, conn, reader, "b.txt", "new b")
+	if reply := send(t, conn, reader, "PREPARE\n"); reply != "ERR Could not prepare." {
+		t.Errorf("PREPARE: reply = %q, want a vote against", reply)
+	}
+	<-done
+	if indexed("a.txt") || indexed("b.txt") {
+		t.Error("the files are visible after a vote against")
+	}
+	// The files are not held back after the vote.
+	lockFile("a.txt")
+	unlockFile("a.txt")
+}
+
+func TestTransactionDiscardedWithoutCommit(t *testing.T) {
+	t.Chdir(t.TempDir())
+	conn, reader, done := session(t, handleTransactionRequest, "TXN t2")
+	reader.ReadString('\n')
+	stage(t, conn, reader, "a.txt", "new a")
+	conn.Close()
+	<-done
+	if indexed("a.txt") {
+		t.Error("a.txt is visible without a commit")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(filePath("a.txt")))
+	for _, entry := range entries {
+		t.Errorf("%s was left behind", entry.Name())
+	}
+}
+
+func TestTransactionRejectsLongLines(t *testing.T) {
+	t.Chdir(t.TempDir())
+	conn, reader, done := session(t, handleTransactionRequest, "TXN t3")
+	reader.ReadString('\n')
+	go conn.Write([]byte(strings.Repeat("x", *maxRequestLength+1) + "\n"))
+	if reply, _ := reader.ReadString('\n'); reply != "ERR Request too large\n" {
+		t.Errorf("reply = %q", reply)
+	}
+	<-done
+}
+
+func TestFailedCommitRollsBack(t *testing.T) {
+	t.Chdir(t.TempDir())
+	storeLocally(t, "a.txt", "old", storedFile{Sum: "old sum"})
+	// b.txt can not be moved into place, as a directory is in its way.
+	err := os.MkdirAll(filepath.Join(filePath("b.txt"), "in the way"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged := make(map[string]stagedFile)
+	for _, fileName := range []string{"a.txt", "b.txt"} {
+		tempFile, err := os.CreateTemp(filepath.Dir(filePath(fileName)), tempFilePrefix+"*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tempFile.WriteString("new")
+		tempFile.Close()
+		staged[fileName] = stagedFile{tempPath: tempFile.Name(), file: storedFile{Key: hsh(fileName), Sum: "new sum"}}
+	}
+	if err := commitTransaction([]string{"a.txt", "b.txt"}, staged); err == nil {
+		t.Fatal("the commit did not fail")
+	}
+	contents, _ := os.ReadFile(filePath("a.txt"))
+	storedFilesMutex.Lock()
+	file := storedFiles["a.txt"]
+	storedFilesMutex.Unlock()
+	if string(contents) != "old" || file.Sum != "old sum" {
+		t.Errorf("a.txt = %q with sum %q, want the old version", contents, file.Sum)
+	}
+	if indexed("b.txt") {
+		t.Error("b.txt is visible after a failed commit")
+	}
+}
+
+func TestTwoNodeLeaveLeavesALoneNode(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	other := node{ID: 100, Address: "127.0.0.1:2"}
+	successor, predecessor = other, other
+	// The leaving node updates its predecessor first, then its successor, which are
+	// both this node.
+	for _, update := range []string{"UPDATE " + self.Address + " KEEP", "UPDATE KEEP " + self.Address} {
+		if reply := handle(t, handleUpdateRequest, update); reply != "OK" {
+			t.Fatalf("%q: reply = %q", update, reply)
+		}
+		if successor.ID != -1 || predecessor.ID != -1 {
+			t.Fatalf("after %q: successor = %v, predecessor = %v, want a lone node", update, successor, predecessor)
+		}
+	}
+	// The lone node owns every key, and takes a new join.
+	if !ownsFile("a.txt") {
+		t.Error("the lone node does not own a.txt")
+	}
+	newNodeAddr, _ := fakePeer(t, "")
+	if reply := placeLoneJoin(t, newNodeAddr, 50); reply != self.Address+" "+self.Address {
+		t.Errorf("join after the leave: answer = %q", reply)
+	}
+}
+
+func TestOwnsKeyBreaksTiesByAddress(t *testing.T) {
+	cases := []struct {
+		predID   int
+		predAddr string
+		nodeID   int
+		nodeAddr string
+		key      int
+		want     bool
+	}{
+		{10, "a", 20, "b", 15, true},
+		{10, "a", 20, "b", 20, true},
+		{10, "a", 20, "b", 10, false},
+		{120, "a", 5, "b", 2, true},
+		// Of the nodes with the same id, the one with the lowest address owns the
+		// whole ring, as its predecessor is the wrap around.
+		{30, "b", 30, "a", 30, true},
+		{30, "b", 30, "a", 31, true},
+		{30, "a", 30, "b", 30, false},
+		{30, "a", 30, "b", 31, false},
+		// A node that is its own predecessor owns every key.
+		{30, "a", 30, "a", 31, true},
+	}
+	for _, c := range cases {
+		if got := ownsKey(c.predID, c.predAddr, c.nodeID, c.nodeAddr, c.key); got != c.want {
+			t.Errorf("ownsKey(%d, %q, %d, %q, %d) = %v, want %v", c.predID, c.predAddr, c.nodeID, c.nodeAddr, c.key, got, c.want)
+		}
+	}
+}
+
+func TestConcurrentJoinsArePlacedOneAtATime(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	// Whichever node joins first takes the file over, which takes a while.
+	storeLocally(t, namesInRange(1, 10, 12)[0], "contents", storedFile{})
+	addresses := []string{}
+	for i := 0; i < 2; i++ {
+		address, _ := fakePeer(t, "")
+		addresses = append(addresses, address)
+	}
+	answers := make([]string, len(addresses))
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, reader, done := session(t, handleJoinRequest, "JOIN "+address)
+			answer, _ := reader.ReadString('\n')
+			<-done
+			answers[i] = strings.TrimSpace(answer)
+		}()
+	}
+	wg.Wait()
+	// Only one of the joins can find this node alone.
+	alone := 0
+	for i, answer := range answers {
+		if answer == self.Address+" "+self.Address {
+			alone++
+		}
+		if strings.HasPrefix(answer, "ERR ") {
+			continue
+		}
+		if successor.Address != addresses[i] && predecessor.Address != addresses[i] {
+			t.Errorf("%s joined with %q, but is not a neighbor: successor = %v, predecessor = %v", addresses[i], answer, successor, predecessor)
+		}
+	}
+	if alone != 1 {
+		t.Errorf("answers = %q, want exactly one join of a lone node", answers)
+	}
+}
+
+func TestAssertOwnerRejectsStoresOfOtherKeys(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	// The other node with id 100 owns the keys in (10, 100].
+	successor = node{ID: 100, Address: "127.0.0.1:2"}
+	predecessor = successor
+	fileName := namesInRange(1, 10, 100)[0]
+	oldAssertOwner := *assertOwner
+	t.Cleanup(func() { *assertOwner = oldAssertOwner })
+	*assertOwner = true
+	if reply := handle(t, handleStoreRequest, "STORE "+fileName+" 8"); reply != "ERR Not the owner." {
+		t.Errorf("with the assertion: answer = %q, want the store rejected", reply)
+	}
+	if indexed(fileName) {
+		t.Errorf("%s was stored", fileName)
+	}
+	*assertOwner = false
+	conn, reader, done := session(t, handleStoreRequest, "STORE "+fileName+" 8")
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("without the assertion: answer = %q, want OK", reply)
+	}
+	if reply := send(t, conn, reader, "contents"); reply != "OK" {
+		t.Errorf("transfer: reply = %q", reply)
+	}
+	<-done
+	if !indexed(fileName) {
+		t.Errorf("%s was not stored", fileName)
+	}
+}
+
+func TestShortTTLFileExpires(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	conn, reader, done := session(t, handleStoreRequest, "STORE a.txt 8 ttl=1")
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("answer = %q", reply)
+	}
+	if reply := send(t, conn, reader, "contents"); reply != "OK" {
+		t.Fatalf("transfer: reply = %q", reply)
+	}
+	<-done
+	if reply := handle(t, handleStatRequest, "STAT a.txt"); !strings.HasPrefix(reply, "OK") {
+		t.Fatalf("before the expiry: stat = %q", reply)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	// The file can not be retrieved once expired, even before the sweep.
+	if reply := handle(t, handleRetrieveRequest, "RETRIEVE a.txt"); reply != "ERR File does not exist." {
+		t.Errorf("retrieve = %q, want the file gone", reply)
+	}
+	removeExpiredFiles()
+	if indexed("a.txt") {
+		t.Errorf("a.txt is still in the index")
+	}
+	if _, err := os.Stat(filePath("a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a.txt is still on the disk: %v", err)
+	}
+	if reply := handle(t, handleStatRequest, "STAT a.txt"); reply != "ERR File does not exist." {
+		t.Errorf("stat = %q, want the file gone", reply)
+	}
+}
+
+func TestOverLongRequestIsRejected(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		handleRequest(server)
+	}()
+	// The line is never ended, so the node must give up before reading all of it.
+	go client.Write([]byte(strings.Repeat("a", 2**maxRequestLength)))
+	reader := bufio.NewReader(client)
+	reply, err := reader.ReadString('\n')
+	if err != nil || reply != "ERR Request too large\n" {
+		t.Fatalf("reply = %q, err = %v", reply, err)
+	}
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("connection not closed: err = %v", err)
+	}
+	<-done
+}
+
+// Runs a peer that answers every successor request with the given answer, after
+// calling the given function. Returns its address.
+func answeringPeer(t *testing.T, answer string, onRequest func()) string {
+	t.Helper()
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ls.Close() })
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				bufio.NewReader(conn).ReadString('\n')
+				onRequest()
+				conn.Write([]byte(answer + "\n"))
+			}()
+		}
+	}()
+	return ls.Addr().String()
+}
+
+func TestLookupRetriesThroughTheNewSuccessor(t *testing.T) {
+	beLoneNode(t, 10)
+	predecessor = node{ID: 5, Address: "127.0.0.1:3"}
+	// The successor of 50 has to lie in [50, 10) on the ring.
+	wantAddr := ""
+	for port := 1000; wantAddr == ""; port++ {
+		address := fmt.Sprintf("127.0.0.1:%d", port)
+		if hsh(address) == 50 || between(50, hsh(address), 10) {
+			wantAddr = address
+		}
+	}
+	newSuccAddr := answeringPeer(t, wantAddr, func() {})
+	// The old successor is replaced while the lookup is in flight, and answers with
+	// this node as if it had not heard of the lookup's target.
+	oldSuccAddr := answeringPeer(t, self.Address, func() {
+		successor = node{ID: 30, Address: newSuccAddr}
+		log.Println("Successor changed to", newSuccAddr)
+	})
+	successor = node{ID: 20, Address: oldSuccAddr}
+	if answer := findSuccessor(50); answer != wantAddr {
+		t.Errorf("answer = %q, want %q through the new successor", answer, wantAddr)
+	}
+}
+
+func TestPeerIsReachedThroughTheAdvertisedAddress(t *testing.T) {
+	// Bind to every interface, which the other peers can not dial as such.
+	ls, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ls.Addr().String())
+	oldAdvertiseAddr := *advertiseAddr
+	t.Cleanup(func() { *advertiseAddr = oldAdvertiseAddr })
+	*advertiseAddr = ls.Addr().String()
+	if _, err := advertisedAddress(port); err == nil {
+		t.Errorf("advertised the wildcard address %s", *advertiseAddr)
+	}
+	*advertiseAddr = "127.0.0.1:" + port
+	address, err := advertisedAddress(port)
+	if err != nil || address != *advertiseAddr {
+		t.Fatalf("address = %q, err = %v, want %q", address, err, *advertiseAddr)
+	}
+	beLoneNode(t, hsh(address))
+	self.Address = address
+	serveListener(t, ls)
+	// Another peer looking up a key through the advertised address is answered with it.
+	if answer := sendSuccessorRequest(5, *maxHops, address); answer != address {
+		t.Errorf("answer = %q, want %q", answer, address)
+	}
+}
+
+func TestStoreRetryWithTheSameTokenIsIngestedOnce(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	t.Cleanup(func() {
+		recentTokensMutex.Lock()
+		defer recentTokensMutex.Unlock()
+		recentTokens = make(map[string]time.Time)
+	})
+	conn, reader, done := session(t, handleStoreRequest, "STORE a.txt 8 token=retry-token")
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("first store: answer = %q", reply)
+	}
+	if reply := send(t, conn, reader, "contents"); reply != "OK" {
+		t.Fatalf("first store: transfer reply = %q", reply)
+	}
+	<-done
+	// The retry is confirmed without taking the contents again.
+	if reply := handle(t, handleStoreRequest, "STORE a.txt 8 token=retry-token"); reply != "OK STORED" {
+		t.Fatalf("retry: answer = %q, want OK STORED", reply)
+	}
+	if contents, err := os.ReadFile(filePath("a.txt")); err != nil || string(contents) != "contents" {
+		t.Errorf("contents = %q, err = %v", contents, err)
+	}
+	// A store with another token is a new one.
+	if reply := handle(t, handleStoreRequest, "STORE a.txt 8 token=other-token"); reply != "OK" {
+		t.Errorf("new store: answer = %q, want OK", reply)
+	}
+}
+
+// Retrieves the given file through the retrieve handler and returns its contents.
+func retrieve(t testing.TB, fileName string) string {
+	t.Helper()
+	_, reader, done := session(t, handleRetrieveRequest, "RETRIEVE "+fileName)
+	defer func() { <-done }()
+	var size int
+	reply, err := reader.ReadString('\n')
+	if _, scanErr := fmt.Sscanf(reply, "OK %d", &size); err != nil || scanErr != nil {
+		t.Fatalf("retrieve of %s: reply = %q, err = %v", fileName, reply, err)
+	}
+	contents := make([]byte, size)
+	if _, err := io.ReadFull(reader, contents); err != nil {
+		t.Fatalf("retrieve of %s: %v", fileName, err)
+	}
+	if reply, err := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("retrieve of %s: final reply = %q, err = %v", fileName, reply, err)
+	}
+	return string(contents)
+}
+
+// Replaces the read cache with one of the given capacity until the test is over.
+func useReadCache(t testing.TB, capacity int64) {
+	oldReadCache := readCache
+	t.Cleanup(func() { readCache = oldReadCache })
+	readCache = newFileCache(capacity)
+}
+
+func TestReadCacheIsInvalidatedByAStore(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	useReadCache(t, 1<<20)
+	storeLocally(t, "a.txt", "old contents", storedFile{})
+	for i := 0; i < 2; i++ {
+		if contents := retrieve(t, "a.txt"); contents != "old contents" {
+			t.Fatalf("retrieve %d = %q", i, contents)
+		}
+	}
+	if _, ok := readCache.get("a.txt"); !ok {
+		t.Fatalf("a.txt was not cached")
+	}
+	conn, reader, done := session(t, handleStoreRequest, "STORE a.txt 12")
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("store: answer = %q", reply)
+	}
+	if reply := send(t, conn, reader, "new contents"); reply != "OK" {
+		t.Fatalf("store: transfer reply = %q", reply)
+	}
+	<-done
+	if contents := retrieve(t, "a.txt"); contents != "new contents" {
+		t.Errorf("after the store: retrieve = %q, want the new contents", contents)
+	}
+}
+
+func benchmarkRepeatedRetrieve(b *testing.B, cacheSize int64) {
+	b.Chdir(b.TempDir())
+	beLoneNode(b, 10)
+	useReadCache(b, cacheSize)
+	storeLocally(b, "hot.txt", strings.Repeat("x", 64<<10), storedFile{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		retrieve(b, "hot.txt")
+	}
+}
+
+func BenchmarkRetrieveFromDisk(b *testing.B) {
+	benchmarkRepeatedRetrieve(b, 0)
+}
+
+func BenchmarkRetrieveFromCache(b *testing.B) {
+	benchmarkRepeatedRetrieve(b, 1<<20)
+}
+
+// Serves a connection like the node does, on one end of a pipe. Returns the other end
+// to talk to it, along with a channel that is closed once the node is done with it.
+func serveConn(t *testing.T) (net.Conn, *bufio.Reader, chan bool) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		handleRequest(server)
+	}()
+	return client, bufio.NewReader(client), done
+}
+
+// Sets the control & the stall timeouts until the test is over.
+func useTimeouts(t *testing.T, control time.Duration, stall time.Duration) {
+	oldControl, oldStall := *controlTimeout, *stallTimeout
+	t.Cleanup(func() { *controlTimeout, *stallTimeout = oldControl, oldStall })
+	*controlTimeout, *stallTimeout = control, stall
+}
+
+func TestSlowTransferIsNotTimedOut(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	useTimeouts(t, 50*time.Millisecond, 100*time.Millisecond)
+	conn, reader, done := serveConn(t)
+	if reply := send(t, conn, reader, "STORE a.txt 10\n"); reply != "OK" {
+		t.Fatalf("answer = %q", reply)
+	}
+	// The whole transfer takes longer than both timeouts, but each byte comes in time.
+	for i := 0; i < 9; i++ {
+		time.Sleep(30 * time.Millisecond)
+		conn.Write([]byte("x"))
+	}
+	if reply := send(t, conn, reader, "x"); reply != "OK" {
+		t.Errorf("transfer reply = %q, want OK", reply)
+	}
+	<-done
+	if !indexed("a.txt") {
+		t.Errorf("a.txt was not stored")
+	}
+}
+
+func TestStalledTransferIsTimedOut(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	useTimeouts(t, 50*time.Millisecond, 100*time.Millisecond)
+	conn, reader, done := serveConn(t)
+	if reply := send(t, conn, reader, "STORE a.txt 10\n"); reply != "OK" {
+		t.Fatalf("answer = %q", reply)
+	}
+	conn.Write([]byte("xxx"))
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the stalled transfer was not timed out")
+	}
+	if indexed("a.txt") {
+		t.Errorf("a.txt was stored")
+	}
+}
+
+func TestNodeSurvivesAHandlerPanic(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	storeLocally(t, "a.txt", "contents", storedFile{})
+	// The retrieve handler can not do without the read cache.
+	oldReadCache := readCache
+	t.Cleanup(func() { readCache = oldReadCache })
+	readCache = nil
+	conn, reader, done := serveConn(t)
+	if reply := send(t, conn, reader, "RETRIEVE a.txt\n"); reply != "ERR Internal error" {
+		t.Errorf("reply = %q, want the internal error", reply)
+	}
+	<-done
+	// The node goes on serving the other requests.
+	readCache = oldReadCache
+	conn, reader, done = serveConn(t)
+	if reply := send(t, conn, reader, "RETRIEVE a.txt\n"); reply != "OK 8" {
+		t.Errorf("after the panic: reply = %q", reply)
+	}
+	conn.Close()
+	<-done
+}
+
+func TestMalformedRequestsAreRejected(t *testing.T) {
+	beLoneNode(t, 10)
+	for request, want := range map[string]string{
+		"SUCC abc": "ERR Invalid id",
+		"SUCC":     "ERR Malformed successor request.",
+		"RETRIEVE": "ERR Malformed retrieve request.",
+	} {
+		if reply := handle(t, dispatchRequest, request); reply != want {
+			t.Errorf("%q: reply = %q, want %q", request, reply, want)
+		}
+	}
+}
+
+// Collects what is logged until the test is over.
+func captureLog(t *testing.T) *strings.Builder {
+	var logged strings.Builder
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &logged
+}
+
+func TestAddressChangeIsDetected(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	// The previous run had another address, and so another id.
+	lastAddress := "127.0.0.1:2"
+	for port := 3; hsh(lastAddress) == hsh(self.Address); port++ {
+		lastAddress = fmt.Sprintf("127.0.0.1:%d", port)
+	}
+	self.ID = hsh(self.Address)
+	oldFolder := fmt.Sprintf("%d", hsh(lastAddress))
+	os.Mkdir(oldFolder, 0755)
+	os.WriteFile(filepath.Join(oldFolder, "a.txt"), []byte("contents"), 0644)
+	os.WriteFile("state", []byte(lastAddress), 0644)
+	logged := captureLog(t)
+	// Without rekey, the files are only warned about.
+	checkAddressChange("state", false)
+	if !strings.Contains(logged.String(), "the address changed from "+lastAddress) {
+		t.Errorf("no warning about the address change:\n%s", logged)
+	}
+	if indexed("a.txt") {
+		t.Errorf("a.txt was moved without rekey")
+	}
+	// The state now holds the new address, so a restart with it is not a change.
+	if state, _ := os.ReadFile("state"); string(state) != self.Address {
+		t.Errorf("state = %q, want %q", state, self.Address)
+	}
+	// With rekey, the files are moved under the new id.
+	os.WriteFile("state", []byte(lastAddress), 0644)
+	checkAddressChange("state", true)
+	if !indexed("a.txt") {
+		t.Errorf("a.txt was not moved")
+	}
+	if contents, err := os.ReadFile(filePath("a.txt")); err != nil || string(contents) != "contents" {
+		t.Errorf("moved contents = %q, err = %v", contents, err)
+	}
+}
+
+func benchmarkLargeRetrieve(b *testing.B, useZeroCopy bool) {
+	b.Chdir(b.TempDir())
+	beLoneNode(b, 10)
+	const size = 16 << 20
+	storeLocally(b, "large.bin", strings.Repeat("x", size), storedFile{})
+	oldZeroCopy := *zeroCopy
+	b.Cleanup(func() { *zeroCopy = oldZeroCopy })
+	*zeroCopy = useZeroCopy
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ls.Close()
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, err := net.Dial("tcp", ls.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		server, err := ls.Accept()
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			defer server.Close()
+			handleRetrieveRequest(&deadlineConn{Conn: server, timeout: *controlTimeout}, nil, "RETRIEVE large.bin")
+		}()
+		n, _ := io.Copy(io.Discard, client)
+		client.Close()
+		if n < size {
+			b.Fatalf("retrieved %d bytes", n)
+		}
+	}
+}
+
+func BenchmarkLargeRetrieveZeroCopy(b *testing.B) {
+	benchmarkLargeRetrieve(b, true)
+}
+
+func BenchmarkLargeRetrieveBuffered(b *testing.B) {
+	benchmarkLargeRetrieve(b, false)
+}
+
+func TestLookupModesResolveTheSameOwner(t *testing.T) {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beLoneNode(t, 10)
+	self.Address = ls.Addr().String()
+	serveListener(t, ls)
+	// The successor of this node knows the owner of 50.
+	ownerAddr := "127.0.0.1:50"
+	lookups := atomic.Int64{}
+	succAddr := answeringPeer(t, ownerAddr, func() { lookups.Add(1) })
+	predecessor = node{ID: 5, Address: "127.0.0.1:3"}
+	successor = node{ID: 20, Address: succAddr}
+	oldLookupMode := *lookupMode
+	t.Cleanup(func() { *lookupMode = oldLookupMode })
+	// Recursive: this node asks its successor, the requester only sees the answer.
+	*lookupMode = "recursive"
+	if answer := sendSuccessorRequest(50, *maxHops, self.Address); answer != ownerAddr {
+		t.Errorf("recursive: answer = %q, want %q", answer, ownerAddr)
+	}
+	// Iterative: the requester is told the next hop, and asks it itself.
+	*lookupMode = "iterative"
+	if answer := sendSuccessorRequest(50, *maxHops, self.Address); answer != "NEXT "+succAddr {
+		t.Errorf("iterative: answer = %q, want the next hop %s", answer, succAddr)
+	}
+	if answer := lookupSuccessor(50, *maxHops, self.Address); answer != ownerAddr {
+		t.Errorf("iterative: owner = %q, want %q", answer, ownerAddr)
+	}
+	if lookups.Load() != 2 {
+		t.Errorf("successor asked %d times, want once in each mode", lookups.Load())
+	}
+}
+
+func TestLeaveKeepsTheFilesWhenTheHandoffFails(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		storeLocally(t, name, "contents of "+name, storedFile{})
+	}
+	succAddr, _ := fakePeer(t, "a.txt")
+	successor = node{ID: 100, Address: succAddr}
+	predecessor = successor
+	if err := leaveRing(); err == nil {
+		t.Fatal("left the ring without handing a.txt over")
+	}
+	if successor.Address != succAddr || predecessor.Address != succAddr {
+		t.Errorf("unlinked: successor = %v, predecessor = %v", successor, predecessor)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if !indexed(name) {
+			t.Errorf("%s is no longer in the index", name)
+		}
+		if contents, err := os.ReadFile(filePath(name)); err != nil || string(contents) != "contents of "+name {
+			t.Errorf("%s: contents = %q, err = %v", name, contents, err)
+		}
+	}
+}
+
+func TestLeaveHandsTheFilesOver(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	storeLocally(t, "a.txt", "contents", storedFile{})
+	succAddr, stored := fakePeer(t, "")
+	successor = node{ID: 100, Address: succAddr}
+	predecessor = successor
+	if err := leaveRing(); err != nil {
+		t.Fatal(err)
+	}
+	if contents, ok := stored.Load("a.txt"); !ok || contents != "contents" {
+		t.Errorf("successor has %q", contents)
+	}
+	if indexed("a.txt") {
+		t.Errorf("a.txt is still in the index")
+	}
+	if successor.ID != -1 || predecessor.ID != -1 {
+		t.Errorf("still linked: successor = %v, predecessor = %v", successor, predecessor)
+	}
+}
+
+func TestLoneNodeExitRemovesItsDirectory(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	storeLocally(t, "a.txt", "contents", storedFile{})
+	// A lone node has no one to hand its files to, so it leaves right away.
+	if err := leaveRing(); err != nil {
+		t.Fatal(err)
+	}
+	if !indexed("a.txt") {
+		t.Fatal("a.txt was dropped by the leave")
+	}
+	// Without -keepdata, the files are removed on exit.
+	discardFiles()
+	if indexed("a.txt") {
+		t.Errorf("a.txt is still in the index")
+	}
+	if _, err := os.Stat(fmt.Sprintf("%d", self.ID)); !os.IsNotExist(err) {
+		t.Errorf("the directory of the node is left behind: %v", err)
+	}
+}
+
+func TestPushSendsTheFileStraightToTheDestination(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	storeLocally(t, "a.txt", "contents", storedFile{})
+	destAddr, stored := fakePeer(t, "")
+	// The coordinator only gets the outcome, none of the contents.
+	_, reader, done := session(t, handlePushRequest, "PUSH a.txt "+destAddr)
+	reply, err := reader.ReadString('\n')
+	if err != nil || reply != "OK\n" {
+		t.Fatalf("reply = %q, err = %v", reply, err)
+	}
+	// The rest of the connection, up to its closing by the handler.
+	if rest, _ := io.ReadAll(reader); len(rest) != 0 {
+		t.Errorf("the coordinator received %q", rest)
+	}
+	<-done
+	if contents, ok := stored.Load("a.txt"); !ok || contents != "contents" {
+		t.Errorf("destination has %q", contents)
+	}
+	if reply := handle(t, handlePushRequest, "PUSH missing.txt "+destAddr); reply != "ERR File does not exist." {
+		t.Errorf("push of a missing file: reply = %q", reply)
+	}
+}
+
+func TestHandlersAreCapped(t *testing.T) {
+	// The handlers of the earlier tests may still be on their way out.
+	if !awaitIdleHandlers() {
+		t.Fatal("the handlers of the earlier tests are still active")
+	}
+	oldHandlerSlots := handlerSlots
+	t.Cleanup(func() { handlerSlots = oldHandlerSlots })
+	handlerSlots = make(chan struct{}, 3)
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, ls)
+	// The connections send nothing, so that their handlers stay busy.
+	conns := []net.Conn{}
+	for i := 0; i < 5; i++ {
+		conn, err := net.Dial("tcp", ls.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns[3:] {
+		reply, _ := bufio.NewReader(conn).ReadString('\n')
+		if reply != "ERR Too many requests\n" {
+			t.Errorf("over the cap: reply = %q", reply)
+		}
+	}
+	if active := activeHandlers.Load(); active != 3 {
+		t.Errorf("active handlers = %d, want 3", active)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if !awaitIdleHandlers() {
+		t.Errorf("active handlers = %d after the connections closed, want 0", activeHandlers.Load())
+	}
+}
+
+func TestTouchedFileSurvivesItsOriginalExpiry(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	storeLocally(t, "a.txt", "contents", storedFile{Expiry: time.Now().Add(500 * time.Millisecond)})
+	storeLocally(t, "b.txt", "contents", storedFile{Expiry: time.Now().Add(-time.Second)})
+	if reply := handle(t, handleTouchRequest, "TOUCH a.txt 5"); reply != "OK" {
+		t.Fatalf("touch: reply = %q", reply)
+	}
+	time.Sleep(700 * time.Millisecond)
+	removeExpiredFiles()
+	if !indexed("a.txt") {
+		t.Fatal("a.txt was removed at its original expiry")
+	}
+	if contents := retrieve(t, "a.txt"); contents != "contents" {
+		t.Errorf("retrieve = %q", contents)
+	}
+	// A file that is gone, or already expired, can not be touched.
+	for _, request := range []string{"TOUCH missing.txt 5", "TOUCH b.txt 5"} {
+		if reply := handle(t, handleTouchRequest, request); reply != "ERR File does not exist." {
+			t.Errorf("%q: reply = %q", request, reply)
+		}
+	}
+}
+
+func TestStoreOfADeniedExtensionIsRejected(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	oldAllowed, oldDenied := *allowedExtensions, *deniedExtensions
+	t.Cleanup(func() { *allowedExtensions, *deniedExtensions = oldAllowed, oldDenied })
+	*allowedExtensions, *deniedExtensions = "", "exe,."
+	for _, fileName := range []string{"tool.EXE", "README"} {
+		if reply := handle(t, handleStoreRequest, "STORE "+fileName+" 8"); reply != "ERR File extension not allowed." {
+			t.Errorf("%s: reply = %q", fileName, reply)
+		}
+	}
+	*allowedExtensions, *deniedExtensions = "txt", ""
+	if reply := handle(t, handleStoreRequest, "STORE tool.exe 8"); reply != "ERR File extension not allowed." {
+		t.Errorf("tool.exe under the allow list: reply = %q", reply)
+	}
+}
+
+func TestReindexRestoresAConsistentIndex(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	succAddr, stored := fakePeer(t, "")
+	successor = node{ID: 100, Address: succAddr}
+	predecessor = node{ID: 5, Address: "127.0.0.1:2"}
+	// This node owns the keys in (5, 10], its successor those in (10, 100].
+	owned := namesInRange(2, 5, 10)
+	misplaced := namesInRange(1, 10, 100)[0]
+	expiry := time.Now().Add(time.Hour)
+	storeLocally(t, owned[0], "kept", storedFile{Expiry: expiry, Sum: "recorded"})
+	for _, name := range []string{owned[1], misplaced} {
+		os.WriteFile(filePath(name), []byte("contents of "+name), 0644)
+	}
+	storedFilesMutex.Lock()
+	storedFiles["gone.txt"] = storedFile{Key: hsh("gone.txt")}
+	storedFilesMutex.Unlock()
+	reindexFiles()
+	storedFilesMutex.Lock()
+	kept, found := storedFiles[owned[0]]
+	storedFilesMutex.Unlock()
+	if !found || !kept.Expiry.Equal(expiry) || kept.Sum != "recorded" {
+		t.Errorf("%s: indexed = %v, file = %+v", owned[0], found, kept)
+	}
+	if !indexed(owned[1]) {
+		t.Errorf("%s was not indexed", owned[1])
+	}
+	if indexed("gone.txt") {
+		t.Errorf("gone.txt is still indexed without a file on disk")
+	}
+	if indexed(misplaced) {
+		t.Errorf("%s is still indexed after the move", misplaced)
+	}
+	if _, err := os.Stat(filePath(misplaced)); !os.IsNotExist(err) {
+		t.Errorf("%s is still on disk: %v", misplaced, err)
+	}
+	if contents, ok := stored.Load(misplaced); !ok || contents != "contents of "+misplaced {
+		t.Errorf("owner has %q", contents)
+	}
+}
+
+func TestUnknownCommandIsAnswered(t *testing.T) {
+	beLoneNode(t, 10)
+	captureLog(t)
+	conn, reader, done := serveConn(t)
+	if reply := send(t, conn, reader, "BOGUS a.txt\n"); reply != "ERR Unknown command" {
+		t.Errorf("reply = %q", reply)
+	}
+	// The connection is closed rather than left waiting for another request.
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the connection is still open")
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("the connection is still open")
+	}
+}
+
+func TestSlowRequestIsLoggedAndCounted(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	oldThreshold := *slowRequestThreshold
+	t.Cleanup(func() { *slowRequestThreshold = oldThreshold })
+	*slowRequestThreshold = 50 * time.Millisecond
+	logged := captureLog(t)
+	before := slowRequests.Load()
+	// A quick request is not counted.
+	conn, reader, done := serveConn(t)
+	send(t, conn, reader, "NODEINFO\n")
+	<-done
+	if slowRequests.Load() != before {
+		t.Fatalf("a quick request was counted as slow")
+	}
+	// The handler of the store is held up by the contents coming in late.
+	conn, reader, done = serveConn(t)
+	if reply := send(t, conn, reader, "STORE a.txt 1\n"); reply != "OK" {
+		t.Fatalf("answer = %q", reply)
+	}
+	time.Sleep(100 * time.Millisecond)
+	send(t, conn, reader, "x")
+	<-done
+	if slowRequests.Load() != before+1 {
+		t.Errorf("slow requests = %d, want %d", slowRequests.Load(), before+1)
+	}
+	if !strings.Contains(logged.String(), `Slow request from pipe took`) || !strings.Contains(logged.String(), `"STORE a.txt 1"`) {
+		t.Errorf("log = %q", logged.String())
+	}
+}
+
+func TestGossipLearnsOfUnmentionedPeers(t *testing.T) {
+	beLoneNode(t, 10)
+	knownPeersMutex.Lock()
+	oldKnownPeers := knownPeers
+	knownPeers = make(map[string]time.Time)
+	knownPeersMutex.Unlock()
+	t.Cleanup(func() {
+		knownPeersMutex.Lock()
+		knownPeers = oldKnownPeers
+		knownPeersMutex.Unlock()
+	})
+	// The successor is the only peer that this node was told about.
+	succAddr := answeringPeer(t, "OK 127.0.0.1:7 127.0.0.1:8", func() {})
+	successor = node{ID: hsh(succAddr), Address: succAddr}
+	predecessor = successor
+	gossip()
+	known := samplePeers(maxKnownPeers)
+	slices.Sort(known)
+	want := []string{"127.0.0.1:7", "127.0.0.1:8", succAddr}
+	slices.Sort(want)
+	if !slices.Equal(known, want) {
+		t.Errorf("known peers = %v, want %v", known, want)
+	}
+}
+
+func TestAbortedStoreLeavesNothingBehind(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	storeLocally(t, "b.txt", "previous version", storedFile{})
+	for _, fileName := range []string{"a.txt", "b.txt"} {
+		conn, reader, done := serveConn(t)
+		if reply := send(t, conn, reader, "STORE "+fileName+" 10\n"); reply != "OK" {
+			t.Fatalf("%s: answer = %q", fileName, reply)
+		}
+		// The client is canceled halfway through the upload.
+		conn.Write([]byte("xxxxx"))
+		conn.Close()
+		<-done
+	}
+	if indexed("a.txt") {
+		t.Error("a.txt was indexed")
+	}
+	if _, err := os.Stat(filePath("a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a.txt is on disk: %v", err)
+	}
+	if contents, _ := os.ReadFile(filePath("b.txt")); string(contents) != "previous version" {
+		t.Errorf("b.txt = %q", contents)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(filePath("a.txt")))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			t.Errorf("the partial upload %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestLookupsAreWarnedAboutBeforeTheHopLimit(t *testing.T) {
+	beLoneNode(t, 10)
+	if got, want := flag.Lookup("maxhops").DefValue, "14"; got != want {
+		t.Errorf("default hop limit = %s, want 2*log2(%d) = %s", got, ringCapacity, want)
+	}
+	oldMaxHops, oldWarnHops := *maxHops, *warnHops
+	t.Cleanup(func() { *maxHops, *warnHops = oldMaxHops, oldWarnHops })
+	*maxHops = defaultMaxHops(ringCapacity)
+	*warnHops = defaultWarnHops(ringCapacity, *maxHops)
+	if *warnHops != 10 {
+		t.Errorf("warn threshold = %d, want 10", *warnHops)
+	}
+	logged := captureLog(t)
+	// A lookup that has taken fewer hops is answered quietly.
+	for _, hopsLeft := range []int{*maxHops, *maxHops - *warnHops + 1} {
+		handle(t, dispatchRequest, fmt.Sprintf("SUCC 5 %d", hopsLeft))
+	}
+	if strings.Contains(logged.String(), "Warning") {
+		t.Errorf("log = %q", logged.String())
+	}
+	// One that has reached the threshold is warned about, but still answered.
+	if reply := handle(t, dispatchRequest, fmt.Sprintf("SUCC 5 %d", *maxHops-*warnHops)); reply != self.Address {
+		t.Errorf("reply = %q", reply)
+	}
+	if !strings.Contains(logged.String(), "Warning: the lookup of 5 has taken 10 hops") {
+		t.Errorf("log = %q", logged.String())
+	}
+}
+
+func TestSizeAboveTwoGiBIsNotTruncated(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	const size = 3 << 30
+	conn, reader, done := serveConn(t)
+	if reply := send(t, conn, reader, fmt.Sprintf("STORE big.bin %d\n", size)); reply != "OK" {
+		t.Fatalf("answer = %q", reply)
+	}
+	conn.Write([]byte("xxxxx"))
+	// The transfer in progress expects the whole declared size.
+	_, transfersReader, transfersDone := session(t, handleTransfersRequest, "TRANSFERS")
+	reply, _ := transfersReader.ReadString('\n')
+	line, _ := transfersReader.ReadString('\n')
+	<-transfersDone
+	if reply != "OK 1\n" || !strings.Contains(line, " in big.bin ") || !strings.Contains(line, fmt.Sprintf(" %d ", size)) {
+		t.Errorf("transfers = %q %q", reply, line)
+	}
+	// The connection runs out long before the declared size, so nothing is stored.
+	conn.Close()
+	<-done
+	if indexed("big.bin") {
+		t.Error("big.bin was stored")
+	}
+}
+
+func TestJoinFailsCleanlyOnABadAnswer(t *testing.T) {
+	// The initiator closes the connection without answering.
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ls.Close() })
+	go func() {
+		for {
+			conn, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+		}
+	}()
+	_, _, err = sendJoinRequest("127.0.0.1:2", ls.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), "no answer from the initiator") {
+		t.Errorf("closed connection: err = %v", err)
+	}
+	// The initiator answers with a single address.
+	initiatorAddr := answeringPeer(t, "127.0.0.1:3", func() {})
+	_, _, err = sendJoinRequest("127.0.0.1:2", initiatorAddr)
+	if err == nil || !strings.Contains(err.Error(), "malformed answer") {
+		t.Errorf("single address: err = %v", err)
+	}
+}
+
+func TestPinnedShortTTLFileSurvivesTheSweep(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	// a.txt is pinned as it is stored, b.txt once it is stored.
+	conn, reader, done := session(t, handleStoreRequest, "STORE a.txt 8 ttl=1 pin=true")
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("answer = %q", reply)
+	}
+	if reply := send(t, conn, reader, "contents"); reply != "OK" {
+		t.Fatalf("transfer: reply = %q", reply)
+	}
+	<-done
+	storeLocally(t, "b.txt", "contents", storedFile{Expiry: time.Now().Add(time.Second)})
+	if reply := handle(t, handlePinRequest, "PIN b.txt"); reply != "OK" {
+		t.Fatalf("pin = %q", reply)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	removeExpiredFiles()
+	for _, fileName := range []string{"a.txt", "b.txt"} {
+		if reply := handle(t, handleStatRequest, "STAT "+fileName); !strings.HasSuffix(reply, " pinned=true") {
+			t.Errorf("%s: stat = %q", fileName, reply)
+		}
+		if contents := retrieve(t, fileName); contents != "contents" {
+			t.Errorf("%s = %q", fileName, contents)
+		}
+	}
+}
+
+func TestListAllStreamsSizesAndChecksums(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	storeLocally(t, "a.txt", "hello", storedFile{Sum: "recorded"})
+	storeLocally(t, "b.txt", "unknown sum", storedFile{})
+	storeLocally(t, "c.txt", "expired", storedFile{Expiry: time.Now().Add(-time.Second)})
+	_, reader, done := session(t, handleListAllRequest, "LISTALL")
+	defer func() { <-done }()
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("reply = %q", reply)
+	}
+	lines := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("the list was not ended: %v", err)
+		}
+		if line == "\n" {
+			break
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	slices.Sort(lines)
+	want := []string{
+		fmt.Sprintf("a.txt %d 5 recorded", hsh("a.txt")),
+		fmt.Sprintf("b.txt %d 11 -", hsh("b.txt")),
+	}
+	if !slices.Equal(lines, want) {
+		t.Errorf("files = %q, want %q", lines, want)
+	}
+}
+
+func TestStoreIsDeferredUntilThePredecessorIsKnown(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	// Right after the join, the node knows its successor but not its predecessor yet.
+	successor = node{ID: 100, Address: "127.0.0.1:2"}
+	if reply := handle(t, handleStoreRequest, "STORE a.txt 8"); reply != "ERR Not ready, retry" {
+		t.Fatalf("reply = %q", reply)
+	}
+	if indexed("a.txt") {
+		t.Fatal("a.txt was stored")
+	}
+	// Once the predecessor is known, the retry goes through.
+	predecessor = node{ID: 100, Address: "127.0.0.1:2"}
+	conn, reader, done := session(t, handleStoreRequest, "STORE a.txt 8")
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("retry: answer = %q", reply)
+	}
+	if reply := send(t, conn, reader, "contents"); reply != "OK" {
+		t.Fatalf("retry: transfer reply = %q", reply)
+	}
+	<-done
+	if !indexed("a.txt") {
+		t.Error("a.txt was not stored by the retry")
+	}
+}
+
+func TestIndexIsRecoveredFromTheLogAfterACrash(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	oldKeepData, oldIndexFlush, oldIndexBatch := *keepData, *indexFlush, *indexBatch
+	t.Cleanup(func() {
+		*keepData, *indexFlush, *indexBatch = oldKeepData, oldIndexFlush, oldIndexBatch
+		if indexLog != nil {
+			indexLog.Close()
+			indexLog = nil
+		}
+	})
+	*keepData, *indexFlush, *indexBatch = true, time.Hour, 100
+	storeLocally(t, "a.txt", "contents", storedFile{})
+	storeLocally(t, "c.txt", "contents", storedFile{})
+	storedFilesMutex.Lock()
+	snapshotIndex()
+	storedFilesMutex.Unlock()
+	// The changes after the snapshot are only in the log.
+	if reply := handle(t, handlePinRequest, "PIN a.txt"); reply != "OK" {
+		t.Fatalf("pin = %q", reply)
+	}
+	conn, reader, done := session(t, handleStoreRequest, "STORE b.txt 8 ttl=3600")
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("answer = %q", reply)
+	}
+	if reply := send(t, conn, reader, "contents"); reply != "OK" {
+		t.Fatalf("transfer: reply = %q", reply)
+	}
+	<-done
+	if reply := handle(t, handleDeleteRequest, "DELETE c.txt"); reply != "OK" {
+		t.Fatalf("delete = %q", reply)
+	}
+	// The node crashes in the middle of logging another change.
+	indexLog.Write([]byte(`{"Name":"d.t`))
+	indexLog.Close()
+	indexLog = nil
+	storedFilesMutex.Lock()
+	storedFiles = make(map[string]storedFile)
+	storedFilesMutex.Unlock()
+	loadStoredFiles()
+	storedFilesMutex.Lock()
+	defer storedFilesMutex.Unlock()
+	if file := storedFiles["a.txt"]; !file.Pinned {
+		t.Errorf("a.txt lost its pin: %+v", file)
+	}
+	if file := storedFiles["b.txt"]; file.Expiry.IsZero() || file.Sum == "" {
+		t.Errorf("b.txt lost its expiry or checksum: %+v", file)
+	}
+	if _, ok := storedFiles["c.txt"]; ok {
+		t.Error("c.txt came back")
+	}
+	if len(storedFiles) != 2 {
+		t.Errorf("recovered %d files: %v", len(storedFiles), storedFiles)
+	}
+}
+
+func TestStoredFilesGetTheConfiguredPermissions(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	oldDirMode, oldStoredFileMode := dirMode, storedFileMode
+	t.Cleanup(func() { dirMode, storedFileMode = oldDirMode, oldStoredFileMode })
+	if err := dirMode.Set("700"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storedFileMode.Set("600"); err != nil {
+		t.Fatal(err)
+	}
+	conn, reader, done := session(t, handleStoreRequest, "STORE a.txt 8")
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("answer = %q", reply)
+	}
+	if reply := send(t, conn, reader, "contents"); reply != "OK" {
+		t.Fatalf("transfer: reply = %q", reply)
+	}
+	<-done
+	for path, want := range map[string]os.FileMode{filepath.Dir(filePath("a.txt")): 0700, filePath("a.txt"): 0600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s: permissions = %v, want %v", path, info.Mode().Perm(), want)
+		}
+	}
+	if err := dirMode.Set("800"); err == nil {
+		t.Error("accepted the mode 800")
+	}
+}
+
+// A reader of zeros that takes a while for each read, like a slow connection.
+type slowZeros struct{}
+
+func (slowZeros) Read(p []byte) (int, error) {
+	time.Sleep(100 * time.Microsecond)
+	clear(p)
+	return len(p), nil
+}
+
+func TestSmallTransfersAreNotBlockedByALargeOne(t *testing.T) {
+	oldTransferSlots := transferSlots
+	t.Cleanup(func() { transferSlots = oldTransferSlots })
+	transferSlots = make(chan struct{}, 1)
+	largeDone := make(chan time.Time)
+	go func() {
+		copyChunked(io.Discard, slowZeros{}, 4*transferChunkSize, &transfer{})
+		largeDone <- time.Now()
+	}()
+	// Let the large transfer take the only slot first.
+	time.Sleep(10 * time.Millisecond)
+	var small sync.WaitGroup
+	smallDone := make([]time.Time, 3)
+	for i := range smallDone {
+		small.Add(1)
+		go func() {
+			defer small.Done()
+			copyChunked(io.Discard, strings.NewReader(strings.Repeat("x", 1024)), 1024, &transfer{})
+			smallDone[i] = time.Now()
+		}()
+	}
+	small.Wait()
+	largeEnd := <-largeDone
+	for i, end := range smallDone {
+		if !end.Before(largeEnd) {
+			t.Errorf("small transfer %d ended after the large one", i)
+		}
+	}
+}
+
+func TestStreamedStoreOfUnknownSize(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, ls)
+	conn, err := net.Dial("tcp", ls.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if reply := send(t, conn, reader, "STORE a.txt stream\n"); reply != "OK" {
+		t.Fatalf("answer = %q", reply)
+	}
+	// The contents are generated piece by piece, and end when the client half-closes.
+	contents := ""
+	for i := 0; i < 100; i++ {
+		piece := fmt.Sprintf("line %d\n", i)
+		conn.Write([]byte(piece))
+		contents += piece
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("transfer reply = %q", reply)
+	}
+	if stored := retrieve(t, "a.txt"); stored != contents {
+		t.Errorf("stored %d bytes, want %d", len(stored), len(contents))
+	}
+	sum := sha256.Sum256([]byte(contents))
+	storedFilesMutex.Lock()
+	file := storedFiles["a.txt"]
+	storedFilesMutex.Unlock()
+	if file.Sum != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum = %q", file.Sum)
+	}
+	// A store without a size or the stream marker is rejected.
+	if reply := handle(t, handleStoreRequest, "STORE b.txt"); reply != "ERR Malformed store request." {
+		t.Errorf("store without a size = %q", reply)
+	}
+}
+
+func TestWildcardAddressesNeedAConcreteAdvertiseAddress(t *testing.T) {
+	oldAdvertiseAddr := *advertiseAddr
+	t.Cleanup(func() { *advertiseAddr = oldAdvertiseAddr })
+	for _, address := range []string{"0.0.0.0:5000", "[::]:5000", ":5000"} {
+		*advertiseAddr = address
+		_, err := advertisedAddress("5000")
+		if err == nil || !strings.Contains(err.Error(), "give a concrete host") {
+			t.Errorf("%s: err = %v", address, err)
+		}
+	}
+	// A concrete address is advertised as given, even if it can not be reached yet.
+	captureLog(t)
+	*advertiseAddr = deadAddress(t)
+	if address, err := advertisedAddress("5000"); err != nil || address != *advertiseAddr {
+		t.Errorf("address = %q, err = %v", address, err)
+	}
+}
+
+func TestKilledTransferIsCleanedUp(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	captureLog(t)
+	conn, reader, done := serveConn(t)
+	if reply := send(t, conn, reader, "STORE a.txt 10\n"); reply != "OK" {
+		t.Fatalf("answer = %q", reply)
+	}
+	conn.Write([]byte("xxx"))
+	// The transfer is listed with its id.
+	_, listReader, listDone := session(t, handleTransfersRequest, "TRANSFERS")
+	reply, _ := listReader.ReadString('\n')
+	line, _ := listReader.ReadString('\n')
+	<-listDone
+	var id int64
+	var direction, fileName string
+	fmt.Sscanf(line, "%d %s %s", &id, &direction, &fileName)
+	if reply != "OK 1\n" || direction != "in" || fileName != "a.txt" {
+		t.Fatalf("transfers = %q %q", reply, line)
+	}
+	if reply := handle(t, handleKillRequest, fmt.Sprintf("KILL %d", id)); reply != "OK" {
+		t.Fatalf("kill = %q", reply)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the killed transfer is still running")
+	}
+	if indexed("a.txt") {
+		t.Error("a.txt was indexed")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(filePath("a.txt")))
+	if len(entries) > 0 {
+		t.Errorf("left behind %v", entries)
+	}
+	if reply := handle(t, handleTransfersRequest, "TRANSFERS"); reply != "OK 0" {
+		t.Errorf("transfers after the kill = %q", reply)
+	}
+	if reply := handle(t, handleKillRequest, fmt.Sprintf("KILL %d", id)); !strings.HasPrefix(reply, "ERR") {
+		t.Errorf("second kill = %q", reply)
+	}
+}
+
+func TestMultiplexedResponsesMatchTheirRequests(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	const requests = 50
+	for i := 0; i < requests; i++ {
+		storeLocally(t, fmt.Sprintf("file-%d.txt", i), strings.Repeat("x", i+1), storedFile{})
+	}
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, ls)
+	conn, err := net.Dial("tcp", ls.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if reply := send(t, conn, reader, "MUX\n"); reply != "OK" {
+		t.Fatalf("answer = %q", reply)
+	}
+	// Every request is in flight before any response is read.
+	go func() {
+		for i := 0; i < requests; i++ {
+			fmt.Fprintf(conn, "r%d STAT file-%d.txt\n", i, i)
+		}
+	}()
+	seen := make(map[string]bool)
+	for n := 0; n < requests; n++ {
+		var id string
+		var length int
+		header, err := reader.ReadString('\n')
+		if _, scanErr := fmt.Sscanf(header, "%s %d", &id, &length); err != nil || scanErr != nil {
+			t.Fatalf("header = %q, err = %v", header, err)
+		}
+		response := make([]byte, length)
+		if _, err := io.ReadFull(reader, response); err != nil {
+			t.Fatal(err)
+		}
+		var i, size int
+		fmt.Sscanf(id, "r%d", &i)
+		fmt.Sscanf(string(response), "OK %d", &size)
+		if size != i+1 {
+			t.Errorf("%s: response = %q, want the size %d", id, response, i+1)
+		}
+		if seen[id] {
+			t.Errorf("%s was answered twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestRepeatedlyReadFileIsTheHottest(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	accessStatsMutex.Lock()
+	oldAccessStats := accessStats
+	accessStats = make(map[string]*accessStat)
+	accessStatsMutex.Unlock()
+	t.Cleanup(func() {
+		accessStatsMutex.Lock()
+		accessStats = oldAccessStats
+		accessStatsMutex.Unlock()
+	})
+	for _, fileName := range []string{"a.txt", "b.txt", "c.txt"} {
+		storeLocally(t, fileName, "contents", storedFile{})
+	}
+	retrieve(t, "a.txt")
+	for i := 0; i < 5; i++ {
+		retrieve(t, "b.txt")
+	}
+	_, reader, done := session(t, handleHotKeysRequest, "HOTKEYS 2")
+	defer func() { <-done }()
+	if reply, _ := reader.ReadString('\n'); reply != "OK 2\n" {
+		t.Fatalf("reply = %q", reply)
+	}
+	for _, want := range []string{fmt.Sprintf("b.txt %d 5 0 ", hsh("b.txt")), fmt.Sprintf("a.txt %d 1 0 ", hsh("a.txt"))} {
+		if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, want) {
+			t.Errorf("line = %q, want %q...", line, want)
+		}
+	}
+}
+
+func TestLengthFramingCarriesEmbeddedNewlines(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	// A message round-trips through the framing as is.
+	var buffer bytes.Buffer
+	message := "first line\nsecond line\n\nlast line"
+	if err := (lengthFramer{}).writeMessage(&buffer, message); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := (lengthFramer{}).readMessage(bufio.NewReader(&buffer)); err != nil || got != message {
+		t.Fatalf("read back %q, err = %v", got, err)
+	}
+	storeLocally(t, "a.txt", "contents", storedFile{})
+	storeLocally(t, "b.txt", "contents", storedFile{})
+	conn, reader, _ := serveConn(t)
+	if reply := send(t, conn, reader, "FRAMING length\n"); reply != "OK" {
+		t.Fatalf("answer = %q", reply)
+	}
+	exchange := func(request string) string {
+		t.Helper()
+		go (lengthFramer{}).writeMessage(conn, request)
+		response, err := (lengthFramer{}).readMessage(reader)
+		if err != nil {
+			t.Fatalf("%q: %v", request, err)
+		}
+		return response
+	}
+	// The multi-line response of a listing comes as a single message.
+	if response := exchange("LIST"); !strings.HasPrefix(response, "OK 2\n") || strings.Count(response, "\n") != 3 {
+		t.Errorf("list = %q", response)
+	}
+	// A newline in the request is a part of the file name, not the end of the request.
+	if response := exchange("STAT a.txt\nb.txt"); response != "ERR File does not exist.\n" {
+		t.Errorf("stat = %q", response)
+	}
+	if response := exchange("STAT a.txt"); !strings.HasPrefix(response, "OK 8 ") {
+		t.Errorf("stat = %q", response)
+	}
+}
+
+func TestRejoinedPeerServesTheNewerVersion(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	oldReclaimCooldown := *reclaimCooldown
+	t.Cleanup(func() {
+		*reclaimCooldown = oldReclaimCooldown
+		storedFilesMutex.Lock()
+		heldFiles = make(map[string]bool)
+		storedFilesMutex.Unlock()
+	})
+	*reclaimCooldown = 300 * time.Millisecond
+	// The files kept from before the crash. a.txt was changed while the peer was down.
+	storeLocally(t, "a.txt", "old", storedFile{})
+	storeLocally(t, "b.txt", "unchanged", storedFile{})
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self.Address = ls.Addr().String()
+	serveListener(t, ls)
+	params := handle(t, handleParamsRequest, "PARAMS")
+	// The initiator is the successor, which sends the newer a.txt before it answers.
+	initiator, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { initiator.Close() })
+	go func() {
+		for {
+			conn, err := initiator.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			if strings.HasPrefix(line, "JOIN ") {
+				pushed, err := net.Dial("tcp", self.Address)
+				if err == nil {
+					pushedReader := bufio.NewReader(pushed)
+					pushed.Write([]byte("STORE a.txt 3\n"))
+					pushedReader.ReadString('\n')
+					pushed.Write([]byte("new"))
+					pushedReader.ReadString('\n')
+					pushed.Close()
+				}
+				fmt.Fprintf(conn, "%s %s\n", initiator.Addr(), initiator.Addr())
+			} else {
+				conn.Write([]byte(params + "\n"))
+			}
+			conn.Close()
+		}
+	}()
+	if err := joinRing(initiator.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if contents := retrieve(t, "a.txt"); contents != "new" {
+		t.Errorf("a.txt = %q, want the newer version", contents)
+	}
+	// b.txt is held back for a while, in case its newer version is still on the way.
+	if reply := handle(t, handleRetrieveRequest, "RETRIEVE b.txt"); reply != "ERR Not ready, retry" {
+		t.Errorf("retrieve of b.txt during the cooldown = %q", reply)
+	}
+	time.Sleep(*reclaimCooldown)
+	if contents := retrieve(t, "b.txt"); contents != "unchanged" {
+		t.Errorf("b.txt = %q", contents)
+	}
+}
+
+func TestSubscriberIsToldOfTheChanges(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	sub, subReader, subDone := session(t, handleSubscribeRequest, "SUBSCRIBE a.txt")
+	if reply, _ := subReader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("SUBSCRIBE: reply = %q", reply)
+	}
+	// Another client stores the file.
+	conn, reader, done := session(t, handleStoreRequest, "STORE a.txt 8")
+	if reply, _ := reader.ReadString('\n'); reply != "OK\n" {
+		t.Fatalf("STORE: reply = %q", reply)
+	}
+	if reply := send(t, conn, reader, "contents"); reply != "OK" {
+		t.Fatalf("transfer: reply = %q", reply)
+	}
+	<-done
+	sum := sha256.Sum256([]byte("contents"))
+	if event, _ := subReader.ReadString('\n'); event != "CHANGED a.txt "+hex.EncodeToString(sum[:])+"\n" {
+		t.Errorf("after the store: event = %q", event)
+	}
+	if reply := handle(t, handleDeleteRequest, "DELETE a.txt"); reply != "OK" {
+		t.Fatalf("DELETE: reply = %q", reply)
+	}
+	if event, _ := subReader.ReadString('\n'); event != "CHANGED a.txt NONE\n" {
+		t.Errorf("after the delete: event = %q", event)
+	}
+	if reply := send(t, sub, subReader, "UNSUBSCRIBE\n"); reply != "OK" {
+		t.Errorf("UNSUBSCRIBE: reply = %q", reply)
+	}
+	<-subDone
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	if len(subscribers["a.txt"]) != 0 {
+		t.Errorf("the subscriber was not forgotten")
+	}
+}
+
+func TestJoinThroughSelfFailsCleanly(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beLoneNode(t, hsh(ls.Addr().String()))
+	self.Address = ls.Addr().String()
+	oldSuccessor, oldPredecessor := successor, predecessor
+	serveListener(t, ls)
+	_, _, err = sendJoinRequest(self.Address, self.Address)
+	if err == nil || !strings.Contains(err.Error(), "Cannot join through self") {
+		t.Errorf("err = %v, want the join rejected", err)
+	}
+	if successor != oldSuccessor || predecessor != oldPredecessor {
+		t.Errorf("the neighbours changed to %v, %v", successor, predecessor)
+	}
+}
+
+func TestNoStoreNodeRoutesButRefusesToStore(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	oldNoStore, oldProxyEntry := *noStore, proxyEntry
+	t.Cleanup(func() { *noStore, proxyEntry = oldNoStore, oldProxyEntry })
+	*noStore = true
+	// The lookups are passed on to the ring, even for the keys around the node's own id.
+	asked := atomic.Int64{}
+	proxyEntry = answeringPeer(t, "127.0.0.1:7", func() { asked.Add(1) })
+	for _, id := range []int{5, 10, 11} {
+		if reply := handle(t, handleSuccessorRequest, fmt.Sprintf("SUCC %d", id)); reply != "127.0.0.1:7" {
+			t.Errorf("SUCC %d = %q, want the answer of the ring", id, reply)
+		}
+	}
+	if asked.Load() != 3 {
+		t.Errorf("the ring was asked %d times, want 3", asked.Load())
+	}
+	if reply := handle(t, handleStoreRequest, "STORE a.txt 8"); reply != "ERR Node stores no data" {
+		t.Errorf("STORE = %q, want the store refused", reply)
+	}
+	if reply := handle(t, handleTransactionRequest, "TXN t1"); reply != "ERR Node stores no data" {
+		t.Errorf("TXN = %q, want the transaction refused", reply)
+	}
+	if indexed("a.txt") {
+		t.Errorf("a.txt was stored")
+	}
+}
+
+func TestRequestsOverTheConnectionLimitAreRefused(t *testing.T) {
+	beLoneNode(t, 10)
+	oldConnRequests, oldConnRate := *connRequests, *connRate
+	t.Cleanup(func() { *connRequests, *connRate = oldConnRequests, oldConnRate })
+	for _, limit := range []struct {
+		name          string
+		count, perSec int
+	}{{"count", 3, 0}, {"rate", 0, 3}} {
+		*connRequests, *connRate = limit.count, limit.perSec
+		// Only the lookups keep the connection open.
+		conn, reader, done := serveConn(t)
+		for i := 0; i < 3; i++ {
+			if reply := send(t, conn, reader, "SUCC 5\n"); reply != self.Address {
+				t.Fatalf("%s: request %d: reply = %q", limit.name, i+1, reply)
+			}
+		}
+		if reply := send(t, conn, reader, "SUCC 5\n"); reply != "ERR Rate limit exceeded" {
+			t.Errorf("%s: request 4: reply = %q, want it refused", limit.name, reply)
+		}
+		// The connection is closed after the refusal.
+		if _, err := reader.ReadString('\n'); err != io.EOF {
+			t.Errorf("%s: after the refusal: err = %v, want the connection closed", limit.name, err)
+		}
+		<-done
+	}
+}
+
+func TestScrubMarksTheCorruptedFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	beLoneNode(t, 10)
+	sum := sha256.Sum256([]byte("contents"))
+	storeLocally(t, "a.txt", "contents", storedFile{Sum: hex.EncodeToString(sum[:])})
+	storeLocally(t, "b.txt", "contents", storedFile{})
+	scrubFile("a.txt")
+	scrubFile("b.txt")
+	storedFilesMutex.Lock()
+	a, b := storedFiles["a.txt"], storedFiles["b.txt"]
+	storedFilesMutex.Unlock()
+	if a.Corrupt {
+		t.Errorf("the intact a.txt was marked as corrupt")
+	}
+	// A file without a checksum gets the one of its contents.
+	if b.Sum != hex.EncodeToString(sum[:]) || b.Corrupt {
+		t.Errorf("b.txt: sum = %q, corrupt = %v, want the sum of its contents", b.Sum, b.Corrupt)
+	}
+	// A bit flips on the disk.
+	if err := os.WriteFile(filePath("a.txt"), []byte("contentz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scrubFile("a.txt")
+	storedFilesMutex.Lock()
+	a = storedFiles["a.txt"]
+	storedFilesMutex.Unlock()
+	if !a.Corrupt {
+		t.Fatalf("the corrupted a.txt was not detected")
+	}
+	if reply := handle(t, handleRetrieveRequest, "RETRIEVE a.txt"); reply != "ERR File is corrupt." {
+		t.Errorf("RETRIEVE = %q, want the corrupt file refused", reply)
+	}
+}
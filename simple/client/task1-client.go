@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -22,6 +24,55 @@ Welcome, %s.
 var serverReader *bufio.Reader
 var stdReader *bufio.Reader
 
+var metricsMode = flag.String("metrics", "", "report the transfers as a summary at exit (summary) or as JSON lines (json) on stderr, instead of printing each one")
+
+// A single file transfer, as reported in the metrics.
+type transfer struct {
+	Op       string `json:"op"`
+	File     string `json:"file"`
+	Bytes    int64  `json:"bytes"`
+	Duration int64  `json:"us"`
+}
+
+var transfers []transfer
+
+// Reports a completed transfer according to the metrics mode.
+func recordTransfer(op string, fileName string, bytes int64, elapsed time.Duration) {
+	t := transfer{Op: op, File: fileName, Bytes: bytes, Duration: elapsed.Microseconds()}
+	switch *metricsMode {
+	case "json":
+		line, _ := json.Marshal(t)
+		fmt.Fprintln(os.Stderr, string(line))
+	case "summary":
+		transfers = append(transfers, t)
+	default:
+		fmt.Println("Transfer took", t.Duration, "us")
+	}
+}
+
+// Prints the count, the total size and the throughput of the recorded transfers.
+func printTransferSummary() {
+	if len(transfers) < 1 {
+		fmt.Fprintln(os.Stderr, "transfers=0")
+		return
+	}
+	var totalBytes, totalDuration int64
+	minThroughput, maxThroughput := -1.0, 0.0
+	for _, t := range transfers {
+		totalBytes += t.Bytes
+		totalDuration += t.Duration
+		// In MB/s, i.e. bytes per microsecond.
+		throughput := float64(t.Bytes) / float64(max(t.Duration, 1))
+		if minThroughput < 0 || throughput < minThroughput {
+			minThroughput = throughput
+		}
+		maxThroughput = max(maxThroughput, throughput)
+	}
+	avgThroughput := float64(totalBytes) / float64(max(totalDuration, 1))
+	fmt.Fprintf(os.Stderr, "transfers=%d bytes=%d min_mbps=%.2f avg_mbps=%.2f max_mbps=%.2f\n",
+		len(transfers), totalBytes, minThroughput, avgThroughput, maxThroughput)
+}
+
 // Extracts the argument from a server response.
 func extractArg(serverResponse string) string {
 	i := strings.IndexByte(serverResponse, ' ')
@@ -50,7 +101,7 @@ func handleMessage(conn net.Conn, msg string) {
 
 // Handles a `STORE` response from the server.
 // Stores a file in the server.
-func handleStore(conn net.Conn, fileName string) {
+func handleStore(conn net.Conn, fileName string) int64 {
 	srcFile, err := os.Open(fileName)
 	defer srcFile.Close()
 	if os.IsNotExist(err) {
@@ -61,29 +112,38 @@ func handleStore(conn net.Conn, fileName string) {
 	fileSize := fmt.Sprintf("%d\n", srcFileInfo.Size())
 	conn.Write([]byte(fileSize))
 	// Send the file to the server.
-	_, err = io.Copy(conn, srcFile)
+	n, err := io.Copy(conn, srcFile)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	return n
 }
 
 // Handles a `RETRIEVE` response from the server.
 // Retrieves a file from the server.
-func handleRetrieve(conn net.Conn, fileName string) {
-	dstFile, _ := os.Create(fileName)
-	defer dstFile.Close()
+func handleRetrieve(conn net.Conn, fileName string) int64 {
 	// Retrieve the size information from the server.
 	size, _ := serverReader.ReadString('\n')
 	size = strings.TrimSpace(size)
-	sizeBytes, _ := strconv.Atoi(size)
+	sizeBytes, _ := strconv.ParseInt(size, 10, 64)
+	dstFile, err := os.Create(fileName)
+	if err != nil {
+		fmt.Println("> Could not create the local file:", err)
+		// Skip the file, so that the next server response can be read.
+		io.CopyN(io.Discard, serverReader, sizeBytes)
+		return 0
+	}
+	defer dstFile.Close()
 	// Retrieve the file from the client w.r.t. the size.
-	io.CopyN(dstFile, serverReader, int64(sizeBytes))
+	n, _ := io.CopyN(dstFile, serverReader, sizeBytes)
+	return n
 }
 
 func main() {
 	// Acquire the server information.
-	serverIP := os.Args[1]
-	serverPort := os.Args[2]
+	flag.Parse()
+	serverIP := flag.Arg(0)
+	serverPort := flag.Arg(1)
 	// Connect to the server.
 	fmt.Print("Connecting... ")
 	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", serverIP, serverPort))
@@ -113,17 +173,20 @@ func main() {
 		} else if strings.HasPrefix(serverResponse, "STORE") {
 			// Keep track of the time as we transfer a file.
 			start := time.Now()
-			handleStore(conn, extractArg(serverResponse))
-			elapsed := time.Since(start)
-			fmt.Println("Transfer took", elapsed.Microseconds(), "us")
+			fileName := extractArg(serverResponse)
+			n := handleStore(conn, fileName)
+			recordTransfer("store", fileName, n, time.Since(start))
 		} else if strings.HasPrefix(serverResponse, "RETRIEVE") {
 			// Keep track of the time as we transfer a file.
 			start := time.Now()
-			handleRetrieve(conn, extractArg(serverResponse))
-			elapsed := time.Since(start)
-			fmt.Println("Transfer took", elapsed.Microseconds(), "us")
+			fileName := extractArg(serverResponse)
+			n := handleRetrieve(conn, fileName)
+			recordTransfer("retrieve", fileName, n, time.Since(start))
 		} else if strings.HasPrefix(serverResponse, "CLOSE") {
 			fmt.Println("Goodbye!")
+			if *metricsMode == "summary" {
+				printTransferSummary()
+			}
 			conn.Close()
 			return
 		} else {
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetrieveIntoAnUncreatableFileSkipsIt(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// A directory stands where the local file should be created.
+	os.Mkdir("a.txt", 0755)
+	oldServerReader := serverReader
+	t.Cleanup(func() { serverReader = oldServerReader })
+	serverReader = bufio.NewReader(strings.NewReader("8\ncontentsMSG File successfully retrieved.\n"))
+	if n := handleRetrieve(nil, "a.txt"); n != 0 {
+		t.Errorf("retrieved %d bytes", n)
+	}
+	// The contents are skipped, so the next response can be read.
+	if response, _ := serverReader.ReadString('\n'); response != "MSG File successfully retrieved.\n" {
+		t.Errorf("next response = %q", response)
+	}
+}
+
+// Runs the given function and returns what it prints to the standard error.
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStderr := os.Stderr
+	os.Stderr = w
+	output := make(chan string)
+	go func() {
+		contents, _ := io.ReadAll(r)
+		output <- string(contents)
+	}()
+	f()
+	os.Stderr = oldStderr
+	w.Close()
+	return <-output
+}
+
+// Sets the metrics mode until the test is over.
+func useMetricsMode(t *testing.T, mode string) {
+	oldMode, oldTransfers := *metricsMode, transfers
+	t.Cleanup(func() { *metricsMode, transfers = oldMode, oldTransfers })
+	*metricsMode, transfers = mode, nil
+}
+
+func TestTransfersAsJSONLines(t *testing.T) {
+	useMetricsMode(t, "json")
+	output := captureStderr(t, func() {
+		recordTransfer("store", "a.txt", 1000, time.Millisecond)
+		recordTransfer("retrieve", "a.txt", 1000, 2*time.Millisecond)
+		recordTransfer("store", "b.txt", 500, time.Millisecond)
+	})
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("output = %q, want 3 lines", output)
+	}
+	var second transfer
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatal(err)
+	}
+	if second != (transfer{Op: "retrieve", File: "a.txt", Bytes: 1000, Duration: 2000}) {
+		t.Errorf("second transfer = %+v", second)
+	}
+}
+
+func TestTransferSummary(t *testing.T) {
+	useMetricsMode(t, "summary")
+	output := captureStderr(t, func() {
+		recordTransfer("store", "a.txt", 1000, time.Millisecond)
+		recordTransfer("retrieve", "a.txt", 3000, time.Millisecond)
+	})
+	if output != "" {
+		t.Errorf("printed %q before the summary", output)
+	}
+	output = captureStderr(t, printTransferSummary)
+	if output != "transfers=2 bytes=4000 min_mbps=1.00 avg_mbps=2.00 max_mbps=3.00\n" {
+		t.Errorf("summary = %q", output)
+	}
+}
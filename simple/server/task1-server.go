@@ -2,148 +2,342 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Session represents a session of a client.
 type Session struct {
-	SessionID int
+	// Unique across server runs, see newSessionID.
+	SessionID string
 	UserName  string
 }
 
+// A random nonce chosen once per server run.
+var runNonce = newRunNonce()
+
+// Returns a random nonce to distinguish this server run from the others.
+func newRunNonce() string {
+	nonce := make([]byte, 4)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// Returns the session id for the given per-run session counter. The counter restarts
+// from 0 with each run, so it is prefixed with the run nonce to keep the ids unique
+// across restarts.
+func newSessionID(counter int) string {
+	return fmt.Sprintf("%s-%d", runNonce, counter)
+}
+
+var maxLineLength = flag.Int("maxline", 8192, "maximum length of a line sent by a client in bytes")
+
+var errLineTooLong = errors.New("request too large")
+
+var maxSessions = flag.Int("maxsessions", 0, "maximum number of sessions at once (0 for no limit)")
+
+// The number of live sessions.
+var activeSessions atomic.Int64
+
+var shutdownGrace = flag.Duration("grace", 30*time.Second, "how long to wait for the live sessions to finish their operations on shutdown")
+
+var allowedExtensions = flag.String("allowext", "", "comma separated extensions that can be stored, \".\" for no extension (default: all)")
+var deniedExtensions = flag.String("denyext", "", "comma separated extensions that can not be stored, \".\" for no extension")
+
+var dirMode = fileMode(0755)
+var userFileMode = fileMode(0644)
+
+func init() {
+	flag.Var(&dirMode, "dirmode", "permissions of the user directories, in octal")
+	flag.Var(&userFileMode, "filemode", "permissions of the user files, in octal")
+}
+
+// A file mode flag, given and shown in octal.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *fileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return errors.New("not an octal permission mode")
+	}
+	*m = fileMode(mode)
+	return nil
+}
+
+var userRoot = flag.String("userroot", ".", "directory under which the user directories are created")
+
+// Returns the directory of the given user under the user root.
+func userDir(session Session) string {
+	return filepath.Join(*userRoot, session.UserName)
+}
+
+// Checks that the user root is an existing directory that the server can write into.
+func checkUserRoot() error {
+	info, err := os.Stat(*userRoot)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", *userRoot)
+	}
+	probe, err := os.CreateTemp(*userRoot, ".probe")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// Reads a single line from the client. Lines longer than the maximum line length are
+// not buffered and errLineTooLong is returned instead.
+func readLine(clientReader *bufio.Reader) (string, error) {
+	line, err := clientReader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
 // Returns the requested file by the given session. We create folders
 // for each user in order to separate their files.
 func getUserFile(conn net.Conn, session Session, fileName string) (*os.File, error) {
-	fullFilePath := filepath.Join(session.UserName, fileName)
+	fullFilePath := filepath.Join(userDir(session), fileName)
 	f, err := os.Open(fullFilePath)
 	return f, err
 }
 
+// Checks whether the file name's extension passes the allow & deny lists. Matching is
+// case-insensitive, and a file without an extension is matched by a "." entry.
+func extensionAllowed(fileName string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))
+	if ext == "" {
+		ext = "."
+	}
+	if *allowedExtensions != "" && !extensionListed(*allowedExtensions, ext) {
+		return false
+	}
+	return !extensionListed(*deniedExtensions, ext)
+}
+
+// Checks whether the comma separated list of extensions contains the given one.
+func extensionListed(list string, ext string) bool {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "." {
+			entry = strings.TrimPrefix(entry, ".")
+		}
+		if entry == ext {
+			return true
+		}
+	}
+	return false
+}
+
 // Sends a response to the client in the form of <RESP TYPE> <ARGUMENT>
 // In the client, these will be evaluated as a command and its argument.
-func sendResponse(conn net.Conn, respType string, arg string) {
-	conn.Write([]byte(respType + " " + arg + "\n"))
+// Returns an error if the client can not be written to, e.g. if it has disconnected.
+func sendResponse(conn net.Conn, respType string, arg string) error {
+	_, err := conn.Write([]byte(respType + " " + arg + "\n"))
+	return err
 }
 
 // Creates/truncates a new file for the user. Does not write anything into it.
 func createUserFile(conn net.Conn, clientReader *bufio.Reader, session Session, fileName string) (*os.File, error) {
+	if !extensionAllowed(fileName) {
+		return nil, fmt.Errorf("the extension of %s is not allowed", fileName)
+	}
 	// Create the user directory if it doesn't exist.
-	_, err := os.Stat(session.UserName)
+	_, err := os.Stat(userDir(session))
 	if os.IsNotExist(err) {
-		os.MkdirAll(session.UserName, 0777)
+		err = os.MkdirAll(userDir(session), os.FileMode(dirMode))
+		if err == nil {
+			// Set the permissions regardless of the umask.
+			err = os.Chmod(userDir(session), os.FileMode(dirMode))
+		}
 		if err != nil {
-			fmt.Println("* Created user directory for", session.UserName)
+			return nil, err
 		}
+		fmt.Printf("* [%s] Created user directory for %s\n", session.SessionID, session.UserName)
 	}
 	// Try to find the file.
-	fullFilePath := filepath.Join(session.UserName, fileName)
+	fullFilePath := filepath.Join(userDir(session), fileName)
 	_, err = os.Stat(fullFilePath)
 	if !os.IsNotExist(err) {
 		// If the file already exists, ask the client to confirm overwriting
 		// the old file.
-		overwrite, _ := askInput(conn, clientReader,
+		overwrite, err := askInput(conn, clientReader,
 			"File "+fileName+" already exists. Overwrite? (Y/N)")
+		if err != nil {
+			return nil, err
+		}
 		if strings.ToLower(overwrite) != "y" {
 			return nil, errors.New("canceled by the user")
 		}
 	}
 	// Create/truncate the file.
-	f, err := os.Create(fullFilePath)
+	f, err := os.OpenFile(fullFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.FileMode(userFileMode))
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("* Created user file ", fullFilePath)
+	// Set the permissions regardless of the umask, or of the previous file.
+	f.Chmod(os.FileMode(userFileMode))
+	fmt.Printf("* [%s] Created user file %s\n", session.SessionID, fullFilePath)
 	return f, nil
 }
 
-// Sends a `PROMPT` response to the client.
+// Sends a `PROMPT` response to the client. If the answer is too long, the client is
+// told so and the connection is closed.
 func askInput(conn net.Conn, clientReader *bufio.Reader, msg string) (string, error) {
-	sendResponse(conn, "PROMPT", msg)
-	input, err := clientReader.ReadString('\n')
+	err := sendResponse(conn, "PROMPT", msg)
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(input), nil
+	input, err := readLine(clientReader)
+	if err == errLineTooLong {
+		fmt.Printf("* Rejected a line longer than %d bytes\n", *maxLineLength)
+		sendResponse(conn, "MSG", "Request too large.")
+		sendResponse(conn, "CLOSE", "")
+		conn.Close()
+	}
+	return input, err
 }
 
-// Handles the `login` selection of the client.
-func handleLogin(conn net.Conn, clientReader *bufio.Reader, session *Session) {
+// Handles the `login` selection of the client. Returns an error if the client can not
+// be talked to anymore, which ends the session.
+func handleLogin(conn net.Conn, clientReader *bufio.Reader, session *Session) error {
 	input, err := askInput(conn, clientReader, "Enter username")
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	session.UserName = input
-	fmt.Printf("* User changed for client %d to %s\n", session.SessionID, session.UserName)
-	sendResponse(conn, "MSG", "Success.")
-	sendResponse(conn, "MENU", session.UserName)
+	fmt.Printf("* [%s] User changed to %s\n", session.SessionID, session.UserName)
+	err = sendResponse(conn, "MSG", "Success.")
+	if err != nil {
+		return err
+	}
+	return sendResponse(conn, "MENU", session.UserName)
 }
 
-// Handles the `store a file` selection of the client.
-func handleStore(conn net.Conn, clientReader *bufio.Reader, session Session) {
-	fileName, _ := askInput(conn, clientReader, "Enter the file name to store")
+// Handles the `store a file` selection of the client. Returns an error if the client
+// can not be talked to anymore, which ends the session.
+func handleStore(conn net.Conn, clientReader *bufio.Reader, session Session) error {
+	fileName, err := askInput(conn, clientReader, "Enter the file name to store")
+	if err != nil {
+		return err
+	}
 	dstFile, err := createUserFile(conn, clientReader, session, fileName)
-	defer dstFile.Close()
 	if err != nil {
-		sendResponse(conn, "MSG", err.Error())
-		return
+		return sendResponse(conn, "MSG", err.Error())
+	}
+	// The file is truncated already, do not leave it half written if the client goes
+	// away.
+	stored := false
+	defer func() {
+		dstFile.Close()
+		if !stored {
+			os.Remove(dstFile.Name())
+		}
+	}()
+	err = sendResponse(conn, "STORE", fileName)
+	if err != nil {
+		return err
 	}
-	sendResponse(conn, "STORE", fileName)
 	// Retrieve the size information from the client.
-	size, _ := clientReader.ReadString('\n')
-	size = strings.TrimSpace(size)
-	sizeBytes, _ := strconv.Atoi(size)
+	size, err := readLine(clientReader)
+	if err != nil {
+		return err
+	}
+	sizeBytes, _ := strconv.ParseInt(size, 10, 64)
 	// Retrieve the file from the client w.r.t. the size.
-	_, err = io.CopyN(dstFile, clientReader, int64(sizeBytes))
+	_, err = io.CopyN(dstFile, clientReader, sizeBytes)
 	if err != nil {
-		sendResponse(conn, "MSG", err.Error())
-		return
+		return sendResponse(conn, "MSG", err.Error())
 	}
-	fmt.Println("* Stored user file ", dstFile.Name())
-	sendResponse(conn, "MSG", "File successfully stored.")
+	stored = true
+	fmt.Printf("* [%s] Stored user file %s\n", session.SessionID, dstFile.Name())
+	return sendResponse(conn, "MSG", "File successfully stored.")
 }
 
-// Handles the `retrieve a file` request of the client.
-func handleRetrieve(conn net.Conn, clientReader *bufio.Reader, session Session) {
-	fileName, _ := askInput(conn, clientReader, "Enter the file name to retrieve")
+// Handles the `retrieve a file` request of the client. Returns an error if the client
+// can not be talked to anymore, which ends the session.
+func handleRetrieve(conn net.Conn, clientReader *bufio.Reader, session Session) error {
+	fileName, err := askInput(conn, clientReader, "Enter the file name to retrieve")
+	if err != nil {
+		return err
+	}
 	srcFile, err := getUserFile(conn, session, fileName)
-	defer srcFile.Close()
 	if os.IsNotExist(err) {
-		sendResponse(conn, "MSG", "File does not exist.")
-		return
+		return sendResponse(conn, "MSG", "File does not exist.")
+	}
+	if err != nil {
+		return sendResponse(conn, "MSG", err.Error())
+	}
+	defer srcFile.Close()
+	err = sendResponse(conn, "RETRIEVE", fileName)
+	if err != nil {
+		return err
 	}
-	sendResponse(conn, "RETRIEVE", fileName)
 	// Send the file size to the client.
 	srcFileInfo, _ := srcFile.Stat()
 	fileSize := fmt.Sprintf("%d\n", srcFileInfo.Size())
-	conn.Write([]byte(fileSize))
+	_, err = conn.Write([]byte(fileSize))
+	if err != nil {
+		return err
+	}
 	// Send the file to the client.
 	_, err = io.Copy(conn, srcFile)
 	if err != nil {
-		sendResponse(conn, "MSG", err.Error())
-		return
+		return err
 	}
-	sendResponse(conn, "MSG", "File successfully retrieved.")
+	return sendResponse(conn, "MSG", "File successfully retrieved.")
 }
 
-func handleSession(conn net.Conn, session Session) {
-	clientReader := bufio.NewReader(conn)
+// Handles the session until the client leaves, or the given context is canceled.
+// Once canceled, the session finishes its current operation and closes.
+func handleSession(ctx context.Context, conn net.Conn, session Session) {
+	// The buffer can hold at most one line, see readLine.
+	clientReader := bufio.NewReaderSize(conn, *maxLineLength)
 	sendResponse(conn, "MENU", session.UserName)
 	// Each session has its own loop where the server asks the client for a selection
 	// and according to the selection, the server does the job.
 	for {
-		// Ask for choice.
+		if ctx.Err() != nil {
+			sendResponse(conn, "CLOSE", "")
+			return
+		}
+		// Ask for choice. Stop waiting for it if the server is shutting down.
+		stopWaiting := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
 		input, err := askInput(conn, clientReader, "Please choose an option")
+		stopWaiting()
+		if err != nil && ctx.Err() != nil {
+			sendResponse(conn, "CLOSE", "")
+			return
+		}
 		if err != nil {
-			log.Println(err)
+			log.Printf("* [%s] %s\n", session.SessionID, err)
 			return
 		}
 		var chosenOption int
@@ -151,43 +345,90 @@ func handleSession(conn net.Conn, session Session) {
 		// Find the correct handler according to the selection.
 		switch chosenOption {
 		case 1:
-			handleLogin(conn, clientReader, &session)
+			err = handleLogin(conn, clientReader, &session)
 		case 2:
-			handleStore(conn, clientReader, session)
+			err = handleStore(conn, clientReader, session)
 		case 3:
-			handleRetrieve(conn, clientReader, session)
+			err = handleRetrieve(conn, clientReader, session)
 		case 4:
 			// Confirm the closure of the connection by sending back a
 			// CLOSE response.
-			sendResponse(conn, "CLOSE", "")
-			break
+			err = sendResponse(conn, "CLOSE", "")
+		}
+		// Stop as soon as the client can not be talked to anymore.
+		if err != nil {
+			log.Printf("* [%s] %s\n", session.SessionID, err)
+			return
 		}
 	}
 }
 
 func main() {
 	// Acquire the server port.
-	port := os.Args[1]
+	flag.Parse()
+	port := flag.Arg(0)
+	err := checkUserRoot()
+	if err != nil {
+		log.Fatalf("Invalid user root: %s", err)
+	}
 	// Launch the server.
-	fmt.Printf("Launching the server at the port %s...\n", port)
+	fmt.Printf("Launching the server at the port %s (run %s)...\n", port, runNonce)
 	lst, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		log.Fatalf("Could not create the server: %s", err)
 	}
-	lastSessionID := 0
+	// Stop accepting the clients on an interrupt, and let the sessions finish.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		lst.Close()
+	}()
+	var sessions sync.WaitGroup
+	sessionCounter := 0
 	// Main program loop.
 	for {
 		// Accept a connection.
 		conn, err := lst.Accept()
+		if err != nil && ctx.Err() != nil {
+			break
+		}
 		if err != nil {
 			log.Printf("* Could not accept the connection: %s\n", err)
 			continue
 		}
+		// Turn the client away if there are too many sessions.
+		if *maxSessions > 0 && activeSessions.Load() >= int64(*maxSessions) {
+			fmt.Printf("* Rejected a client, %d sessions are live\n", *maxSessions)
+			sendResponse(conn, "MSG", "Too many sessions, try again later.")
+			sendResponse(conn, "CLOSE", "")
+			conn.Close()
+			continue
+		}
 		// Construct the session.
-		session := Session{SessionID: lastSessionID, UserName: "Guest"}
-		lastSessionID++
-		fmt.Printf("* Client connected with a session id of %d\n", session.SessionID)
+		session := Session{SessionID: newSessionID(sessionCounter), UserName: "Guest"}
+		sessionCounter++
+		fmt.Printf("* [%s] Client connected (%d live sessions)\n", session.SessionID, activeSessions.Add(1))
 		// Handle the session.
-		go handleSession(conn, session)
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			handleSession(ctx, conn, session)
+			conn.Close()
+			fmt.Printf("* [%s] Session ended (%d live sessions)\n", session.SessionID, activeSessions.Add(-1))
+		}()
+	}
+	// Wait for the live sessions, up to the grace period.
+	fmt.Printf("* Shutting down, waiting for %d live sessions...\n", activeSessions.Load())
+	done := make(chan struct{})
+	go func() {
+		sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		fmt.Println("* All sessions ended, goodbye!")
+	case <-time.After(*shutdownGrace):
+		fmt.Printf("* Gave up on %d live sessions after %s\n", activeSessions.Load(), *shutdownGrace)
 	}
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs a session under the given context on one end of a pipe, and returns the other
+// end to talk to it, along with a channel that is closed once the session is over.
+func startSession(t *testing.T, ctx context.Context) (net.Conn, *bufio.Reader, chan bool) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		defer server.Close()
+		handleSession(ctx, server, Session{SessionID: newSessionID(0)})
+	}()
+	return client, bufio.NewReader(client), done
+}
+
+// Reads the next response of the server, and fails unless it is the given one.
+func expect(t *testing.T, reader *bufio.Reader, want string) {
+	t.Helper()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("waiting for %q: %v", want, err)
+	}
+	if line != want+"\n" {
+		t.Fatalf("response = %q, want %q", line, want)
+	}
+}
+
+func TestOverLongLineIsRejected(t *testing.T) {
+	client, reader, done := startSession(t, context.Background())
+	expect(t, reader, "MENU ")
+	expect(t, reader, "PROMPT Please choose an option")
+	// The line is never ended, so the server must give up before reading all of it.
+	go client.Write([]byte(strings.Repeat("1", 2**maxLineLength)))
+	expect(t, reader, "MSG Request too large.")
+	expect(t, reader, "CLOSE ")
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("connection not closed: err = %v", err)
+	}
+	<-done
+}
+
+func TestSessionIDsAreUniqueAcrossRestarts(t *testing.T) {
+	oldRunNonce := runNonce
+	t.Cleanup(func() { runNonce = oldRunNonce })
+	seen := make(map[string]bool)
+	for run := 0; run < 3; run++ {
+		// Each run starts counting the sessions from 0 again.
+		runNonce = newRunNonce()
+		for counter := 0; counter < 5; counter++ {
+			id := newSessionID(counter)
+			if seen[id] {
+				t.Fatalf("run %d: session id %s was already used", run, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestUserFilesLandUnderTheUserRoot(t *testing.T) {
+	root := t.TempDir()
+	oldUserRoot := *userRoot
+	t.Cleanup(func() { *userRoot = oldUserRoot })
+	*userRoot = root
+	if err := checkUserRoot(); err != nil {
+		t.Fatal(err)
+	}
+	session := Session{SessionID: newSessionID(0), UserName: "alice"}
+	f, err := createUserFile(nil, nil, session, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := os.Stat(filepath.Join(root, "alice", "a.txt")); err != nil {
+		t.Errorf("the file is not under the user root: %v", err)
+	}
+	f, err = getUserFile(nil, session, "a.txt")
+	if err != nil {
+		t.Fatalf("could not get the file back: %v", err)
+	}
+	f.Close()
+	// A missing root, or a file in place of it, is rejected at startup.
+	*userRoot = filepath.Join(root, "missing")
+	if err := checkUserRoot(); err == nil {
+		t.Errorf("accepted the missing root %s", *userRoot)
+	}
+	*userRoot = filepath.Join(root, "alice", "a.txt")
+	if err := checkUserRoot(); err == nil {
+		t.Errorf("accepted the file %s as the root", *userRoot)
+	}
+}
+
+// Sets the allow & deny lists of the extensions until the test is over.
+func useExtensionLists(t *testing.T, allowed string, denied string) {
+	oldAllowed, oldDenied := *allowedExtensions, *deniedExtensions
+	t.Cleanup(func() { *allowedExtensions, *deniedExtensions = oldAllowed, oldDenied })
+	*allowedExtensions, *deniedExtensions = allowed, denied
+}
+
+func TestExtensionLists(t *testing.T) {
+	for _, c := range []struct {
+		allowed, denied string
+		fileName        string
+		want            bool
+	}{
+		// An allow list.
+		{"txt,.md", "", "a.txt", true},
+		{"txt,.md", "", "b.MD", true},
+		{"txt,.md", "", "c.EXE", false},
+		{"txt,.md", "", "README", false},
+		{"txt,.", "", "README", true},
+		// A deny list.
+		{"", "exe", "a.txt", true},
+		{"", "exe", "c.Exe", false},
+		{"", "exe", "README", true},
+		{"", "exe,.", "README", false},
+	} {
+		useExtensionLists(t, c.allowed, c.denied)
+		if got := extensionAllowed(c.fileName); got != c.want {
+			t.Errorf("allow %q, deny %q: %s allowed = %v, want %v", c.allowed, c.denied, c.fileName, got, c.want)
+		}
+	}
+}
+
+func TestDeniedFileIsRejectedBeforeItIsCreated(t *testing.T) {
+	root := t.TempDir()
+	oldUserRoot := *userRoot
+	t.Cleanup(func() { *userRoot = oldUserRoot })
+	*userRoot = root
+	useExtensionLists(t, "", "exe")
+	session := Session{SessionID: newSessionID(0), UserName: "alice"}
+	_, err := createUserFile(nil, nil, session, "tool.exe")
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("err = %v, want the extension rejected", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "alice", "tool.exe")); !os.IsNotExist(err) {
+		t.Errorf("the denied file was created: %v", err)
+	}
+}
+
+func TestShutdownLetsTheTransferFinish(t *testing.T) {
+	root := t.TempDir()
+	oldUserRoot := *userRoot
+	t.Cleanup(func() { *userRoot = oldUserRoot })
+	*userRoot = root
+	ctx, shutDown := context.WithCancel(context.Background())
+	defer shutDown()
+	client, reader, done := startSession(t, ctx)
+	expect(t, reader, "MENU ")
+	expect(t, reader, "PROMPT Please choose an option")
+	client.Write([]byte("2\n"))
+	expect(t, reader, "PROMPT Enter the file name to store")
+	client.Write([]byte("a.txt\n"))
+	expect(t, reader, "STORE a.txt")
+	client.Write([]byte("8\ncont"))
+	// The server shuts down halfway through the upload.
+	shutDown()
+	time.Sleep(50 * time.Millisecond)
+	client.Write([]byte("ents"))
+	expect(t, reader, "MSG File successfully stored.")
+	expect(t, reader, "CLOSE ")
+	<-done
+	if contents, _ := os.ReadFile(filepath.Join(root, "a.txt")); string(contents) != "contents" {
+		t.Errorf("a.txt = %q", contents)
+	}
+}
+
+func TestUserFilesGetTheConfiguredPermissions(t *testing.T) {
+	root := t.TempDir()
+	oldUserRoot, oldDirMode, oldUserFileMode := *userRoot, dirMode, userFileMode
+	t.Cleanup(func() { *userRoot, dirMode, userFileMode = oldUserRoot, oldDirMode, oldUserFileMode })
+	*userRoot = root
+	if err := dirMode.Set("700"); err != nil {
+		t.Fatal(err)
+	}
+	if err := userFileMode.Set("600"); err != nil {
+		t.Fatal(err)
+	}
+	session := Session{SessionID: newSessionID(0), UserName: "alice"}
+	f, err := createUserFile(nil, nil, session, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	for path, want := range map[string]os.FileMode{filepath.Join(root, "alice"): 0700, filepath.Join(root, "alice", "a.txt"): 0600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s: permissions = %v, want %v", path, info.Mode().Perm(), want)
+		}
+	}
+	if err := userFileMode.Set("rw"); err == nil {
+		t.Error("accepted the mode rw")
+	}
+}
+
+// Waits for the session to end, and fails if it does not.
+func awaitSessionEnd(t *testing.T, done chan bool) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not end")
+	}
+}
+
+func TestSessionStopsOnceTheClientDisconnects(t *testing.T) {
+	root := t.TempDir()
+	oldUserRoot := *userRoot
+	t.Cleanup(func() { *userRoot = oldUserRoot })
+	*userRoot = root
+	// The client leaves in the middle of a store, the half written file is removed.
+	client, reader, done := startSession(t, context.Background())
+	expect(t, reader, "MENU ")
+	expect(t, reader, "PROMPT Please choose an option")
+	client.Write([]byte("2\n"))
+	expect(t, reader, "PROMPT Enter the file name to store")
+	client.Write([]byte("a.txt\n"))
+	expect(t, reader, "STORE a.txt")
+	client.Close()
+	awaitSessionEnd(t, done)
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			t.Errorf("%s was left behind", path)
+		}
+		return nil
+	})
+	// The client leaves before the answer to a retrieve, which can not be written.
+	client, reader, done = startSession(t, context.Background())
+	expect(t, reader, "MENU ")
+	expect(t, reader, "PROMPT Please choose an option")
+	client.Write([]byte("3\n"))
+	expect(t, reader, "PROMPT Enter the file name to retrieve")
+	client.Write([]byte("a.txt\n"))
+	client.Close()
+	awaitSessionEnd(t, done)
+}